@@ -206,7 +206,13 @@ if [[ -n "$bot_token" ]] && [[ -n "$admin_id" ]]; then
   cd /etc/zivpn/api
   run_silent "Downloading Bot Deps" "go get github.com/go-telegram-bot-api/telegram-bot-api/v5"
   
-  if go build -o zivpn-bot "$bot_file" &>/dev/null; then
+  # Stamp the release tag so /version can compare it with release_check_url;
+  # fall back to the commit when there is no release yet
+  bot_version=$(wget -qO- https://api.github.com/repos/KAISARVPN/Premium/releases/latest | grep -m1 '"tag_name"' | cut -d'"' -f4)
+  bot_version=${bot_version:-$(wget -qO- https://api.github.com/repos/KAISARVPN/Premium/commits/main | grep -m1 '"sha"' | cut -d'"' -f4 | cut -c1-7)}
+  bot_version=${bot_version:-$(date +%Y%m%d)}
+
+  if go build -ldflags "-X main.Version=$bot_version" -o zivpn-bot "$bot_file" &>/dev/null; then
     print_done "Compiling Bot"
     
     cat <<EOF > /etc/systemd/system/zivpn-bot.service
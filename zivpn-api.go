@@ -1,3 +1,7 @@
+//go:build api
+
+// zivpn-api is built on its own (go build zivpn-api.go, see install.sh). The tag
+// keeps it out of ./..., which is the free bot and its tests.
 package main
 
 import (
@@ -8,6 +12,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"os/exec"
 	"strings"
 	"sync"
@@ -15,11 +20,12 @@ import (
 )
 
 const (
-	ConfigFile = "/etc/zivpn/config.json"
-	UserDB     = "/etc/zivpn/users.json"
-	DomainFile = "/etc/zivpn/domain"
-	ApiKeyFile = "/etc/zivpn/apikey"
-	Port       = "/etc/zivpn/api_port"
+	ConfigFile   = "/etc/zivpn/config.json"
+	UserDB       = "/etc/zivpn/users.json"
+	DomainFile   = "/etc/zivpn/domain"
+	ApiKeyFile   = "/etc/zivpn/apikey"
+	MaxUsersFile = "/etc/zivpn/max_users" // Optional server capacity, reported by /api/info
+	Port         = "/etc/zivpn/api_port"
 )
 
 var AuthToken = "AutoFtBot-agskjgdvsbdreiWG1234512SDKrqw"
@@ -38,6 +44,7 @@ type Config struct {
 type UserRequest struct {
 	Password string `json:"password"`
 	Days     int    `json:"days"`
+	Expired  string `json:"expired,omitempty"`
 }
 
 type UserStore struct {
@@ -65,7 +72,10 @@ func main() {
 	http.HandleFunc("/api/user/create", authMiddleware(createUser))
 	http.HandleFunc("/api/user/delete", authMiddleware(deleteUser))
 	http.HandleFunc("/api/user/renew", authMiddleware(renewUser))
+	http.HandleFunc("/api/user/lock", authMiddleware(lockUser))
+	http.HandleFunc("/api/user/unlock", authMiddleware(unlockUser))
 	http.HandleFunc("/api/users", authMiddleware(listUsers))
+	http.HandleFunc("/api/user/get", authMiddleware(getUser))
 	http.HandleFunc("/api/info", authMiddleware(getSystemInfo))
 	http.HandleFunc("/api/cron/expire", authMiddleware(checkExpiration))
 
@@ -286,6 +296,16 @@ func renewUser(w http.ResponseWriter, r *http.Request) {
 
 			newExp := currentExp.Add(time.Duration(req.Days) * 24 * time.Hour)
 			newExpDate = newExp.Format("2006-01-02")
+
+			// Absolute date from the client wins, as long as it does not shorten the account
+			if req.Expired != "" {
+				requested, err := time.Parse("2006-01-02", req.Expired)
+				if err != nil || requested.Before(currentExp) {
+					jsonResponse(w, http.StatusBadRequest, false, "Tanggal expired tidak valid", nil)
+					return
+				}
+				newExpDate = requested.Format("2006-01-02")
+			}
 			
 			u.Expired = newExpDate
 			
@@ -321,45 +341,141 @@ func renewUser(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func listUsers(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+func lockUser(w http.ResponseWriter, r *http.Request) {
+	setUserLocked(w, r, true)
+}
+
+func unlockUser(w http.ResponseWriter, r *http.Request) {
+	setUserLocked(w, r, false)
+}
+
+// setUserLocked flips a user between "locked" and "active" without touching
+// the expiry date, and removes/re-adds the password in the zivpn config.
+func setUserLocked(w http.ResponseWriter, r *http.Request, locked bool) {
+	if r.Method != http.MethodPost {
 		jsonResponse(w, http.StatusMethodNotAllowed, false, "Method not allowed", nil)
 		return
 	}
 
+	var req UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonResponse(w, http.StatusBadRequest, false, "Invalid request body", nil)
+		return
+	}
+
+	mutex.Lock()
 	users, err := loadUsers()
 	if err != nil {
+		mutex.Unlock()
 		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca database user", nil)
 		return
 	}
 
-	type UserInfo struct {
-		Password string `json:"password"`
-		Expired  string `json:"expired"`
-		Status   string `json:"status"`
+	found := false
+	status := "active"
+	if locked {
+		status = "locked"
+	}
+	for i, u := range users {
+		if u.Password == req.Password {
+			found = true
+			users[i].Status = status
+		}
+	}
+
+	if !found {
+		mutex.Unlock()
+		jsonResponse(w, http.StatusNotFound, false, "User tidak ditemukan di database", nil)
+		return
+	}
+
+	err = saveUsers(users)
+	mutex.Unlock()
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, false, "Gagal menyimpan database user", nil)
+		return
+	}
+
+	// Both take the mutex themselves
+	if locked {
+		revokeAccess(req.Password)
+		jsonResponse(w, http.StatusOK, true, "User berhasil dikunci", nil)
+		return
+	}
+	enableUser(req.Password)
+	jsonResponse(w, http.StatusOK, true, "User berhasil dibuka", nil)
+}
+
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, http.StatusMethodNotAllowed, false, "Method not allowed", nil)
+		return
+	}
+
+	users, err := loadUsers()
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca database user", nil)
+		return
 	}
 
 	userList := []UserInfo{}
 	today := time.Now().Format("2006-01-02")
 
 	for _, u := range users {
-		status := "Active"
-		if u.Status == "locked" {
-			status = "Locked"
-		} else if u.Expired < today {
-			status = "Expired"
-		}
-		
-		userList = append(userList, UserInfo{
-			Password: u.Password,
-			Expired:  u.Expired,
-			Status:   status,
-		})
+		userList = append(userList, userInfo(u, today))
 	}
 
 	jsonResponse(w, http.StatusOK, true, "Daftar user", userList)
 }
 
+func getUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, http.StatusMethodNotAllowed, false, "Method not allowed", nil)
+		return
+	}
+
+	password := r.URL.Query().Get("password")
+	if password == "" {
+		jsonResponse(w, http.StatusBadRequest, false, "Password harus diisi", nil)
+		return
+	}
+
+	users, err := loadUsers()
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, false, "Gagal membaca database user", nil)
+		return
+	}
+
+	for _, u := range users {
+		if u.Password == password {
+			jsonResponse(w, http.StatusOK, true, "Data user", userInfo(u, time.Now().Format("2006-01-02")))
+			return
+		}
+	}
+
+	jsonResponse(w, http.StatusNotFound, false, "User tidak ditemukan", nil)
+}
+
+type UserInfo struct {
+	Password string `json:"password"`
+	Expired  string `json:"expired"`
+	Status   string `json:"status"`
+}
+
+func userInfo(u UserStore, today string) UserInfo {
+	status := "Active"
+	if u.Status == "locked" {
+		status = "Locked"
+	} else if u.Expired < today {
+		status = "Expired"
+	}
+	return UserInfo{
+		Password: u.Password,
+		Expired:  u.Expired,
+		Status:   status,
+	}
+}
+
 func getSystemInfo(w http.ResponseWriter, r *http.Request) {
 	cmd := exec.Command("curl", "-s", "ifconfig.me")
 	ipPub, _ := cmd.Output()
@@ -380,6 +496,14 @@ func getSystemInfo(w http.ResponseWriter, r *http.Request) {
 		"service":    "zivpn",
 	}
 
+	// Capacity (optional): max_users from MaxUsersFile, active_users from config
+	if config, err := loadConfig(); err == nil {
+		info["active_users"] = fmt.Sprint(len(config.Auth.Config))
+	}
+	if maxBytes, err := ioutil.ReadFile(MaxUsersFile); err == nil {
+		info["max_users"] = strings.TrimSpace(string(maxBytes))
+	}
+
 	jsonResponse(w, http.StatusOK, true, "System Info", info)
 }
 
@@ -480,11 +604,7 @@ func loadConfig() (Config, error) {
 }
 
 func saveConfig(config Config) error {
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(ConfigFile, data, 0644)
+	return writeJSONAtomic(ConfigFile, config)
 }
 
 func loadUsers() ([]UserStore, error) {
@@ -501,11 +621,38 @@ func loadUsers() ([]UserStore, error) {
 }
 
 func saveUsers(users []UserStore) error {
-	data, err := json.MarshalIndent(users, "", "  ")
+	return writeJSONAtomic(UserDB, users)
+}
+
+// writeJSONAtomic writes v as indented JSON to a temp file next to path
+// and renames it into place, so a crash mid-write never leaves a
+// truncated file behind.
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(UserDB, data, 0644)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func restartService() error {
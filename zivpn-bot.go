@@ -3,19 +3,38 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -30,17 +49,453 @@ const (
 	ApiKeyFile    = "/etc/zivpn/apikey"
 	DomainFile    = "/etc/zivpn/domain"
 	PortFile      = "/etc/zivpn/port"
+	BindingsFile  = "/etc/zivpn/bindings.json"
+	ChatsFile     = "/etc/zivpn/chats.json"
+	ScheduleFile  = "/etc/zivpn/scheduled-broadcasts.json"
+
+	AttributionsFile = "/etc/zivpn/attributions.json"
+	ReferralsFile    = "/etc/zivpn/referrals.json"
+	AutoRenewFile    = "/etc/zivpn/auto-renew.json"
+	ActivationsFile  = "/etc/zivpn/pending-activations.json"
+
+	BindingServersFile = "/etc/zivpn/binding-servers.json"
+	AuditLogFile       = "/etc/zivpn/audit.log"
+	DashboardFile      = "/etc/zivpn/dashboard.json"
+	RemindersFile      = "/etc/zivpn/reminders-sent.json"
+	MaintenanceFile    = "/etc/zivpn/maintenance-windows.json"
+	NotesFile          = "/etc/zivpn/notes.json"
+	RenewHistoryFile   = "/etc/zivpn/renew-history.json"
 )
 
+// backupFiles is what a backup contains and, by base name, what a restore
+// may write back.
+var backupFiles = []string{
+	"/etc/zivpn/config.json",
+	"/etc/zivpn/users.json",
+	DomainFile,
+	NotesFile,
+	RenewHistoryFile,
+}
+
+// secretBackupFiles hold the bot token, owner ID and API key. They are
+// only backed up (and restorable) with backup_secrets set.
+var secretBackupFiles = []string{
+	BotConfigFile,
+	ApiKeyFile,
+}
+
+// Version is set at build time:
+// go build -ldflags "-X main.Version=<version>"
+var Version = "dev"
+
+// ReleaseCheckTimeout bounds the release_check_url request of /version.
+const ReleaseCheckTimeout = 10 * time.Second
+
+// ReleaseCheckTTL is how long /version reuses the last release check.
+const ReleaseCheckTTL = 1 * time.Hour
+
 var ApiUrl = "http://127.0.0.1:" + PortFile + "/api"
 
 var ApiKey = "AutoFtBot-agskjgdvsbdreiWG1234512SDKrqw"
 
+// apiKeyMutex guards ApiKey, which the secret watcher may reload.
+var apiKeyMutex = &sync.RWMutex{}
+
+// SecretCheckInterval is how often the API key and bot token files are
+// checked for rotation.
+const SecretCheckInterval = time.Minute
+
+// RequestIDHeader carries the correlation ID of each API call, so a
+// failure a user reports can be found in the bot's log.
+const RequestIDHeader = "X-Request-ID"
+
+// apiDebugLog logs every API call, not only failures (api_debug_log).
+var apiDebugLog = false
+
+// API auth header, overridable via api_auth_header / api_auth_scheme
+var ApiAuthHeader = "X-API-Key"
+var ApiAuthScheme = ""
+
+// APIErrorClass tells callers how to present a failed API call.
+type APIErrorClass int
+
+const (
+	APIUserError APIErrorClass = iota // 4xx, the API's message is meant for the user
+	APIOutage                         // 5xx or timeout
+	APIDown                           // Connection refused, service not running
+)
+
+// APIError is returned by apiCall for transport failures and HTTP errors.
+type APIError struct {
+	Class     APIErrorClass
+	Status    int
+	Message   string
+	Err       error
+	RequestID string // Sent as RequestIDHeader, also in the log line
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.Status, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// apiClient is used for every zivpn-api call, see newApiClient
+var apiClient = &http.Client{}
+
+// ApiTimeout bounds every single call to the zivpn-api.
+const ApiTimeout = 15 * time.Second
+
+// CapacityWarnPercent is the server usage from which creates warn the admin.
+const CapacityWarnPercent = 90
+
+// DefaultCallbackDebounce is the window in which a repeated tap on the
+// same button is ignored.
+const DefaultCallbackDebounce = 500 * time.Millisecond
+
+// DefaultStateTimeout cancels abandoned input flows (create, renew, ...).
+const DefaultStateTimeout = 5 * time.Minute
+
+// DefaultUsersCacheTTL is how long getUsers reuses the last user list.
+const DefaultUsersCacheTTL = 5 * time.Second
+
+// MaxTelegramDocumentSize is the largest document a bot may upload.
+const MaxTelegramDocumentSize = 50 * 1024 * 1024
+
+// MaxRestoreFileSize is the largest backup the restore flow will accept.
+const MaxRestoreFileSize = 20 * 1024 * 1024
+
+// RestoreDownloadTimeout bounds the download of an uploaded backup.
+const RestoreDownloadTimeout = 60 * time.Second
+
+// StaleBackupAge is how old a leftover temp backup must be before the
+// startup cleanup removes it.
+const StaleBackupAge = time.Hour
+
+// RestartVerifyTimeout is how long a restarted service has to become
+// active (and, for the API, answer /info) before the next attempt.
+const RestartVerifyTimeout = 15 * time.Second
+
+// DashboardInterval is how often the /dashboard message is refreshed.
+const DashboardInterval = 5 * time.Minute
+
+// WatchdogInterval is how often the watchdog checks the services.
+const WatchdogInterval = time.Minute
+
+// DefaultWatchdogMaxRestarts caps watchdog restarts per service per hour.
+const DefaultWatchdogMaxRestarts = 3
+
+// Clock drift check defaults, see startClockCheck.
+const (
+	DefaultClockCheckURL     = "https://www.google.com"
+	DefaultClockDriftSeconds = 60
+	ClockCheckInterval       = 6 * time.Hour
+)
+
+// DefaultRestartAttempts is the number of restart tries after a restore.
+const DefaultRestartAttempts = 3
+
+// Pre-restore snapshots: applyRestore saves the current files here first
+// so a bad restore can be reverted.
+const (
+	PreRestoreDir         = "/etc/zivpn/backups"
+	DefaultPreRestoreKeep = 3
+)
+
+// DefaultRenewHistoryMax is the number of renewals kept per account.
+const DefaultRenewHistoryMax = 20
+
+// HookTimeout bounds the on_create/on_delete hook commands.
+const HookTimeout = 30 * time.Second
+
+// WebhookTimeout bounds each webhook delivery attempt.
+const WebhookTimeout = 5 * time.Second
+
 type BotConfig struct {
 	BotToken string `json:"bot_token"`
 	AdminID  int64  `json:"admin_id"`
 	Mode     string `json:"mode"`   // "public" or "private"
 	Domain   string `json:"domain"` // Domain from setup
+
+	// Branding (optional, for white-label resellers)
+	BrandName  string `json:"brand_name,omitempty"`  // Replaces "ZIVPN UDP" in panel headers
+	FooterText string `json:"footer_text,omitempty"` // Menu footer, supports {brand} and {domain}
+
+	BroadcastFooter string `json:"broadcast_footer,omitempty"` // Appended to broadcasts, supports {brand} and {domain}
+
+	AccountNote         string `json:"account_note,omitempty"`          // Appended to account info, supports {brand}, {domain}, {username}, {expired}
+	KeepAccountMessages bool   `json:"keep_account_messages,omitempty"` // Don't delete the previous message when sending account info
+	AskContact          bool   `json:"ask_contact,omitempty"`           // Ask for the customer's phone/email on create (skippable)
+
+	// Client formats offered as buttons under account info: "text",
+	// "uri" and "file" (default all). client_uri is the link template,
+	// supports {password}, {domain}, {port} and {brand}
+	ClientFormats []string `json:"client_formats,omitempty"`
+	ClientUri     string   `json:"client_uri,omitempty"`
+
+	// Message overrides keyed by event (create, renew, delete,
+	// delete_confirm), see defaultTemplates for placeholders
+	Templates map[string]string `json:"templates,omitempty"`
+
+	// Custom command names keyed by canonical command, e.g.
+	// {"start": "mulai"}; the canonical names keep working
+	CommandAliases map[string]string `json:"command_aliases,omitempty"`
+
+	// Extra roles keyed by name, e.g. {"reseller": [12345]}, and the
+	// actions each role may use, see permissionActions. Roles without an
+	// entry get the "user" permissions; the owner always has "*".
+	Roles       map[string][]int64  `json:"roles,omitempty"`
+	Permissions map[string][]string `json:"permissions,omitempty"`
+
+	ChatTTLDays     int `json:"chat_ttl_days,omitempty"`     // Forget chats not seen for this long (default 90)
+	MaxChatSessions int `json:"max_chat_sessions,omitempty"` // Keep at most this many chats, least recently seen go first (default 10000)
+
+	// Broadcast tuning
+	BroadcastWorkers int `json:"broadcast_workers,omitempty"` // Parallel senders (default 5)
+	BroadcastRate    int `json:"broadcast_rate,omitempty"`    // Messages per second (default 25, max 30)
+
+	MaxAccountsPerUser int `json:"max_accounts_per_user,omitempty"` // Public mode create limit, 0 = unlimited
+
+	// Account defaults
+	DefaultDays    int `json:"default_days,omitempty"`     // Quick Create duration (default 30)
+	DefaultIpLimit int `json:"default_ip_limit,omitempty"` // Sent as ip_limit on create, 0 = not set
+
+	MaxDurationDays int `json:"max_duration_days,omitempty"` // Create/renew cap for non-owners, 0 = 9999
+
+	LowercaseUsernames bool `json:"lowercase_usernames,omitempty"` // Treat "User" and "user" as the same account
+	SeparatePassword   bool `json:"separate_password,omitempty"`   // Ask for username and password separately on create
+
+	// Terms users must accept in public mode before using the bot.
+	// Bump terms_version to ask everyone again after changing the text.
+	TermsText    string `json:"terms_text,omitempty"`
+	TermsVersion int    `json:"terms_version,omitempty"`
+
+	UsersCacheSeconds int `json:"users_cache_seconds,omitempty"` // User list cache TTL (default 5, -1 = off)
+
+	StateTimeoutMinutes int `json:"state_timeout_minutes,omitempty"` // Cancel idle input flows after this long (default 5)
+	CallbackDebounceMs  int `json:"callback_debounce_ms,omitempty"`  // Ignore a repeated tap within this window (default 500, -1 off)
+
+	Timezone string `json:"timezone,omitempty"` // IANA name, e.g. "Asia/Jakarta" (default server time)
+
+	ProtectedAccounts []string `json:"protected_accounts,omitempty"` // Never deleted by the bot, see /protect
+
+	Maintenance bool `json:"maintenance,omitempty"` // Set via /maintenance, blocks everyone but the owner
+
+	DryRun bool `json:"dry_run,omitempty"` // Demo mode: create/renew/delete/restore only pretend
+
+	DeleteSecretInput bool `json:"delete_secret_input,omitempty"` // Delete the user's message after a password is typed
+
+	RestartAttempts int      `json:"restart_attempts,omitempty"` // Service restart tries after restore (default 3)
+	RestoreFiles    []string `json:"restore_files,omitempty"`    // Restore only these backup files (e.g. ["users.json"]); empty = all
+	PreRestoreKeep  int      `json:"pre_restore_keep,omitempty"` // Pre-restore snapshots kept in /etc/zivpn/backups (default 3, -1 = off)
+	BackupSecrets   bool     `json:"backup_secrets,omitempty"`   // Include bot-config.json and the API key in backup/restore
+
+	WatchdogAutoRestart bool `json:"watchdog_auto_restart,omitempty"` // Restart zivpn/zivpn-api when found down
+	WatchdogMaxRestarts int  `json:"watchdog_max_restarts,omitempty"` // Per service per hour (default 3)
+
+	// Clock drift check against the Date header of an HTTP(S) server
+	ClockCheckURL     string `json:"clock_check_url,omitempty"`     // Default https://www.google.com
+	ClockDriftSeconds int    `json:"clock_drift_seconds,omitempty"` // Warn above this drift (default 60, -1 = off)
+
+	// API transport. Plain HTTP unless api_scheme is "https"; a self-signed
+	// certificate can be trusted via api_ca_cert or skipped entirely.
+	ApiScheme             string `json:"api_scheme,omitempty"`
+	ApiCACert             string `json:"api_ca_cert,omitempty"` // PEM file path
+	ApiInsecureSkipVerify bool   `json:"api_insecure_skip_verify,omitempty"`
+
+	// API authentication, e.g. "Authorization" + "Bearer" behind a gateway
+	ApiAuthHeader string `json:"api_auth_header,omitempty"` // Default "X-API-Key"
+	ApiAuthScheme string `json:"api_auth_scheme,omitempty"` // Optional prefix before the key
+
+	ApiDebugLog bool `json:"api_debug_log,omitempty"` // Log every API call (method, endpoint, status, latency, request ID); failures are always logged
+
+	// Remote zivpn-api backends the owner can switch to; the local API is
+	// always available as "local"
+	Servers []ServerConfig `json:"servers,omitempty"`
+
+	// Provisioning hooks, run as "<hook> <username> [days]" after success
+	OnCreateHook string `json:"on_create_hook,omitempty"`
+	OnDeleteHook string `json:"on_delete_hook,omitempty"`
+
+	Webhooks *WebhookConfig `json:"webhooks,omitempty"`
+
+	ReleaseCheckURL string `json:"release_check_url,omitempty"` // Latest version for /version, as plain text or a GitHub release JSON
+
+	ReferralBonusDays int `json:"referral_bonus_days,omitempty"` // Days added to the referrer's account, 0 = referrals off
+
+	// Auto-renew for flagged accounts
+	AutoRenewDays       int `json:"auto_renew_days,omitempty"`        // Days added per renewal (default: default_days)
+	AutoRenewBeforeDays int `json:"auto_renew_before_days,omitempty"` // Renew this many days before expiry (default 1)
+
+	RenewHistoryMax int `json:"renew_history_max,omitempty"` // Renewals kept per account (default 20)
+
+	// Expiry reminders for bound accounts on the local server
+	ReminderDays      []int `json:"reminder_days,omitempty"`       // Days before expiry to remind, e.g. [3, 1]; empty = off
+	ReminderCopyOwner bool  `json:"reminder_copy_owner,omitempty"` // Also send each reminder to the owner
+}
+
+// Referral records who referred a Telegram user and whether the referrer
+// has been rewarded for it.
+type Referral struct {
+	ReferrerID int64     `json:"referrer_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Rewarded   bool      `json:"rewarded"`
+}
+
+// CreatedAccount is the last account a user created, see lastCreated.
+type CreatedAccount struct {
+	Password  string
+	Expired   string
+	CreatedAt time.Time
+}
+
+// Support chat limits: forwards per user per SupportRateWindow, and how
+// many forwarded messages stay reply-able.
+const (
+	SupportRateLimit   = 5
+	SupportRateWindow  = time.Minute
+	SupportThreadLimit = 1000
+)
+
+// /check limit per user per CheckRateWindow.
+const (
+	CheckRateLimit  = 10
+	CheckRateWindow = time.Minute
+)
+
+// LastCreatedTTL is how long the "Kirim Ulang" button stays available.
+const LastCreatedTTL = 30 * time.Minute
+
+// RetryAction is a failed action the "Coba Lagi" button can run again.
+type RetryAction struct {
+	Run func()
+	At  time.Time
+}
+
+// RetryActionTTL is how long a "Coba Lagi" button stays usable.
+const RetryActionTTL = 5 * time.Minute
+
+// ConnectionEvent is one entry of /user/connections.
+type ConnectionEvent struct {
+	Time string `json:"time"`
+	IP   string `json:"ip"`
+}
+
+// ConnectionHistoryLimit is how many recent connections are shown.
+const ConnectionHistoryLimit = 20
+
+// ExportSchemaVersion is bumped whenever the /export layout changes.
+const ExportSchemaVersion = 2
+
+// ExportSnapshot is the normalized JSON document produced by /export.
+type ExportSnapshot struct {
+	SchemaVersion int                `json:"schema_version"`
+	ExportedAt    time.Time          `json:"exported_at"`
+	Users         []UserData         `json:"users"`
+	Bindings      map[string]int64   `json:"bindings"`
+	Attributions  map[string]int64   `json:"attributions"`
+	Referrals     map[int64]Referral `json:"referrals"`
+	AutoRenew     map[string]bool    `json:"auto_renew"`
+	Notes         map[string][]Note  `json:"notes"`
+	Chats         []ChatSession      `json:"chats"`
+}
+
+// WebhookConfig describes the outbound account lifecycle webhook.
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`           // HMAC-SHA256 key for X-ZiVPN-Signature
+	Events []string `json:"events,omitempty"` // "create", "renew", "delete"; empty = all
+}
+
+// WebhookEvent is the JSON payload POSTed to the webhook URL.
+type WebhookEvent struct {
+	Event     string `json:"event"`
+	Username  string `json:"username"`
+	Days      int    `json:"days,omitempty"`
+	Expired   string `json:"expired,omitempty"`
+	ByUserID  int64  `json:"by_user_id"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+const (
+	DefaultBrandName   = "ZIVPN UDP"
+	DefaultFooterText  = "👇 Silakan pilih menu dibawah ini:"
+	DefaultChatTTLDays = 90
+	ChatsSaveInterval  = 10 * time.Minute
+	DefaultMaxChats    = 10000
+	DefaultDays        = 30
+	MaxDurationDays    = 9999 // Hard upper bound, also the owner's limit
+
+	DefaultClientPort = "5667"
+	DefaultClientUri  = "zivpn://{password}@{domain}:{port}"
+	ClientObfs        = "zivpn" // Must match "obfs" in /etc/zivpn/config.json
+
+	DefaultBroadcastWorkers = 5
+	DefaultBroadcastRate    = 25
+	MaxBroadcastRate        = 30      // Telegram global limit
+	DefaultBroadcastFrom    = "Admin" // Sender in the broadcast footer when brand_name is unset
+
+	MaintenanceText = "🛠 Sedang maintenance, coba lagi nanti"
+)
+
+// ScheduleTimeLayout is the format admins use to enter a schedule time.
+const ScheduleTimeLayout = "2006-01-02 15:04"
+
+// BroadcastContent is a composed broadcast: plain text, or a photo or
+// document with the text as caption.
+type BroadcastContent struct {
+	Text      string `json:"text"`
+	MediaType string `json:"media_type,omitempty"` // "photo" or "document"
+	MediaID   string `json:"media_id,omitempty"`   // Telegram file ID
+	Server    string `json:"server,omitempty"`     // Only users bound to accounts on this server
+}
+
+// ScheduledBroadcast is a broadcast queued to go out at a later time.
+type ScheduledBroadcast struct {
+	ID          string           `json:"id"`
+	At          time.Time        `json:"at"`
+	AdminChatID int64            `json:"admin_chat_id"` // Receives the delivery report
+	Content     BroadcastContent `json:"content"`
+}
+
+// MaintenanceWindow turns maintenance mode on at Start and off at End.
+type MaintenanceWindow struct {
+	ID      string    `json:"id"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Started bool      `json:"started"`
+}
+
+// MaintenanceReminderLead is how long before a window the reminder
+// broadcast goes out.
+const MaintenanceReminderLead = time.Hour
+
+// Sender is the subset of *tgbotapi.BotAPI used by the handlers, so they
+// can be driven by a fake in tests.
+type Sender interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+	GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error)
+}
+
+// ChatSession is the most recent chat a Telegram user talked to the bot from.
+type ChatSession struct {
+	UserID   int64     `json:"user_id"`
+	ChatID   int64     `json:"chat_id"`
+	Name     string    `json:"name"`
+	JoinedAt time.Time `json:"joined_at"`
+	LastSeen time.Time `json:"last_seen"`
+
+	TermsVersion    int       `json:"terms_version,omitempty"`
+	TermsAcceptedAt time.Time `json:"terms_accepted_at,omitempty"`
+
+	PlainText   bool `json:"plain_text,omitempty"`   // /plain: send without Markdown
+	NoBroadcast bool `json:"no_broadcast,omitempty"` // Opted out of broadcasts, /subscribe undoes it
 }
 
 type IpInfo struct {
@@ -49,6 +504,13 @@ type IpInfo struct {
 	Query string `json:"query"`
 }
 
+// ServerConfig is a remote zivpn-api backend.
+type ServerConfig struct {
+	Name string `json:"name"`
+	Url  string `json:"url"` // Base URL including /api, e.g. "http://1.2.3.4:8080/api"
+	Key  string `json:"key"`
+}
+
 type UserData struct {
 	Password string `json:"password"`
 	Expired  string `json:"expired"`
@@ -64,6 +526,211 @@ var userStates = make(map[int64]string)
 var tempUserData = make(map[int64]map[string]string)
 var lastMessageIDs = make(map[int64]int)
 
+// stateUpdatedAt is the last activity of each user in userStates.
+var stateUpdatedAt = make(map[int64]time.Time)
+
+// editableMessages holds, while a callback is handled, the text message
+// whose button was pressed. The first sendAndTrack edits it in place.
+var editableMessages = make(map[int64]int)
+
+// bindings maps an account password to the Telegram user that owns it.
+var bindings = make(map[string]int64)
+
+// bindingServers records the server of a bound account; accounts without
+// an entry are on the local API.
+var bindingServers = make(map[string]string)
+
+// bindingsMutex guards bindings and bindingServers. They are written from
+// the update loop and read by the schedulers (reminders, auto-renew,
+// activations, broadcasts).
+var bindingsMutex = &sync.RWMutex{}
+
+// attributions maps an account password to the Telegram user that created it.
+var attributions = make(map[string]int64)
+
+// referrals maps a referred Telegram user ID to its referral.
+var referrals = make(map[int64]Referral)
+
+// lastCreated keeps each user's most recent account for "Kirim Ulang".
+var lastCreated = make(map[int64]CreatedAccount)
+
+// retryActions holds the last failed action per chat, see
+// replyAPIErrorWithRetry.
+var retryActions = make(map[int64]RetryAction)
+
+// Note is free text attached to an account. Public notes are shown to the
+// account's owner in /myaccount, the others only to admins.
+type Note struct {
+	Text      string    `json:"text"`
+	Public    bool      `json:"public"`
+	Kind      string    `json:"kind,omitempty"` // "contact" for the customer contact, "" for messages
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// notes holds each account's notes, at most one per visibility and kind.
+var notes = make(map[string][]Note)
+
+// autoRenew flags accounts the scheduler extends automatically. The API
+// has no field for it, so it lives in AutoRenewFile.
+var autoRenew = make(map[string]bool)
+var autoRenewMutex = &sync.Mutex{}
+
+// PendingActivation is an account created locked that the scheduler
+// unlocks on StartDate.
+type PendingActivation struct {
+	StartDate string `json:"start_date"` // 2006-01-02, in the bot's timezone
+	Days      int    `json:"days"`
+	CreatedBy int64  `json:"created_by"`
+	Server    string `json:"server,omitempty"` // Backend the account lives on (default local)
+}
+
+// activations holds accounts waiting for their start date, keyed by
+// account name.
+var activations = make(map[string]PendingActivation)
+var activationsMutex = &sync.Mutex{}
+
+// RenewEvent is one renewal of an account.
+type RenewEvent struct {
+	OldExpiry string    `json:"old_expiry,omitempty"` // Empty when unknown
+	NewExpiry string    `json:"new_expiry"`
+	Days      int       `json:"days"`
+	At        time.Time `json:"at"`
+	ByUserID  int64     `json:"by_user_id,omitempty"` // 0 for the bot itself (auto-renew, referral)
+}
+
+// renewHistory holds the renewals of each account, oldest first, keyed by
+// account name. The auto-renew scheduler writes it too, hence the mutex.
+var renewHistory = make(map[string][]RenewEvent)
+var renewHistoryMutex = &sync.Mutex{}
+
+// remindersSent records the last reminder per account as
+// "<expired>:<days left>", so each reminder goes out once.
+var remindersSent = make(map[string]string)
+var remindersMutex = &sync.Mutex{}
+
+// Dashboard is the owner's live stats message, see /dashboard.
+type Dashboard struct {
+	ChatID    int64 `json:"chat_id"`
+	MessageID int   `json:"message_id"`
+	Pinned    bool  `json:"pinned,omitempty"`
+}
+
+var dashboard Dashboard
+var dashboardMutex = &sync.Mutex{}
+
+// modeMutex guards config.Mode and config.Maintenance, which the update
+// loop switches at runtime while the dashboard updater reads them.
+var modeMutex = &sync.RWMutex{}
+
+// apiServers holds the configured remote backends by name.
+var apiServers = make(map[string]ServerConfig)
+
+// selectedServers is the backend each owner chat currently manages; chats
+// without an entry use the local API.
+var selectedServers = make(map[int64]string)
+
+// supportThreads maps the owner-side message IDs of forwarded support
+// messages to the user who sent them, so the owner can just reply.
+var supportThreads = make(map[int]int64)
+
+// supportThreadOrder holds the keys of supportThreads oldest first, so
+// the oldest thread is dropped once SupportThreadLimit is reached.
+var supportThreadOrder []int
+
+// supportForwards holds recent forward times per user for rate limiting.
+var supportForwards = make(map[int64][]time.Time)
+
+// availabilityChecks holds recent /check times per user for rate limiting.
+var availabilityChecks = make(map[int64][]time.Time)
+
+// previewMode is set while the owner previews the bot as a regular user.
+var previewMode = make(map[int64]bool)
+
+// textMenuChats are the chats that opened /menu: keyboards sent to them
+// are rendered as numbered lines, and textMenuChoices maps each number of
+// the last one to its callback data.
+var textMenuChats = make(map[int64]bool)
+var textMenuChoices = make(map[int64]map[string]string)
+
+// botUsername is used to build deep links (t.me/<bot>?start=...).
+var botUsername string
+
+// activeChats holds one ChatSession per Telegram user ID, at most
+// maxChatSessions of them.
+var activeChats = make(map[int64]ChatSession)
+var maxChatSessions = DefaultMaxChats
+var chatsMutex = &sync.Mutex{}
+
+// chatsSavedAt is the last time saveChatSession wrote ChatsFile. LastSeen
+// alone only reaches disk every ChatsSaveInterval.
+var chatsSavedAt time.Time
+
+// broadcastCancel stops the running broadcast; nil when none is running.
+var broadcastCancel context.CancelFunc
+var broadcastMutex = &sync.Mutex{}
+
+var scheduledBroadcasts []ScheduledBroadcast
+
+// maintenanceWindows is only touched from the main loop, like the state maps.
+var maintenanceWindows []MaintenanceWindow
+var scheduleMutex = &sync.Mutex{}
+
+// consumedCallbacks remembers the last one-shot callback handled per user,
+// so a double-tapped confirm button is not executed twice.
+var consumedCallbacks = make(map[int64]string)
+
+// lastCallbacks is each user's previous callback, for debouncing.
+var lastCallbacks = make(map[int64]lastCallback)
+
+type lastCallback struct {
+	Data string
+	At   time.Time
+}
+
+// callbackTokens maps per-chat opaque tokens ("~1f") to the usernames they
+// stand for, so callback data stays within Telegram's 64 bytes. Tokens are
+// never reused within a chat; after a restart old buttons simply expire.
+var callbackTokens = make(map[int64]map[string]string)
+var callbackTokenIDs = make(map[int64]map[string]string)
+
+// callbackToasts are shown while slow callback actions are running.
+var callbackToasts = map[string]string{
+	"menu_list":          "⏳ Mengambil data...",
+	"menu_info":          "⏳ Mengambil info...",
+	"menu_backup_action": "⏳ Membuat backup...",
+}
+
+// defaultTemplates are the built-in texts behind config.Templates. Besides
+// {brand} and {domain}, templates may use {username}, {expired}, {days},
+// {status} and {status_icon}. create and renew appear above the account
+// details and are empty by default.
+var defaultTemplates = map[string]string{
+	"create":         "",
+	"renew":          "",
+	"delete":         "✅ Password berhasil dihapus.",
+	"delete_confirm": "❓ Yakin ingin menghapus user `{username}`?\n\n{status_icon} Status  : {status}\n📅 Expired : {expired}",
+}
+
+var templatePlaceholders = map[string]bool{
+	"{brand}": true, "{domain}": true, "{username}": true, "{expired}": true,
+	"{days}": true, "{status}": true, "{status_icon}": true,
+}
+
+var placeholderPattern = regexp.MustCompile(`\{[a-z_]+\}`)
+
+// appCtx is cancelled on SIGINT/SIGTERM so in-flight API calls are aborted.
+var appCtx = context.Background()
+
+// User list cache per server, see getUsers
+var usersCache = make(map[string][]UserData)
+var usersCacheAt = make(map[string]time.Time)
+var usersCacheTTL = DefaultUsersCacheTTL
+var usersCacheMutex = &sync.Mutex{}
+
+// usersCacheGen is bumped by invalidateUsersCache, so a list fetched
+// before a mutation is not stored after it.
+var usersCacheGen int
+
 // ==========================================
 // Main Entry Point
 // ==========================================
@@ -74,742 +741,6899 @@ func main() {
 		ApiKey = strings.TrimSpace(string(keyBytes))
 	}
 
+	// Load Config
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Gagal memuat konfigurasi bot:", err)
+	}
+	for event, text := range config.Templates {
+		if problem := templateProblem(event, text); problem != "" {
+			log.Printf("Ignoring template %s", problem)
+		}
+	}
+	for canonical, alias := range config.CommandAliases {
+		if commandAlias(&config, canonical) == "" {
+			log.Printf("Ignoring command alias %s -> %q (use a-z, 0-9 and _, max 32)", canonical, alias)
+		}
+	}
+
 	// Load API Port
 	if portBytes, err := ioutil.ReadFile(ApiPortFile); err == nil {
 		port := strings.TrimSpace(string(portBytes))
-		ApiUrl = fmt.Sprintf("http://127.0.0.1:%s/api", port)
+		ApiUrl = fmt.Sprintf("%s://127.0.0.1:%s/api", apiScheme(&config), port)
+	}
+	if apiClient, err = newApiClient(&config); err != nil {
+		log.Fatal("Gagal memuat sertifikat API:", err)
 	}
 
-	// Load Config
-	config, err := loadConfig()
-	if err != nil {
-		log.Fatal("Gagal memuat konfigurasi bot:", err)
+	cleanupTempBackups(StaleBackupAge)
+
+	// Load Bindings & Chat Sessions
+	if err := loadBindings(); err != nil {
+		log.Printf("Failed to load bindings: %v", err)
+	}
+	if err := loadJSONFile(BindingServersFile, &bindingServers); err != nil {
+		log.Printf("Failed to load binding servers: %v", err)
+	}
+	if err := loadJSONFile(AttributionsFile, &attributions); err != nil {
+		log.Printf("Failed to load attributions: %v", err)
+	}
+	if err := loadJSONFile(ReferralsFile, &referrals); err != nil {
+		log.Printf("Failed to load referrals: %v", err)
+	}
+	if err := loadJSONFile(AutoRenewFile, &autoRenew); err != nil {
+		log.Printf("Failed to load auto-renew flags: %v", err)
+	}
+	if err := loadJSONFile(ActivationsFile, &activations); err != nil {
+		log.Printf("Failed to load pending activations: %v", err)
+	}
+	if err := loadJSONFile(NotesFile, &notes); err != nil {
+		log.Printf("Failed to load notes: %v", err)
 	}
+	if err := loadJSONFile(RenewHistoryFile, &renewHistory); err != nil {
+		log.Printf("Failed to load renew history: %v", err)
+	}
+	if err := loadJSONFile(DashboardFile, &dashboard); err != nil {
+		log.Printf("Failed to load dashboard: %v", err)
+	}
+	if err := loadJSONFile(RemindersFile, &remindersSent); err != nil {
+		log.Printf("Failed to load sent reminders: %v", err)
+	}
+	if err := loadChats(); err != nil {
+		log.Printf("Failed to load chats: %v", err)
+	}
+	if err := loadScheduledBroadcasts(); err != nil {
+		log.Printf("Failed to load scheduled broadcasts: %v", err)
+	}
+	if err := loadJSONFile(MaintenanceFile, &maintenanceWindows); err != nil {
+		log.Printf("Failed to load maintenance windows: %v", err)
+	}
+
+	logPermissions(&config)
+	usersCacheTTL = cacheTTL(&config)
+	maxChatSessions = chatSessionLimit(&config)
+	if trimmed := trimChatsNow(); trimmed > 0 {
+		log.Printf("Dropped %d chat sessions over the limit of %d", trimmed, maxChatSessions)
+	}
+	for _, server := range config.Servers {
+		if server.Name == "" || server.Name == LocalServerName {
+			log.Printf("Ignoring server without a usable name: %s", server.Url)
+			continue
+		}
+		apiServers[server.Name] = server
+	}
+	if config.ApiAuthHeader != "" {
+		ApiAuthHeader = config.ApiAuthHeader
+	}
+	ApiAuthScheme = config.ApiAuthScheme
+	apiDebugLog = config.ApiDebugLog
 
 	// Initialize Bot
-	bot, err := tgbotapi.NewBotAPI(config.BotToken)
+	bot, err := connectBot(config.BotToken)
 	if err != nil {
-		log.Panic(err)
+		log.Fatalf("Token bot salah atau tidak ada koneksi internet: %v", err)
 	}
 
+	// Never enable: the library's debug log prints every incoming message,
+	// including passwords typed into the create flow
 	bot.Debug = false
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+	botUsername = bot.Self.UserName
+	log.Printf("Authorized on account %s (version %s)", bot.Self.UserName, Version)
+
+	// Graceful Shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	appCtx = ctx
+
+	checkDomainMismatch(bot, &config)
+	registerCommands(bot, &config)
+
+	// Start Background Jobs
+	go startChatPruner(&config)
+	go startBroadcastScheduler(bot, &config)
+	go startAutoRenewScheduler(bot, &config)
+	go startActivationScheduler(bot, &config)
+	go startSecretWatcher(bot, &config)
+	go startWatchdog(bot, &config)
+	go startDashboardUpdater(bot, &config)
+	go startReminderScheduler(bot, &config)
+	go startClockCheck(bot, &config)
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 	updates := bot.GetUpdatesChan(u)
 
-	// Main Loop
-	for update := range updates {
-		if update.Message != nil {
-			handleMessage(bot, update.Message, &config)
-		} else if update.CallbackQuery != nil {
-			handleCallback(bot, update.CallbackQuery, &config)
+	// Main Loop (state expiry runs here too, so the state maps stay
+	// single-goroutine)
+	stateTicker := time.NewTicker(time.Minute)
+	defer stateTicker.Stop()
+	for {
+		select {
+		case <-stateTicker.C:
+			expireStates(bot, &config)
+			runMaintenanceWindows(bot, &config)
+		case <-ctx.Done():
+			log.Println("Shutdown signal received, stopping bot...")
+			bot.StopReceivingUpdates()
+			flushChats()
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			if update.Message != nil {
+				handleMessage(bot, update.Message, &config)
+			} else if update.CallbackQuery != nil {
+				handleCallback(bot, update.CallbackQuery, &config)
+			}
+		}
+	}
+}
+
+// Startup retries for tgbotapi.NewBotAPI, since the bot is often started
+// before the network is up at boot.
+const (
+	BotConnectAttempts = 5
+	BotConnectDelay    = 5 * time.Second
+)
+
+// connectBot logs in to Telegram, retrying network failures. A rejected
+// token is returned immediately.
+func connectBot(token string) (*tgbotapi.BotAPI, error) {
+	var err error
+	for attempt := 1; attempt <= BotConnectAttempts; attempt++ {
+		var bot *tgbotapi.BotAPI
+		if bot, err = tgbotapi.NewBotAPI(token); err == nil {
+			return bot, nil
+		}
+		var tgErr *tgbotapi.Error
+		if errors.As(err, &tgErr) {
+			return nil, err
+		}
+		if attempt < BotConnectAttempts {
+			log.Printf("Connecting to Telegram failed (attempt %d/%d): %v", attempt, BotConnectAttempts, err)
+			time.Sleep(BotConnectDelay)
 		}
 	}
+	return nil, err
 }
 
 // ==========================================
 // Telegram Event Handlers
 // ==========================================
 
-func handleMessage(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, config *BotConfig) {
+func handleMessage(bot Sender, msg *tgbotapi.Message, config *BotConfig) {
 	// Access Control
 	if !isAllowed(config, msg.From.ID) {
 		replyError(bot, msg.Chat.ID, "⛔ Akses Ditolak. Bot ini Private.")
 		return
 	}
+	saveChatSession(msg.From, msg.Chat.ID)
+
+	if config.Maintenance && msg.From.ID != config.AdminID {
+		replyError(bot, msg.Chat.ID, MaintenanceText)
+		return
+	}
+
+	if !termsAccepted(config, msg.From.ID) {
+		showTerms(bot, msg.Chat.ID, config)
+		return
+	}
 
 	// Handle Document Upload (Restore)
-	if msg.Document != nil && msg.From.ID == config.AdminID {
+	if msg.Document != nil && can(config, msg.From.ID, "admin") {
 		if state, exists := userStates[msg.From.ID]; exists && state == "waiting_restore_file" {
 			processRestoreFile(bot, msg, config)
 			return
 		}
+		if state, exists := userStates[msg.From.ID]; exists && state == "waiting_import_file" {
+			processImportFile(bot, msg, config)
+			return
+		}
+	}
+
+	// Keyboards of /menu chats come as numbered lines and are answered
+	// with the number
+	bot = textMenuSender{bot}
+	if handleTextMenuReply(bot, msg, config) {
+		return
 	}
 
 	// Handle State (User Input)
 	if state, exists := userStates[msg.From.ID]; exists {
+		stateUpdatedAt[msg.From.ID] = time.Now()
 		handleState(bot, msg, state, config)
 		return
 	}
 
+	// Support Chat (bound users <-> owner)
+	if !msg.IsCommand() && !msg.From.IsBot {
+		if msg.From.ID == config.AdminID {
+			if relaySupportReply(bot, msg) {
+				return
+			}
+		} else if forwardToAdmin(bot, msg, config) {
+			return
+		}
+	}
+
 	// Handle Commands
 	if msg.IsCommand() {
-		switch msg.Command() {
+		command := resolveCommand(config, msg.Command())
+		if action := commandActions[command]; action != "" && !can(config, msg.From.ID, action) {
+			denyAction(msg.From.ID, action, "/"+command)
+			replyError(bot, msg.Chat.ID, "Perintah tidak dikenal.")
+			return
+		}
+		switch command {
 		case "start":
+			if payload := strings.TrimSpace(msg.CommandArguments()); payload != "" {
+				handleStartPayload(bot, msg, payload, config)
+				return
+			}
 			showMainMenu(bot, msg.Chat.ID, config)
+		case "menu":
+			textMenuChats[msg.Chat.ID] = true
+			showMainMenu(bot, msg.Chat.ID, config)
+		case "check":
+			checkAvailability(bot, msg.Chat.ID, msg.From.ID, strings.TrimSpace(msg.CommandArguments()), config)
+		case "version":
+			showVersion(bot, msg.Chat.ID, msg.From.ID, config)
+		case "myaccount":
+			showMyAccounts(bot, msg.Chat.ID, msg.From.ID)
+		case "subscribe":
+			if setBroadcastOptOut(msg.From.ID, false) {
+				audit(msg.From.ID, "broadcast_subscribe", "")
+			}
+			sendMessage(bot, msg.Chat.ID, "🔔 Anda akan menerima broadcast lagi.")
+		case "plain":
+			enabled := togglePlainText(msg.From.ID)
+			if enabled {
+				sendMessage(bot, msg.Chat.ID, "📝 Mode teks biasa AKTIF. Pesan dikirim tanpa format Markdown.\nKetik /plain lagi untuk menonaktifkan.")
+			} else {
+				sendMessage(bot, msg.Chat.ID, "📝 Mode teks biasa NONAKTIF.")
+			}
+		case "message":
+			handleDirectMessage(bot, msg, config)
+		case "protect", "unprotect":
+			handleProtect(bot, msg.Chat.ID, command == "protect", msg.CommandArguments(), config)
+		case "setdomain":
+			handleSetDomain(bot, msg.Chat.ID, msg.CommandArguments(), config)
+		case "sessions":
+			showSessions(bot, msg.Chat.ID, 1, config)
+		case "maintenance":
+			setMaintenance(bot, msg.Chat.ID, msg.CommandArguments(), config)
+		case "dashboard":
+			handleDashboard(bot, msg.Chat.ID, strings.TrimSpace(msg.CommandArguments()), config)
+		case "ping":
+			pingLatency(bot, msg.Chat.ID)
+		case "import":
+			setState(msg.From.ID, "waiting_import_file")
+			sendMessage(bot, msg.Chat.ID, "📥 *Import Akun*\n\nKirim file CSV (`password,days,ip_limit`) atau JSON (`[{\"password\": ..., \"days\": ..., \"ip_limit\": ...}]`).\nAkun yang sudah ada dilewati.")
+		case "purgeexpired":
+			confirmPurgeExpired(bot, msg.Chat.ID, config)
+		case "credentials":
+			exportActiveCredentials(bot, msg.Chat.ID, msg.From.ID, config)
+		case "export":
+			exportSnapshot(bot, msg.Chat.ID)
 		default:
 			replyError(bot, msg.Chat.ID, "Perintah tidak dikenal.")
 		}
 	}
 }
 
-func handleCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, config *BotConfig) {
-	// Access Control (Special case for toggle_mode)
-	if !isAllowed(config, query.From.ID) {
-		if query.Data != "toggle_mode" || query.From.ID != config.AdminID {
-			bot.Request(tgbotapi.NewCallback(query.ID, "Akses Ditolak"))
-			return
-		}
+// publicCommands and ownerCommands are registered with Telegram's command
+// menu; owner commands only show up in the owner's chat.
+var (
+	publicCommands = []tgbotapi.BotCommand{
+		{Command: "start", Description: "Menu utama"},
+		{Command: "menu", Description: "Menu teks (tanpa tombol)"},
+		{Command: "plain", Description: "Mode teks biasa"},
+		{Command: "check", Description: "Cek ketersediaan password"},
+		{Command: "myaccount", Description: "Akun saya"},
+		{Command: "subscribe", Description: "Terima broadcast lagi"},
+		{Command: "version", Description: "Versi bot"},
 	}
+	ownerCommands = []tgbotapi.BotCommand{
+		{Command: "message", Description: "Kirim pesan ke user"},
+		{Command: "protect", Description: "Lindungi akun"},
+		{Command: "unprotect", Description: "Hapus perlindungan akun"},
+		{Command: "setdomain", Description: "Ganti domain"},
+		{Command: "sessions", Description: "Daftar chat aktif"},
+		{Command: "maintenance", Description: "Mode maintenance"},
+		{Command: "dashboard", Description: "Dashboard live"},
+		{Command: "ping", Description: "Cek latensi"},
+		{Command: "import", Description: "Import akun dari CSV/JSON"},
+		{Command: "credentials", Description: "Export akun aktif"},
+		{Command: "purgeexpired", Description: "Hapus semua akun expired"},
+		{Command: "export", Description: "Export snapshot JSON"},
+	}
+)
 
-	chatID := query.Message.Chat.ID
-	userID := query.From.ID
+// commandActions maps gated commands to the permission they need.
+var commandActions = map[string]string{
+	"message":      "broadcast",
+	"protect":      "admin",
+	"unprotect":    "admin",
+	"setdomain":    "admin",
+	"sessions":     "admin",
+	"maintenance":  "admin",
+	"dashboard":    "admin",
+	"ping":         "admin",
+	"import":       "admin",
+	"purgeexpired": "admin",
+	"credentials":  "export",
+	"export":       "export",
+}
 
-	switch {
-	// --- Menu Navigation ---
-	case query.Data == "menu_create":
-		startCreateUser(bot, chatID, userID)
-	case query.Data == "menu_delete":
-		showUserSelection(bot, chatID, 1, "delete")
-	case query.Data == "menu_renew":
-		showUserSelection(bot, chatID, 1, "renew")
-	case query.Data == "menu_list":
-		if userID == config.AdminID {
-			listUsers(bot, chatID)
-		}
-	case query.Data == "menu_info":
-		if userID == config.AdminID {
-			systemInfo(bot, chatID, config)
-		}
-	case query.Data == "menu_backup_restore":
-		if userID == config.AdminID {
-			showBackupRestoreMenu(bot, chatID)
+// commandNamePattern is what Telegram accepts as a command name.
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// commandAlias returns the custom name configured for a canonical
+// command, or "" when there is none (or it is not a valid command name).
+func commandAlias(config *BotConfig, canonical string) string {
+	alias := strings.ToLower(config.CommandAliases[canonical])
+	if alias == "" || alias == canonical || !commandNamePattern.MatchString(alias) {
+		return ""
+	}
+	return alias
+}
+
+// resolveCommand maps a custom command name back to its canonical one.
+func resolveCommand(config *BotConfig, name string) string {
+	name = strings.ToLower(name)
+	for canonical := range config.CommandAliases {
+		if commandAlias(config, canonical) == name {
+			return canonical
 		}
-	case query.Data == "menu_backup_action":
-		if userID == config.AdminID {
-			performBackup(bot, chatID)
+	}
+	return name
+}
+
+// localizeCommands swaps in the configured aliases.
+func localizeCommands(config *BotConfig, commands []tgbotapi.BotCommand) []tgbotapi.BotCommand {
+	out := make([]tgbotapi.BotCommand, len(commands))
+	for i, c := range commands {
+		if alias := commandAlias(config, c.Command); alias != "" {
+			c.Command = alias
 		}
-	case query.Data == "menu_restore_action":
-		if userID == config.AdminID {
-			startRestore(bot, chatID, userID)
+		out[i] = c
+	}
+	return out
+}
+
+// registerCommands publishes the command menu, using the aliases so
+// white-label bots show their own names.
+func registerCommands(bot Sender, config *BotConfig) {
+	public := localizeCommands(config, publicCommands)
+	if _, err := bot.Request(tgbotapi.NewSetMyCommands(public...)); err != nil {
+		log.Printf("Failed to register commands: %v", err)
+	}
+	owner := append(public, localizeCommands(config, ownerCommands)...)
+	scope := tgbotapi.NewBotCommandScopeChat(config.AdminID)
+	if _, err := bot.Request(tgbotapi.NewSetMyCommandsWithScope(scope, owner...)); err != nil {
+		log.Printf("Failed to register owner commands: %v", err)
+	}
+}
+
+func handleCallback(bot Sender, query *tgbotapi.CallbackQuery, config *BotConfig) {
+	// Access Control (Special case for toggle_mode)
+	if !isAllowed(config, query.From.ID) {
+		if query.Data != "toggle_mode" || query.From.ID != config.AdminID {
+			answerCallback(bot, query.ID, "Akses Ditolak")
+			return
 		}
-	case query.Data == "cancel":
-		cancelOperation(bot, chatID, userID, config)
+	}
+
+	chatID := query.Message.Chat.ID
+	userID := query.From.ID
+
+	// Double taps on laggy connections arrive as two identical callbacks
+	if last, ok := lastCallbacks[userID]; ok && last.Data == query.Data && time.Since(last.At) < callbackDebounce(config) {
+		answerCallback(bot, query.ID, "")
+		return
+	}
+	lastCallbacks[userID] = lastCallback{Data: query.Data, At: time.Now()}
+
+	saveChatSession(query.From, chatID)
+
+	// Navigation edits the pressed message instead of delete + resend
+	if query.Message.Text != "" {
+		editableMessages[chatID] = query.Message.MessageID
+		defer delete(editableMessages, chatID)
+	}
+
+	data, ok := resolveCallbackTokens(chatID, query.Data)
+	if !ok {
+		answerCallback(bot, query.ID, "Tombol kadaluarsa, buka menu lagi")
+		resetState(userID)
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	query.Data = data
+
+	if config.Maintenance && userID != config.AdminID {
+		answerCallback(bot, query.ID, MaintenanceText)
+		return
+	}
+
+	if query.Data != "accept_terms" && !termsAccepted(config, userID) {
+		answerCallback(bot, query.ID, "Setujui syarat & ketentuan dulu")
+		showTerms(bot, chatID, config)
+		return
+	}
+
+	route, arg, found := findCallbackRoute(query.Data)
+	if !found {
+		// Stale button from an old message
+		answerCallback(bot, query.ID, "Tombol kadaluarsa, buka menu lagi")
+		resetState(userID)
+		showMainMenu(bot, chatID, config)
+		return
+	}
 
-	// --- Pagination ---
-	case strings.HasPrefix(query.Data, "page_"):
-		handlePagination(bot, chatID, query.Data)
+	if route.Mutating && previewMode[userID] {
+		answerCallback(bot, query.ID, "🔒 Mode preview: aksi dinonaktifkan")
+		return
+	}
 
-	// --- Action Selection ---
-	case strings.HasPrefix(query.Data, "select_renew:"):
-		startRenewUser(bot, chatID, userID, query.Data)
-	case strings.HasPrefix(query.Data, "select_delete:"):
-		confirmDeleteUser(bot, chatID, query.Data)
+	// A double tap on a confirm button must not run the action twice
+	if route.Once && !consumeCallback(userID, query) {
+		answerCallback(bot, query.ID, "")
+		return
+	}
 
-	// --- Action Confirmation ---
-	case strings.HasPrefix(query.Data, "confirm_delete:"):
-		username := strings.TrimPrefix(query.Data, "confirm_delete:")
-		deleteUser(bot, chatID, username, config)
+	// Answer first so the button stops spinning while slow work runs
+	answerCallback(bot, query.ID, callbackToasts[query.Data])
 
-	// --- Admin Actions ---
-	case query.Data == "toggle_mode":
-		toggleMode(bot, chatID, userID, config)
+	if action := route.action(); action != "" && !can(config, userID, action) {
+		denyAction(userID, action, query.Data)
+		return
 	}
+	route.Handle(bot, CallbackRequest{Query: query, ChatID: chatID, UserID: userID, Arg: arg}, config)
+}
 
-	bot.Request(tgbotapi.NewCallback(query.ID, ""))
+// isSecretState reports whether text typed in state is a password. Such
+// input must never be logged.
+func isSecretState(state string, config *BotConfig) bool {
+	return state == "create_password" || (state == "create_username" && !config.SeparatePassword)
 }
 
-func handleState(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, state string, config *BotConfig) {
+func handleState(bot Sender, msg *tgbotapi.Message, state string, config *BotConfig) {
 	userID := msg.From.ID
 	text := strings.TrimSpace(msg.Text)
 	chatID := msg.Chat.ID
 
+	if config.DeleteSecretInput && isSecretState(state, config) {
+		if _, err := bot.Request(tgbotapi.NewDeleteMessage(chatID, msg.MessageID)); err != nil {
+			log.Printf("Failed to delete password message in chat %d: %v", chatID, err)
+		}
+	}
+
 	switch state {
 	case "create_username":
-		if !validateUsername(bot, chatID, text) {
+		text = normalizeUsername(text, config.LowercaseUsernames)
+		label := "Password"
+		if config.SeparatePassword {
+			label = "Username"
+		}
+		if !validateUsername(bot, chatID, text, label) {
 			return
 		}
+		if users, err := getUsers(serverCtx(chatID)); err == nil {
+			if _, exists := findUser(users, text); exists {
+				sendMessage(bot, chatID, "❌ Password sudah dipakai. Coba lagi:")
+				return
+			}
+			if similar, found := findSimilarUser(users, text); found {
+				warnSimilarUser(bot, chatID, userID, text, similar, config)
+				return
+			}
+		}
 		tempUserData[userID]["username"] = text
-		userStates[userID] = "create_days"
-		sendMessage(bot, chatID, "⏳ Masukkan Durasi (hari):")
+		continueCreate(bot, chatID, userID, config)
+
+	case "create_password":
+		if !validatePassword(bot, chatID, text) {
+			return
+		}
+		tempUserData[userID]["password"] = text
+		promptCreateDays(bot, chatID, userID, config)
 
 	case "create_days":
-		_, ok := validateNumber(bot, chatID, text, 1, 9999, "Durasi")
+		_, ok := validateNumber(bot, chatID, text, 1, maxDurationDays(config, userID), "Durasi")
 		if !ok {
 			return
 		}
 		tempUserData[userID]["days"] = text
+		if config.AskContact {
+			setState(userID, "create_contact")
+			sendMessage(bot, chatID, "📇 Masukkan kontak pelanggan (No. HP / email), atau - untuk lewati:")
+			return
+		}
+		finishCreate(bot, chatID, userID, config)
 
-		days, _ := strconv.Atoi(text)
-		createUser(bot, chatID, tempUserData[userID]["username"], days, config)
-		resetState(userID)
+	case "create_contact":
+		if text == "-" {
+			text = ""
+		}
+		if text != "" && !contactPattern.MatchString(text) {
+			sendMessage(bot, chatID, "❌ Kontak harus No. HP atau email. Coba lagi, atau - untuk lewati:")
+			return
+		}
+		tempUserData[userID]["contact"] = text
+		finishCreate(bot, chatID, userID, config)
+
+	case "create_start_date":
+		now := time.Now().In(botLocation(config))
+		if left, ok := daysUntilExpiry(text, now); !ok || left < 1 {
+			sendMessage(bot, chatID, "❌ Tanggal tidak valid atau bukan tanggal mendatang. Format: 2006-01-02. Coba lagi:")
+			return
+		}
+		tempUserData[userID]["start_date"] = text
+		setState(userID, "create_username")
+		if config.SeparatePassword {
+			sendMessage(bot, chatID, "👤 Masukkan Username:")
+			return
+		}
+		sendMessage(bot, chatID, "👤 Masukkan Password:")
 
 	case "renew_days":
-		days, ok := validateNumber(bot, chatID, text, 1, 9999, "Durasi")
+		days, ok := validateNumber(bot, chatID, text, 1, maxDurationDays(config, userID), "Durasi")
 		if !ok {
 			return
 		}
-		renewUser(bot, chatID, tempUserData[userID]["username"], days, config)
+		tempUserData[userID]["days"] = strconv.Itoa(days)
+		confirmRenewUser(bot, chatID, userID, tempUserData[userID]["username"], days, config)
+
+	case "message_selected":
+		if text == "" {
+			sendMessage(bot, chatID, "❌ Pesan tidak boleh kosong. Coba lagi:")
+			return
+		}
+		recipients := selectedRecipients(userID)
+		resetState(userID)
+		sendMessageToSelected(bot, chatID, recipients, text, config)
+
+	case "broadcast_message":
+		switch {
+		case len(msg.Photo) > 0:
+			// Telegram lists photo sizes ascending, the last is the largest
+			tempUserData[userID]["broadcast_media_type"] = "photo"
+			tempUserData[userID]["broadcast_media_id"] = msg.Photo[len(msg.Photo)-1].FileID
+			text = strings.TrimSpace(msg.Caption)
+		case msg.Document != nil:
+			tempUserData[userID]["broadcast_media_type"] = "document"
+			tempUserData[userID]["broadcast_media_id"] = msg.Document.FileID
+			text = strings.TrimSpace(msg.Caption)
+		case text == "":
+			sendMessage(bot, chatID, "❌ Pesan tidak boleh kosong. Coba lagi:")
+			return
+		}
+		tempUserData[userID]["broadcast_text"] = text
+		delete(userStates, userID)
+		delete(stateUpdatedAt, userID)
+		showBroadcastConfirm(bot, chatID, userID)
+
+	case "broadcast_schedule_time":
+		at, err := time.ParseInLocation(ScheduleTimeLayout, text, botLocation(config))
+		if err != nil || !at.After(time.Now()) {
+			sendMessage(bot, chatID, fmt.Sprintf("❌ Waktu tidak valid atau sudah lewat. Format: %s. Coba lagi:", ScheduleTimeLayout))
+			return
+		}
+		content := broadcastFromTemp(userID)
+		resetState(userID)
+		scheduleBroadcast(bot, chatID, at, content, config)
+
+	case "account_comment":
+		username := tempUserData[userID]["username"]
 		resetState(userID)
+		if text == "-" {
+			text = ""
+		}
+		setNote(username, text, true)
+		if text == "" {
+			sendMessage(bot, chatID, fmt.Sprintf("💬 Pesan untuk %s dihapus.", username))
+		} else {
+			sendMessage(bot, chatID, fmt.Sprintf("💬 Pesan untuk %s disimpan. User melihatnya di /myaccount.", username))
+		}
+		showMainMenu(bot, chatID, config)
+
+	case "maintenance_start":
+		at, err := time.ParseInLocation(ScheduleTimeLayout, text, botLocation(config))
+		if err != nil || !at.After(time.Now()) {
+			sendMessage(bot, chatID, fmt.Sprintf("❌ Waktu tidak valid atau sudah lewat. Format: %s. Coba lagi:", ScheduleTimeLayout))
+			return
+		}
+		tempUserData[userID]["maintenance_start"] = text
+		setState(userID, "maintenance_duration")
+		sendMessage(bot, chatID, "⏱ Masukkan durasi maintenance (menit, 1-1440):")
+
+	case "maintenance_duration":
+		minutes, ok := validateNumber(bot, chatID, text, 1, 1440, "Durasi")
+		if !ok {
+			return
+		}
+		tempUserData[userID]["maintenance_minutes"] = strconv.Itoa(minutes)
+		delete(userStates, userID)
+		delete(stateUpdatedAt, userID)
+		showMaintenanceWindowConfirm(bot, chatID, userID, config)
 	}
 }
 
 // ==========================================
-// Feature Implementation
+// Callback Routing
 // ==========================================
 
-func startCreateUser(bot *tgbotapi.BotAPI, chatID int64, userID int64) {
-	userStates[userID] = "create_username"
-	tempUserData[userID] = make(map[string]string)
-	sendMessage(bot, chatID, "👤 Masukkan Password:")
+// CallbackRequest carries what a callback handler needs.
+type CallbackRequest struct {
+	Query  *tgbotapi.CallbackQuery
+	ChatID int64
+	UserID int64
+	Arg    string // Data after the prefix, for prefix routes
 }
 
-func startRenewUser(bot *tgbotapi.BotAPI, chatID int64, userID int64, data string) {
-	username := strings.TrimPrefix(data, "select_renew:")
-	tempUserData[userID] = map[string]string{"username": username}
-	userStates[userID] = "renew_days"
-	sendMessage(bot, chatID, fmt.Sprintf("🔄 Renewing %s\n⏳ Masukkan Tambahan Durasi (hari):", username))
+type CallbackRoute struct {
+	AdminOnly bool
+	Action    string // Permission needed, overrides AdminOnly
+	Mutating  bool   // Changes accounts; refused while the owner previews as user
+	Once      bool   // Final confirm step; a repeated tap on the same message is ignored
+	Handle    func(bot Sender, req CallbackRequest, config *BotConfig)
 }
 
-func confirmDeleteUser(bot *tgbotapi.BotAPI, chatID int64, data string) {
-	username := strings.TrimPrefix(data, "select_delete:")
-	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("❓ Yakin ingin menghapus user `%s`?", username))
-	msg.ParseMode = "Markdown"
-	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("✅ Ya, Hapus", "confirm_delete:"+username),
-			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
-		),
-	)
-	sendAndTrack(bot, msg)
+// action returns the permission a route needs, "" when anyone may use it.
+func (r CallbackRoute) action() string {
+	if r.Action != "" {
+		return r.Action
+	}
+	if r.AdminOnly {
+		return "admin"
+	}
+	return ""
 }
 
-func cancelOperation(bot *tgbotapi.BotAPI, chatID int64, userID int64, config *BotConfig) {
-	resetState(userID)
-	showMainMenu(bot, chatID, config)
+type prefixRoute struct {
+	Prefix string
+	Route  CallbackRoute
 }
 
-func handlePagination(bot *tgbotapi.BotAPI, chatID int64, data string) {
-	parts := strings.Split(data, ":")
-	action := parts[0][5:] // remove "page_"
-	page, _ := strconv.Atoi(parts[1])
-	showUserSelection(bot, chatID, page, action)
+// callbackRoutes matches callback data exactly; callbackPrefixRoutes are
+// tried in order when no exact route matches.
+var callbackRoutes map[string]CallbackRoute
+var callbackPrefixRoutes []prefixRoute
+
+func init() {
+	callbackRoutes = map[string]CallbackRoute{
+		// --- Menu Navigation ---
+		"menu_create": {Action: "create", Mutating: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startCreateUser(bot, req.ChatID, req.UserID, config)
+		}},
+		"menu_quick_create": {Action: "create", Mutating: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			quickCreateUser(bot, req.ChatID, req.UserID, config)
+		}},
+		"menu_delete": {Action: "delete", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showUserSelection(bot, req.ChatID, 1, "delete")
+		}},
+		"menu_renew": {Action: "renew", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showUserSelection(bot, req.ChatID, 1, "renew")
+		}},
+		"resend_last": {Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			resendLastCreated(bot, req.ChatID, req.UserID, config)
+		}},
+		"menu_referral": {Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showReferralInfo(bot, req.ChatID, req.UserID, config)
+		}},
+		"menu_export": {Action: "export", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showUserSelection(bot, req.ChatID, 1, "export")
+		}},
+		"menu_create_later": {AdminOnly: true, Mutating: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startCreateLater(bot, req.ChatID, req.UserID)
+		}},
+		"menu_autorenew": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showUserSelection(bot, req.ChatID, 1, "autorenew")
+		}},
+		"menu_comment": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showUserSelection(bot, req.ChatID, 1, "comment")
+		}},
+		"menu_servers": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showServerMenu(bot, req.ChatID)
+		}},
+		"menu_migrate": {AdminOnly: true, Mutating: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showUserSelection(bot, req.ChatID, 1, "migrate")
+		}},
+		"migrate_confirm": {AdminOnly: true, Mutating: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			migrateUser(bot, req.ChatID, req.UserID, config)
+		}},
+		"menu_connections": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showUserSelection(bot, req.ChatID, 1, "connections")
+		}},
+		"menu_renew_history": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showUserSelection(bot, req.ChatID, 1, "history")
+		}},
+		"menu_list": {Action: "list", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			listUsers(bot, req.ChatID, req.UserID, "all", 1, config)
+		}},
+		"menu_info": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			systemInfo(bot, req.ChatID, config)
+		}},
+		"create_similar_ok": {Action: "create", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			acceptSimilarUser(bot, req.ChatID, req.UserID, config)
+		}},
+		"renew_confirm": {Action: "renew", Mutating: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			acceptRenewUser(bot, req.ChatID, req.UserID, config)
+		}},
+		"retry_last": {Mutating: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			runRetry(bot, req.ChatID, config)
+		}},
+		"cancel": {Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			cancelOperation(bot, req.ChatID, req.UserID, config)
+		}},
+
+		// --- Backup & Restore ---
+		"menu_backup_restore": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showBackupRestoreMenu(bot, req.ChatID)
+		}},
+		"menu_backup_action": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			performBackup(bot, req.ChatID, config)
+		}},
+		"menu_restore_action": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startRestore(bot, req.ChatID, req.UserID)
+		}},
+
+		// --- Direct Messages ---
+		"menu_message": {Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			tempUserData[req.UserID] = map[string]string{}
+			showUserSelectionForMessage(bot, req.ChatID, req.UserID, 1, config)
+		}},
+		"restore_apply": {AdminOnly: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			applyRestore(bot, req.ChatID, req.UserID, config)
+		}},
+		"msg_send": {Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startSelectedMessage(bot, req.ChatID, req.UserID, config)
+		}},
+
+		// --- Broadcast ---
+		"menu_broadcast": {Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showBroadcastMenu(bot, req.ChatID)
+		}},
+		"broadcast_compose": {Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startBroadcastCompose(bot, req.ChatID, req.UserID)
+		}},
+		"broadcast_send": {Action: "broadcast", Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			confirmBroadcast(bot, req.ChatID, req.UserID, config)
+		}},
+		"broadcast_test": {Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			testBroadcast(bot, req.ChatID, req.UserID, config)
+		}},
+		"broadcast_schedule": {Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startScheduleBroadcast(bot, req.ChatID, req.UserID, config)
+		}},
+		"broadcast_schedules": {Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showScheduledBroadcasts(bot, req.ChatID)
+		}},
+		"broadcast_optout": {Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			if setBroadcastOptOut(req.UserID, true) {
+				audit(req.UserID, "broadcast_optout", "")
+			}
+			sendMessage(bot, req.ChatID, "🔕 Anda tidak akan menerima broadcast lagi.\nKetik /subscribe untuk berlangganan kembali.")
+		}},
+		"broadcast_cancel": {Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			cancelBroadcast(bot, req.ChatID)
+		}},
+		"maintenance_window": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startMaintenanceWindow(bot, req.ChatID, req.UserID, config)
+		}},
+
+		// --- Admin Actions ---
+		"menu_prune_chats": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			pruneChatsNow(bot, req.ChatID, config)
+		}},
+		"accept_terms": {Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			acceptTerms(req.UserID, config.TermsVersion)
+			showMainMenu(bot, req.ChatID, config)
+		}},
+		"preview_enter": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			setPreviewMode(bot, req.ChatID, req.UserID, true, config)
+		}},
+		"preview_exit": {Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			setPreviewMode(bot, req.ChatID, req.UserID, false, config)
+		}},
+		"domain_keep_config": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			resolveDomainMismatch(bot, req.ChatID, config.Domain, config)
+		}},
+		"domain_keep_file": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			resolveDomainMismatch(bot, req.ChatID, readDomainFile(), config)
+		}},
+		"toggle_mode": {AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			toggleMode(bot, req.ChatID, req.UserID, config)
+		}},
+		"purge_expired": {AdminOnly: true, Mutating: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			purgeExpired(bot, req.ChatID, req.UserID, config)
+		}},
+		"mode_public_confirm": {AdminOnly: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			confirmPublicMode(bot, req.ChatID, req.UserID, false, config)
+		}},
+		"mode_public_force": {AdminOnly: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			confirmPublicMode(bot, req.ChatID, req.UserID, true, config)
+		}},
+	}
+
+	callbackPrefixRoutes = []prefixRoute{
+		// --- Pagination ---
+		{"page_", CallbackRoute{Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			handlePagination(bot, req.ChatID, req.Query.Data)
+		}}},
+
+		{"list_filter:", CallbackRoute{Action: "list", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			handleListFilter(bot, req.ChatID, req.UserID, req.Arg, config)
+		}}},
+
+		// --- Action Selection ---
+		{"select_renew:", CallbackRoute{Action: "renew", Mutating: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startRenewUser(bot, req.ChatID, req.UserID, req.Query.Data, config)
+		}}},
+		{"select_export:", CallbackRoute{Action: "export", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			exportUserCredentials(bot, req.ChatID, req.Arg, config)
+		}}},
+		{"server_select:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			selectServer(bot, req.ChatID, req.Arg, config)
+		}}},
+		{"select_connections:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showConnectionHistory(bot, req.ChatID, req.Arg, config)
+		}}},
+		{"select_history:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			showRenewHistory(bot, req.ChatID, req.Arg, config)
+		}}},
+		{"broadcast_target:", CallbackRoute{Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			setBroadcastTarget(bot, req.ChatID, req.UserID, req.Arg)
+		}}},
+		{"remind_renew:", CallbackRoute{Action: "renew", Mutating: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			renewFromReminder(bot, req.ChatID, req.UserID, req.Arg, config)
+		}}},
+		{"select_migrate:", CallbackRoute{AdminOnly: true, Mutating: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			chooseMigrationTarget(bot, req.ChatID, req.UserID, req.Arg, config)
+		}}},
+		{"migrate_to:", CallbackRoute{AdminOnly: true, Mutating: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			confirmMigration(bot, req.ChatID, req.UserID, req.Arg, config)
+		}}},
+		{"select_autorenew:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			toggleAutoRenew(bot, req.ChatID, req.Arg, config)
+		}}},
+		{"select_comment:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			startAccountComment(bot, req.ChatID, req.UserID, req.Arg, config)
+		}}},
+		{"client_format:", CallbackRoute{Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			sendClientFormat(bot, req.ChatID, req.Arg, config)
+		}}},
+		{"select_delete:", CallbackRoute{Action: "delete", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			confirmDeleteUser(bot, req.ChatID, req.UserID, req.Query.Data, config)
+		}}},
+
+		// --- Action Confirmation ---
+		{"confirm_delete:", CallbackRoute{Action: "delete", Mutating: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			deleteUser(bot, req.ChatID, req.UserID, req.Arg, config)
+		}}},
+
+		// --- Direct Messages ---
+		{"restore_revert:", CallbackRoute{AdminOnly: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			revertRestore(bot, req.ChatID, req.UserID, req.Arg, config)
+		}}},
+		{"restore_toggle:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			toggleRestoreFile(bot, req.ChatID, req.UserID, req.Arg)
+		}}},
+		{"msg_toggle:", CallbackRoute{Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			toggleMessageRecipient(bot, req.ChatID, req.UserID, req.Arg, config)
+		}}},
+		{"msg_page:", CallbackRoute{Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			page, _ := strconv.Atoi(req.Arg)
+			showUserSelectionForMessage(bot, req.ChatID, req.UserID, page, config)
+		}}},
+
+		// --- Chat Sessions ---
+		{"sessions_page:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			page, _ := strconv.Atoi(req.Arg)
+			showSessions(bot, req.ChatID, page, config)
+		}}},
+		{"session_forget:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			forgetSession(bot, req.ChatID, req.Arg, config)
+		}}},
+
+		// --- Broadcast ---
+		{"schedule_cancel:", CallbackRoute{Action: "broadcast", Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			cancelScheduledBroadcast(bot, req.ChatID, req.Arg)
+		}}},
+		{"maintenance_confirm:", CallbackRoute{AdminOnly: true, Once: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			confirmMaintenanceWindow(bot, req.ChatID, req.UserID, req.Arg == "auto", config)
+		}}},
+		{"maintenance_cancel:", CallbackRoute{AdminOnly: true, Handle: func(bot Sender, req CallbackRequest, config *BotConfig) {
+			cancelMaintenanceWindow(bot, req.ChatID, req.Arg, config)
+		}}},
+	}
 }
 
-func toggleMode(bot *tgbotapi.BotAPI, chatID int64, userID int64, config *BotConfig) {
-	if userID != config.AdminID {
-		return
+// MaxButtonLabel is the longest inline button label, in runes.
+const MaxButtonLabel = 40
+
+// callbackToken returns the token for value in chatID's buttons.
+func callbackToken(chatID int64, value string) string {
+	if callbackTokenIDs[chatID] == nil {
+		callbackTokenIDs[chatID] = make(map[string]string)
+		callbackTokens[chatID] = make(map[string]string)
 	}
-	if config.Mode == "public" {
-		config.Mode = "private"
-	} else {
-		config.Mode = "public"
+	if token, ok := callbackTokenIDs[chatID][value]; ok {
+		return token
 	}
-	saveConfig(config)
-	showMainMenu(bot, chatID, config)
+	token := "~" + strconv.FormatInt(int64(len(callbackTokens[chatID])), 36)
+	callbackTokens[chatID][token] = value
+	callbackTokenIDs[chatID][value] = token
+	return token
 }
 
-func createUser(bot *tgbotapi.BotAPI, chatID int64, username string, days int, config *BotConfig) {
-	res, err := apiCall("POST", "/user/create", map[string]interface{}{
-		"password": username,
-		"days":     days,
-	})
+// resolveCallbackTokens replaces each ":"-separated token in data with its
+// value. It fails if a token is unknown (e.g. a button from before a
+// restart).
+func resolveCallbackTokens(chatID int64, data string) (string, bool) {
+	if !strings.Contains(data, "~") {
+		return data, true
+	}
+	parts := strings.Split(data, ":")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "~") {
+			continue
+		}
+		value, ok := callbackTokens[chatID][part]
+		if !ok {
+			return "", false
+		}
+		parts[i] = value
+	}
+	return strings.Join(parts, ":"), true
+}
 
-	if err != nil {
-		replyError(bot, chatID, "Error API: "+err.Error())
-		return
+// truncateLabel shortens a button label to MaxButtonLabel runes.
+func truncateLabel(label string) string {
+	runes := []rune(label)
+	if len(runes) <= MaxButtonLabel {
+		return label
 	}
+	return string(runes[:MaxButtonLabel-1]) + "…"
+}
 
-	if res["success"] == true {
-		data := res["data"].(map[string]interface{})
-		sendAccountInfo(bot, chatID, data, config)
-	} else {
-		replyError(bot, chatID, fmt.Sprintf("Gagal: %s", res["message"]))
-		showMainMenu(bot, chatID, config)
+// findCallbackRoute resolves callback data to its route. For prefix routes
+// arg is the data after the prefix.
+func findCallbackRoute(data string) (route CallbackRoute, arg string, found bool) {
+	if route, ok := callbackRoutes[data]; ok {
+		return route, "", true
 	}
+	for _, r := range callbackPrefixRoutes {
+		if strings.HasPrefix(data, r.Prefix) {
+			return r.Route, strings.TrimPrefix(data, r.Prefix), true
+		}
+	}
+	return CallbackRoute{}, "", false
 }
 
-func renewUser(bot *tgbotapi.BotAPI, chatID int64, username string, days int, config *BotConfig) {
-	res, err := apiCall("POST", "/user/renew", map[string]interface{}{
-		"password": username,
-		"days":     days,
-	})
+// ==========================================
+// Feature Implementation
+// ==========================================
 
-	if err != nil {
-		replyError(bot, chatID, "Error API: "+err.Error())
+// startCreateUser begins the create flow. It checks preview mode and the
+// create permission itself because /start create reaches it without
+// going through the callback routes.
+func startCreateUser(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	if previewMode[userID] {
+		replyError(bot, chatID, "🔒 Mode preview: aksi dinonaktifkan")
 		return
 	}
-
-	if res["success"] == true {
-		data := res["data"].(map[string]interface{})
-		// For renew, we might not have the limit handy, so passing 0 or fetching it would be ideal.
-		// But for now, let's just display what we have.
-		sendAccountInfo(bot, chatID, data, config)
-	} else {
-		replyError(bot, chatID, fmt.Sprintf("Gagal: %s", res["message"]))
-		showMainMenu(bot, chatID, config)
+	if !can(config, userID, "create") {
+		denyAction(userID, "create", "start")
+		replyError(bot, chatID, "Akses Ditolak")
+		return
+	}
+	setState(userID, "create_username")
+	tempUserData[userID] = make(map[string]string)
+	if config.SeparatePassword {
+		sendMessage(bot, chatID, "👤 Masukkan Username:")
+		return
 	}
+	sendMessage(bot, chatID, "👤 Masukkan Password:")
 }
 
-func deleteUser(bot *tgbotapi.BotAPI, chatID int64, username string, config *BotConfig) {
-	res, err := apiCall("POST", "/user/delete", map[string]interface{}{
-		"password": username,
-	})
-
-	if err != nil {
-		replyError(bot, chatID, "Error API: "+err.Error())
+// continueCreate moves on from the username step: to the password step
+// when separate_password is set, otherwise straight to the duration.
+func continueCreate(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	if config.SeparatePassword {
+		setState(userID, "create_password")
+		sendMessage(bot, chatID, "🔑 Masukkan Password:")
 		return
 	}
+	promptCreateDays(bot, chatID, userID, config)
+}
 
-	if res["success"] == true {
-		msg := tgbotapi.NewMessage(chatID, "✅ Password berhasil dihapus.")
-		deleteLastMessage(bot, chatID)
-		bot.Send(msg)
-		showMainMenu(bot, chatID, config)
+// finishCreate runs the create collected by the flow and keeps the
+// optional customer contact with the new account.
+func finishCreate(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	data := tempUserData[userID]
+	days, _ := strconv.Atoi(data["days"])
+	username, password, contact := data["username"], data["password"], data["contact"]
+	startDate := data["start_date"]
+
+	// Clear state before the API call so a repeated message can't create twice
+	resetState(userID)
+	var created bool
+	if startDate != "" {
+		created = createLaterUser(bot, chatID, userID, username, password, days, startDate, config)
 	} else {
-		replyError(bot, chatID, fmt.Sprintf("Gagal: %s", res["message"]))
-		showMainMenu(bot, chatID, config)
+		created = createUser(bot, chatID, userID, username, password, days, config)
+	}
+	if created && contact != "" {
+		setContact(normalizeUsername(username, config.LowercaseUsernames), contact)
 	}
 }
 
-func listUsers(bot *tgbotapi.BotAPI, chatID int64) {
-	res, err := apiCall("GET", "/users", nil)
-	if err != nil {
-		replyError(bot, chatID, "Error API: "+err.Error())
-		return
+// contactPattern loosely accepts a phone number or an email address.
+var contactPattern = regexp.MustCompile(`^(\+?[0-9][0-9 -]{5,19}|[^@\s]+@[^@\s]+\.[^@\s]+)$`)
+
+func promptCreateDays(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	setState(userID, "create_days")
+	sendMessage(bot, chatID, fmt.Sprintf("⏳ Masukkan Durasi (hari, 1-%d):", maxDurationDays(config, userID)))
+}
+
+// warnSimilarUser asks for confirmation when a new password looks like a
+// typo of (or a re-purchase by) an existing account. It never blocks.
+// Only admins see which account it resembles.
+func warnSimilarUser(bot Sender, chatID int64, userID int64, username string, similar string, config *BotConfig) {
+	tempUserData[userID]["pending_username"] = username
+	text := fmt.Sprintf("⚠️ Password `%s` mirip dengan akun lain, lanjutkan?\n\nAtau ketik password lain:", username)
+	if hasAdminView(config, userID) {
+		text = fmt.Sprintf("⚠️ Password `%s` mirip dengan akun `%s`, lanjutkan?\n\nAtau ketik password lain:", username, similar)
 	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Lanjutkan", "create_similar_ok"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
 
-	if res["success"] == true {
-		users := res["data"].([]interface{})
-		if len(users) == 0 {
-			sendMessage(bot, chatID, "📂 Tidak ada user.")
-			return
-		}
+func acceptSimilarUser(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	username := tempUserData[userID]["pending_username"]
+	if userStates[userID] != "create_username" || username == "" {
+		replyError(bot, chatID, "Sesi pembuatan akun sudah berakhir.")
+		return
+	}
+	tempUserData[userID]["username"] = username
+	continueCreate(bot, chatID, userID, config)
+}
 
-		msg := "📋 *List Passwords*\n"
-		for _, u := range users {
-			user := u.(map[string]interface{})
-			status := "🟢"
-			if user["status"] == "Expired" {
-				status = "🔴"
-			}
-			msg += fmt.Sprintf("\n%s `%s` (%s)", status, user["password"], user["expired"])
-		}
+func startRenewUser(bot Sender, chatID int64, userID int64, data string, config *BotConfig) {
+	username := strings.TrimPrefix(data, "select_renew:")
+	user, found := requireUser(bot, chatID, username, "renew", config)
+	if !found {
+		return
+	}
+	tempUserData[userID] = map[string]string{"username": user.Password}
+	setState(userID, "renew_days")
+	sendMessage(bot, chatID, fmt.Sprintf("🔄 Renewing %s\n📅 Expired : %s\n⏳ Masukkan Tambahan Durasi (hari, 1-%d):", user.Password, user.Expired, maxDurationDays(config, userID)))
+}
 
-		reply := tgbotapi.NewMessage(chatID, msg)
-		reply.ParseMode = "Markdown"
-		sendAndTrack(bot, reply)
-	} else {
-		replyError(bot, chatID, "Gagal mengambil data.")
+// confirmRenewUser shows the expiry the renew will produce before
+// anything is changed.
+func confirmRenewUser(bot Sender, chatID int64, userID int64, username string, days int, config *BotConfig) {
+	user, found := requireUser(bot, chatID, username, "renew", config)
+	if !found {
+		return
 	}
+	newExpiry := renewedExpiry(user.Expired, days, time.Now().In(botLocation(config)))
+	setState(userID, "renew_confirm")
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("🔄 Renew %s +%d hari\n📅 Expired saat ini : %s\n📅 Expired baru : %s\n\nLanjutkan?", user.Password, days, user.Expired, newExpiry))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Renew", "renew_confirm"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
 }
 
-func systemInfo(bot *tgbotapi.BotAPI, chatID int64, config *BotConfig) {
-	res, err := apiCall("GET", "/info", nil)
-	if err != nil {
-		replyError(bot, chatID, "Error API: "+err.Error())
+// acceptRenewUser runs the renew confirmed in confirmRenewUser.
+func acceptRenewUser(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	data := tempUserData[userID]
+	days, err := strconv.Atoi(data["days"])
+	if userStates[userID] != "renew_confirm" || err != nil {
+		replyError(bot, chatID, "Sesi renew sudah berakhir.")
 		return
 	}
+	username := data["username"]
+	resetState(userID)
+	renewUser(bot, chatID, userID, username, days, config)
+}
 
-	if res["success"] == true {
-		data := res["data"].(map[string]interface{})
-		ipInfo, _ := getIpInfo()
+// renewedExpiry adds days to the later of today and the current expiry,
+// so renewing early never loses the remaining time.
+func renewedExpiry(current string, days int, now time.Time) string {
+	y, m, d := now.Date()
+	base := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	if exp, err := time.ParseInLocation("2006-01-02", current, now.Location()); err == nil && exp.After(base) {
+		base = exp
+	}
+	return base.AddDate(0, 0, days).Format("2006-01-02")
+}
 
-		msg := fmt.Sprintf("```\n━━━━━━━━━━━━━━━━━━━━━\n    INFO ZIVPN UDP\n━━━━━━━━━━━━━━━━━━━━━\nDomain         : %s\nIP Public      : %s\nPort           : %s\nService        : %s\nCITY           : %s\nISP            : %s\n━━━━━━━━━━━━━━━━━━━━━\n```",
-			config.Domain, data["public_ip"], data["port"], data["service"], ipInfo.City, ipInfo.Isp)
+func confirmDeleteUser(bot Sender, chatID int64, userID int64, data string, config *BotConfig) {
+	username := strings.TrimPrefix(data, "select_delete:")
 
-		reply := tgbotapi.NewMessage(chatID, msg)
-		reply.ParseMode = "Markdown"
-		deleteLastMessage(bot, chatID)
-		bot.Send(reply)
+	user, found := requireUser(bot, chatID, username, "delete", config)
+	if !found {
+		return
+	}
+	if isProtected(config, user.Password) {
+		replyError(bot, chatID, fmt.Sprintf("Akun dilindungi: %s tidak bisa dihapus.", user.Password))
 		showMainMenu(bot, chatID, config)
-	} else {
-		replyError(bot, chatID, "Gagal mengambil info.")
+		return
 	}
-}
 
-func showBackupRestoreMenu(bot *tgbotapi.BotAPI, chatID int64) {
-	msg := tgbotapi.NewMessage(chatID, "💾 *Backup & Restore*\nSilakan pilih menu:")
+	text := renderTemplate(config, "delete_confirm", map[string]string{
+		"{username}":    user.Password,
+		"{status}":      user.Status,
+		"{status_icon}": statusIcon(user.Status),
+		"{expired}":     user.Expired,
+	})
+	if contact := accountContact(user.Password); contact != "" && hasAdminView(config, userID) {
+		text += "\n📇 Kontak  : " + tgbotapi.EscapeText(tgbotapi.ModeMarkdown, contact)
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "Markdown"
 	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("⬇️ Backup Data", "menu_backup_action"),
-			tgbotapi.NewInlineKeyboardButtonData("⬆️ Restore Data", "menu_restore_action"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("❌ Kembali", "cancel"),
+			tgbotapi.NewInlineKeyboardButtonData("✅ Ya, Hapus", "confirm_delete:"+callbackToken(chatID, username)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
 		),
 	)
 	sendAndTrack(bot, msg)
 }
 
-func performBackup(bot *tgbotapi.BotAPI, chatID int64) {
-	sendMessage(bot, chatID, "⏳ Sedang membuat backup...")
-
-	// Files to backup
-	files := []string{
-		"/etc/zivpn/config.json",
-		"/etc/zivpn/users.json",
-		"/etc/zivpn/domain",
+// requireUser re-fetches an account right before acting on it. If it is
+// gone (deleted by another admin or removed after expiry) the user is told
+// so and gets a refreshed selection list for action.
+func requireUser(bot Sender, chatID int64, username string, action string, config *BotConfig) (UserData, bool) {
+	user, found, err := fetchUser(serverCtx(chatID), username, config)
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return UserData{}, false
 	}
+	if !found {
+		replyError(bot, chatID, fmt.Sprintf("User %s sudah tidak ada.", username))
+		showUserSelection(bot, chatID, 1, action)
+		return UserData{}, false
+	}
+	return user, true
+}
 
-	buf := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(buf)
+// exportUserCredentials sends the credentials of one account as a .txt
+// document the admin can forward to the customer.
+func exportUserCredentials(bot Sender, chatID int64, username string, config *BotConfig) {
+	user, found := requireUser(bot, chatID, username, "export", config)
+	if !found {
+		return
+	}
 
+	ipInfo, _ := getIpInfo()
+	file := tgbotapi.FileBytes{
+		Name:  user.Password + ".txt",
+		Bytes: []byte(accountInfoText("", user.Password, user.Expired, ipInfo, config)),
+	}
+
+	deleteLastMessage(bot, chatID)
+	if err := sendDocumentWithRetry(bot, chatID, file, "📄 Akun "+user.Password); err != nil {
+		replyError(bot, chatID, "Gagal mengirim file: "+err.Error())
+		return
+	}
+	if keyboard, ok := clientFormatKeyboard(chatID, user.Password, config); ok {
+		formats := tgbotapi.NewMessage(chatID, "Format lain untuk aplikasi client:")
+		formats.ReplyMarkup = keyboard
+		bot.Send(formats)
+	}
+	showMainMenu(bot, chatID, config)
+}
+
+func cancelOperation(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	resetState(userID)
+	delete(retryActions, chatID)
+	showMainMenu(bot, chatID, config)
+}
+
+func handlePagination(bot Sender, chatID int64, data string) {
+	parts := strings.Split(data, ":")
+	action := parts[0][5:] // remove "page_"
+	page, _ := strconv.Atoi(parts[1])
+	showUserSelection(bot, chatID, page, action)
+}
+
+// showSessions lists known chat sessions, most recently seen first, with
+// a "Lupakan" button for each.
+func showSessions(bot Sender, chatID int64, page int, config *BotConfig) {
+	chatsMutex.Lock()
+	sessions := make([]ChatSession, 0, len(activeChats))
+	for _, session := range activeChats {
+		sessions = append(sessions, session)
+	}
+	chatsMutex.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+
+	page, totalPages, start, end := paginate(len(sessions), page, 10)
+	loc := botLocation(config)
+
+	text := fmt.Sprintf("💬 *Chat Sessions* (%d)\n", len(sessions))
+	if len(sessions) == 0 {
+		text += "\nBelum ada sesi."
+	}
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, session := range sessions[start:end] {
+		name := session.Name
+		if name == "" {
+			name = "-"
+		}
+		text += fmt.Sprintf("\n%d. %s (`%d`)\n    Join: %s | Terakhir: %s", start+i+1, tgbotapi.EscapeText(tgbotapi.ModeMarkdown, name), session.UserID,
+			session.JoinedAt.In(loc).Format(ScheduleTimeLayout), session.LastSeen.In(loc).Format(ScheduleTimeLayout))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(truncateLabel(fmt.Sprintf("🗑 Lupakan %d. %s", start+i+1, name)), fmt.Sprintf("session_forget:%d:%d", session.UserID, page)),
+		))
+	}
+	if totalPages > 1 {
+		text += fmt.Sprintf("\n\nHalaman %d/%d", page, totalPages)
+	}
+
+	var navRow []tgbotapi.InlineKeyboardButton
+	if page > 1 {
+		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("⬅️ Prev", fmt.Sprintf("sessions_page:%d", page-1)))
+	}
+	if page < totalPages {
+		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("Next ➡️", fmt.Sprintf("sessions_page:%d", page+1)))
+	}
+	if len(navRow) > 0 {
+		rows = append(rows, navRow)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Kembali", "cancel")))
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+// forgetSession handles "session_forget:<userID>:<page>".
+func forgetSession(bot Sender, chatID int64, arg string, config *BotConfig) {
+	parts := strings.Split(arg, ":")
+	userID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return
+	}
+	page := 1
+	if len(parts) > 1 {
+		page, _ = strconv.Atoi(parts[1])
+	}
+
+	chatsMutex.Lock()
+	delete(activeChats, userID)
+	if err := saveChats(); err != nil {
+		log.Printf("Failed to save chats: %v", err)
+	}
+	chatsMutex.Unlock()
+
+	showSessions(bot, chatID, page, config)
+}
+
+func pruneChatsNow(bot Sender, chatID int64, config *BotConfig) {
+	pruned := pruneChats(chatTTL(config))
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("🧹 %d chat dihapus (tidak aktif > %d hari).", pruned, int(chatTTL(config).Hours()/24)))
+	deleteLastMessage(bot, chatID)
+	bot.Send(msg)
+	showMainMenu(bot, chatID, config)
+}
+
+func setPreviewMode(bot Sender, chatID int64, userID int64, enabled bool, config *BotConfig) {
+	if userID != config.AdminID {
+		return
+	}
+	if enabled {
+		previewMode[userID] = true
+	} else {
+		delete(previewMode, userID)
+	}
+	resetState(userID)
+	showMainMenu(bot, chatID, config)
+}
+
+// toggleMode switches to private right away; going public first explains
+// what that exposes, see confirmPublicMode.
+func toggleMode(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	if userID != config.AdminID {
+		return
+	}
+	if config.Mode == "public" {
+		setMode(userID, "private", config)
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	text := "⚠️ *Aktifkan Mode Public?*\n\nDi mode public SIAPA SAJA yang menemukan bot ini bisa membuat, memperpanjang dan menghapus akun VPN di server Anda."
+	if safeguards := publicSafeguards(config); len(safeguards) > 0 {
+		text += "\n\nPengaman aktif:\n• " + strings.Join(safeguards, "\n• ")
+	} else {
+		text += "\n\n❗ Belum ada pengaman (max\\_accounts\\_per\\_user, max\\_duration\\_days, terms\\_text) di bot-config.json."
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🌍 Ya, Jadikan Public", "mode_public_confirm"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// confirmPublicMode switches to public. Without any safeguard configured
+// the owner has to confirm a second time (force).
+func confirmPublicMode(bot Sender, chatID int64, userID int64, force bool, config *BotConfig) {
+	if config.Mode == "public" {
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	if !force && len(publicSafeguards(config)) == 0 {
+		msg := tgbotapi.NewMessage(chatID, "❗ Tanpa pengaman, satu orang bisa membuat akun tanpa batas sampai server penuh.\n\nTetap aktifkan mode public?")
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("⚠️ Ya, Saya Mengerti", "mode_public_force"),
+				tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+			),
+		)
+		sendAndTrack(bot, msg)
+		return
+	}
+	setMode(userID, "public", config)
+	showMainMenu(bot, chatID, config)
+}
+
+// publicSafeguards describes the configured limits that apply to public
+// users.
+func publicSafeguards(config *BotConfig) []string {
+	var safeguards []string
+	if config.MaxAccountsPerUser > 0 {
+		safeguards = append(safeguards, fmt.Sprintf("Maks %d akun per user", config.MaxAccountsPerUser))
+	}
+	if config.MaxDurationDays > 0 {
+		safeguards = append(safeguards, fmt.Sprintf("Maks %d hari per akun", config.MaxDurationDays))
+	}
+	if config.TermsText != "" {
+		safeguards = append(safeguards, "Syarat & ketentuan wajib disetujui")
+	}
+	return safeguards
+}
+
+func setMode(userID int64, mode string, config *BotConfig) {
+	modeMutex.Lock()
+	previous := config.Mode
+	config.Mode = mode
+	modeMutex.Unlock()
+	if err := saveConfig(config); err != nil {
+		log.Printf("Failed to save config: %v", err)
+	}
+	log.Printf("Mode changed from %s to %s by %d", previous, mode, userID)
+	audit(userID, "mode", previous+" -> "+mode)
+}
+
+func isProtected(config *BotConfig, username string) bool {
+	for _, name := range config.ProtectedAccounts {
+		if name == username {
+			return true
+		}
+	}
+	return false
+}
+
+// handleProtect implements "/protect [username]" and "/unprotect
+// <username>". Without an argument /protect lists the protected accounts.
+func handleProtect(bot Sender, chatID int64, protect bool, arg string, config *BotConfig) {
+	username := normalizeUsername(arg, config.LowercaseUsernames)
+	if username == "" {
+		if !protect {
+			replyError(bot, chatID, "Format: /unprotect <username>")
+			return
+		}
+		list := "(kosong)"
+		if len(config.ProtectedAccounts) > 0 {
+			list = strings.Join(config.ProtectedAccounts, "\n")
+		}
+		sendMessage(bot, chatID, "🛡 Akun dilindungi:\n"+list)
+		return
+	}
+
+	var names []string
+	for _, name := range config.ProtectedAccounts {
+		if name != username {
+			names = append(names, name)
+		}
+	}
+	if protect {
+		names = append(names, username)
+	}
+	config.ProtectedAccounts = names
+	if err := saveConfig(config); err != nil {
+		log.Printf("Failed to save config: %v", err)
+	}
+
+	if protect {
+		sendMessage(bot, chatID, fmt.Sprintf("🛡 %s sekarang dilindungi dari penghapusan.", username))
+	} else {
+		sendMessage(bot, chatID, fmt.Sprintf("🔓 %s tidak lagi dilindungi.", username))
+	}
+}
+
+// setMaintenance implements "/maintenance on|off". The flag is saved in the
+// bot config so it survives restarts.
+func setMaintenance(bot Sender, chatID int64, arg string, config *BotConfig) {
+	var on bool
+	switch strings.ToLower(strings.TrimSpace(arg)) {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		replyError(bot, chatID, "Format: /maintenance on|off")
+		return
+	}
+	modeMutex.Lock()
+	config.Maintenance = on
+	modeMutex.Unlock()
+	if err := saveConfig(config); err != nil {
+		log.Printf("Failed to save config: %v", err)
+	}
+	showMainMenu(bot, chatID, config)
+}
+
+// createUser creates an account and sends its details; it reports whether
+// the account was created. password is only set in separate_password mode;
+// otherwise username doubles as the connection password.
+func createUser(bot Sender, chatID int64, userID int64, username string, password string, days int, config *BotConfig) bool {
+	// Public mode create limit (the owner is exempt)
+	if config.Mode == "public" && userID != config.AdminID && config.MaxAccountsPerUser > 0 {
+		users, err := getUsers(serverCtx(chatID))
+		if err != nil {
+			replyError(bot, chatID, "Gagal mengambil data user.")
+			return false
+		}
+		if countAccountsCreatedBy(userID, users) >= config.MaxAccountsPerUser {
+			replyError(bot, chatID, fmt.Sprintf("Batas maksimal %d akun per user sudah tercapai.", config.MaxAccountsPerUser))
+			showMainMenu(bot, chatID, config)
+			return false
+		}
+	}
+
+	if !checkCapacity(bot, chatID, userID, config) {
+		showMainMenu(bot, chatID, config)
+		return false
+	}
+
+	username = normalizeUsername(username, config.LowercaseUsernames)
+	if config.DryRun {
+		dryRunReply(bot, chatID, fmt.Sprintf("Create %s (%d hari)", username, days), config)
+		return false
+	}
+
+	payload := map[string]interface{}{
+		"password": username,
+		"days":     days,
+	}
+	if password != "" {
+		payload["username"] = username
+		payload["password"] = password
+	}
+	if config.DefaultIpLimit > 0 {
+		payload["ip_limit"] = config.DefaultIpLimit
+	}
+
+	res, err := apiCall(serverCtx(chatID), "POST", "/user/create", payload)
+	invalidateUsersCache()
+
+	if err != nil {
+		replyAPIErrorWithRetry(bot, chatID, err, func() {
+			createUser(bot, chatID, userID, username, password, days, config)
+		}, config)
+		return false
+	}
+
+	if res["success"] == true {
+		data := res["data"].(map[string]interface{})
+		if password != "" {
+			data["username"] = username
+			data["password"] = password
+		}
+		recordAttribution(username, userID)
+
+		// Self-service accounts are bound to their creator for direct messages
+		if userID != config.AdminID {
+			bindAccount(username, userID, serverName(serverCtx(chatID)))
+			rewardReferral(bot, userID, config)
+		}
+		runHook(bot, config, "create", config.OnCreateHook, username, strconv.Itoa(days))
+		sendWebhook(config, WebhookEvent{Event: "create", Username: username, Days: days, Expired: fmt.Sprint(data["expired"]), ByUserID: userID})
+
+		lastCreated[userID] = CreatedAccount{Password: username, Expired: fmt.Sprint(data["expired"]), CreatedAt: time.Now()}
+		header := renderTemplate(config, "create", map[string]string{"{username}": username, "{expired}": fmt.Sprint(data["expired"]), "{days}": strconv.Itoa(days)})
+		sendAccountInfo(bot, chatID, data, header, config)
+		return true
+	}
+	replyError(bot, chatID, fmt.Sprintf("Gagal: %s", res["message"]))
+	showMainMenu(bot, chatID, config)
+	return false
+}
+
+// checkAvailability implements "/check <password>" so a name can be
+// checked without going through the create flow.
+func checkAvailability(bot Sender, chatID int64, userID int64, name string, config *BotConfig) {
+	if name == "" {
+		replyError(bot, chatID, "Format: /check <password>")
+		return
+	}
+	if rateLimited(availabilityChecks, userID, CheckRateLimit, CheckRateWindow) {
+		replyError(bot, chatID, "Terlalu banyak permintaan, tunggu sebentar.")
+		return
+	}
+	name = normalizeUsername(name, config.LowercaseUsernames)
+	if problem := usernameProblem(name, "Password"); problem != "" {
+		replyError(bot, chatID, problem)
+		return
+	}
+	users, err := getUsers(serverCtx(chatID))
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Password, name) {
+			sendMessage(bot, chatID, fmt.Sprintf("❌ Sudah dipakai: %s", name))
+			return
+		}
+	}
+	sendMessage(bot, chatID, fmt.Sprintf("✅ Tersedia: %s", name))
+}
+
+// quickCreateUser creates an account with a random password and the
+// configured defaults in one tap.
+func quickCreateUser(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	password, err := randomPassword(8)
+	if err != nil {
+		replyError(bot, chatID, "Gagal membuat password acak.")
+		return
+	}
+	days := defaultDays(config)
+	if limit := maxDurationDays(config, userID); days > limit {
+		days = limit
+	}
+	resetState(userID)
+	createUser(bot, chatID, userID, password, "", days, config)
+}
+
+func renewUser(bot Sender, chatID int64, userID int64, username string, days int, config *BotConfig) {
+	user, found := requireUser(bot, chatID, username, "renew", config)
+	if !found {
+		return
+	}
+	username = user.Password
+	newExpiry := renewedExpiry(user.Expired, days, time.Now().In(botLocation(config)))
+	if config.DryRun {
+		dryRunReply(bot, chatID, fmt.Sprintf("Renew %s (+%d hari, s/d %s)", username, days, newExpiry), config)
+		return
+	}
+
+	// Older API builds ignore "expired" and extend by days themselves
+	res, err := apiCall(serverCtx(chatID), "POST", "/user/renew", map[string]interface{}{
+		"password": username,
+		"days":     days,
+		"expired":  newExpiry,
+	})
+	invalidateUsersCache()
+
+	if err != nil {
+		replyAPIErrorWithRetry(bot, chatID, err, func() {
+			renewUser(bot, chatID, userID, username, days, config)
+		}, config)
+		return
+	}
+
+	if res["success"] == true {
+		data := res["data"].(map[string]interface{})
+		recordRenewal(config, username, user.Expired, fmt.Sprint(data["expired"]), days, userID)
+		sendWebhook(config, WebhookEvent{Event: "renew", Username: username, Days: days, Expired: fmt.Sprint(data["expired"]), ByUserID: userID})
+		// For renew, we might not have the limit handy, so passing 0 or fetching it would be ideal.
+		// But for now, let's just display what we have.
+		header := renderTemplate(config, "renew", map[string]string{"{username}": username, "{expired}": fmt.Sprint(data["expired"]), "{days}": strconv.Itoa(days)})
+		sendAccountInfo(bot, chatID, data, header, config)
+	} else {
+		replyError(bot, chatID, fmt.Sprintf("Gagal: %s", res["message"]))
+		showMainMenu(bot, chatID, config)
+	}
+}
+
+func deleteUser(bot Sender, chatID int64, userID int64, username string, config *BotConfig) {
+	user, found := requireUser(bot, chatID, username, "delete", config)
+	if !found {
+		return
+	}
+	username = user.Password
+	if isProtected(config, username) {
+		replyError(bot, chatID, fmt.Sprintf("Akun dilindungi: %s tidak bisa dihapus.", username))
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	if config.DryRun {
+		dryRunReply(bot, chatID, "Delete "+username, config)
+		return
+	}
+
+	res, err := apiCall(serverCtx(chatID), "POST", "/user/delete", map[string]interface{}{
+		"password": username,
+	})
+	invalidateUsersCache()
+
+	if err != nil {
+		replyAPIErrorWithRetry(bot, chatID, err, func() {
+			deleteUser(bot, chatID, userID, username, config)
+		}, config)
+		return
+	}
+
+	if res["success"] == true {
+		forgetAccount(username)
+		runHook(bot, config, "delete", config.OnDeleteHook, username)
+		sendWebhook(config, WebhookEvent{Event: "delete", Username: username, ByUserID: userID})
+		msg := tgbotapi.NewMessage(chatID, renderTemplate(config, "delete", map[string]string{"{username}": username}))
+		deleteLastMessage(bot, chatID)
+		bot.Send(msg)
+		showMainMenu(bot, chatID, config)
+	} else {
+		replyError(bot, chatID, fmt.Sprintf("Gagal: %s", res["message"]))
+		showMainMenu(bot, chatID, config)
+	}
+}
+
+// forgetAccount drops everything the bot keeps about a deleted account and
+// returns the stores that had an entry for it.
+func forgetAccount(username string) []string {
+	var removed []string
+	if _, ok := bindingOwner(username); ok {
+		unbindAccount(username)
+		removed = append(removed, "binding")
+	}
+	if _, ok := attributions[username]; ok {
+		removeAttribution(username)
+		removed = append(removed, "attribution")
+	}
+	if isAutoRenew(username) {
+		setAutoRenew(username, false)
+		removed = append(removed, "auto-renew")
+	}
+	activationsMutex.Lock()
+	_, pending := activations[username]
+	activationsMutex.Unlock()
+	if pending {
+		removeActivation(username)
+		removed = append(removed, "activation")
+	}
+	if _, ok := notes[username]; ok {
+		removeNotes(username)
+		removed = append(removed, "notes")
+	}
+	if removeRenewHistory(username) {
+		removed = append(removed, "renew history")
+	}
+	for id, last := range lastCreated {
+		if last.Password == username {
+			delete(lastCreated, id)
+		}
+	}
+	return removed
+}
+
+// expiredAccounts lists the expired, unprotected accounts of the chat's
+// server.
+func expiredAccounts(chatID int64, config *BotConfig) ([]string, error) {
+	users, err := getUsers(serverCtx(chatID))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, u := range users {
+		if u.Status == "Expired" && !isProtected(config, u.Password) {
+			names = append(names, u.Password)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// confirmPurgeExpired implements /purgeexpired: it counts the accounts
+// first and deletes only after confirmation.
+func confirmPurgeExpired(bot Sender, chatID int64, config *BotConfig) {
+	names, err := expiredAccounts(chatID, config)
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+	if len(names) == 0 {
+		sendMessage(bot, chatID, "✅ Tidak ada akun expired.")
+		return
+	}
+	preview := strings.Join(names, ", ")
+	if len(names) > 30 {
+		preview = strings.Join(names[:30], ", ") + fmt.Sprintf(", … (+%d)", len(names)-30)
+	}
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("🧹 Hapus %d akun expired di server %s?\nBinding, atribusi, auto-renew, jadwal aktivasi dan pesan akun ikut dihapus.\n\n%s",
+		len(names), serverName(serverCtx(chatID)), preview))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🗑 Ya, Hapus %d Akun", len(names)), "purge_expired"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// purgeExpired deletes the accounts that are still expired now and reports
+// per account which bot-side stores were cleaned.
+func purgeExpired(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	names, err := expiredAccounts(chatID, config)
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+	if config.DryRun {
+		dryRunReply(bot, chatID, fmt.Sprintf("Hapus %d akun expired", len(names)), config)
+		return
+	}
+
+	var results []BatchResult
+	counts := make(map[string]int)
+	deleted := 0
+	for _, username := range names {
+		res, err := apiCall(serverCtx(chatID), "POST", "/user/delete", map[string]interface{}{"password": username})
+		if err != nil || res["success"] != true {
+			reason := fmt.Sprint(res["message"])
+			if err != nil {
+				reason = apiErrorText(err)
+			}
+			results = append(results, BatchResult{Item: username, Detail: reason})
+			continue
+		}
+		deleted++
+		removed := forgetAccount(username)
+		for _, store := range removed {
+			counts[store]++
+		}
+		runHook(bot, config, "delete", config.OnDeleteHook, username)
+		sendWebhook(config, WebhookEvent{Event: "delete", Username: username, ByUserID: userID})
+		detail := "akun"
+		if len(removed) > 0 {
+			detail += ", " + strings.Join(removed, ", ")
+		}
+		results = append(results, BatchResult{Item: username, OK: true, Detail: detail})
+	}
+	invalidateUsersCache()
+	audit(userID, "purge_expired", fmt.Sprintf("%d/%d deleted on %s", deleted, len(names), serverName(serverCtx(chatID))))
+
+	summary := fmt.Sprintf("🧹 Purge Expired: %d akun", deleted)
+	for _, store := range []string{"binding", "attribution", "auto-renew", "activation", "notes", "renew history"} {
+		summary += fmt.Sprintf(", %s %d", store, counts[store])
+	}
+	deleteLastMessage(bot, chatID)
+	sendReport(bot, chatID, summary, results)
+	showMainMenu(bot, chatID, config)
+}
+
+// handleDirectMessage implements "/message <username> <text>" for the admin.
+func handleDirectMessage(bot Sender, msg *tgbotapi.Message, config *BotConfig) {
+	chatID := msg.Chat.ID
+	parts := strings.SplitN(strings.TrimSpace(msg.CommandArguments()), " ", 2)
+	if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+		replyError(bot, chatID, "Format: /message <username> <pesan>")
+		return
+	}
+	username, text := parts[0], strings.TrimSpace(parts[1])
+
+	user, found, err := fetchUser(serverCtx(chatID), username, config)
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+	if !found {
+		replyError(bot, chatID, fmt.Sprintf("User %s tidak ditemukan.", username))
+		return
+	}
+	username = user.Password
+
+	if err := sendPrivateMessageToUser(bot, username, text); err != nil {
+		replyError(bot, chatID, fmt.Sprintf("Gagal mengirim ke %s: %v", username, err))
+		return
+	}
+	sendMessage(bot, chatID, fmt.Sprintf("✅ Pesan terkirim ke %s.", username))
+}
+
+// accountsOf lists the accounts bound to a Telegram user.
+func accountsOf(userID int64) []string {
+	bindingsMutex.RLock()
+	var names []string
+	for name, owner := range bindings {
+		if owner == userID {
+			names = append(names, name)
+		}
+	}
+	bindingsMutex.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// rateLimited records an attempt by userID in hits and reports whether it
+// exceeds limit attempts per window. Refused attempts are not recorded.
+func rateLimited(hits map[int64][]time.Time, userID int64, limit int, window time.Duration) bool {
+	var recent []time.Time
+	for _, at := range hits[userID] {
+		if time.Since(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= limit {
+		hits[userID] = recent
+		return true
+	}
+	hits[userID] = append(recent, time.Now())
+	return false
+}
+
+// forwardToAdmin passes a free-form message from a bound user on to the
+// owner. Unbound users are ignored (returns false).
+func forwardToAdmin(bot Sender, msg *tgbotapi.Message, config *BotConfig) bool {
+	accounts := accountsOf(msg.From.ID)
+	if len(accounts) == 0 {
+		return false
+	}
+
+	if rateLimited(supportForwards, msg.From.ID, SupportRateLimit, SupportRateWindow) {
+		replyError(bot, msg.Chat.ID, "Terlalu banyak pesan, tunggu sebentar.")
+		return true
+	}
+
+	adminChat := chatForUser(config.AdminID)
+	name := strings.TrimSpace(msg.From.FirstName + " " + msg.From.LastName)
+	header := fmt.Sprintf("💬 Pesan dari %s (%d)\nAkun: %s\n↩️ Balas pesan ini untuk menjawab.", name, msg.From.ID, strings.Join(accounts, ", "))
+	if msg.Text != "" {
+		header += "\n\n" + msg.Text
+	}
+	sent, err := bot.Send(tgbotapi.NewMessage(adminChat, header))
+	if err != nil {
+		log.Printf("Support forward from %d failed: %v", msg.From.ID, err)
+		replyError(bot, msg.Chat.ID, "Gagal meneruskan pesan ke admin.")
+		return true
+	}
+	trackSupportThread(sent.MessageID, msg.From.ID)
+
+	if msg.Text == "" {
+		copyMsg := tgbotapi.NewCopyMessage(adminChat, msg.Chat.ID, msg.MessageID)
+		copyMsg.ReplyToMessageID = sent.MessageID
+		if copied, err := bot.Send(copyMsg); err == nil {
+			trackSupportThread(copied.MessageID, msg.From.ID)
+		}
+	}
+
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "✅ Pesan diteruskan ke admin."))
+	return true
+}
+
+// trackSupportThread lets the owner reply to messageID to reach userID,
+// evicting the oldest threads beyond SupportThreadLimit.
+func trackSupportThread(messageID int, userID int64) {
+	if _, ok := supportThreads[messageID]; !ok {
+		supportThreadOrder = append(supportThreadOrder, messageID)
+	}
+	supportThreads[messageID] = userID
+	for len(supportThreadOrder) > SupportThreadLimit {
+		delete(supportThreads, supportThreadOrder[0])
+		supportThreadOrder = supportThreadOrder[1:]
+	}
+}
+
+// relaySupportReply sends the owner's reply to a forwarded support message
+// back to its sender. It returns false for other messages.
+func relaySupportReply(bot Sender, msg *tgbotapi.Message) bool {
+	if msg.ReplyToMessage == nil {
+		return false
+	}
+	userID, ok := supportThreads[msg.ReplyToMessage.MessageID]
+	if !ok {
+		return false
+	}
+
+	target := chatForUser(userID)
+	var err error
+	if msg.Text != "" {
+		_, err = bot.Send(tgbotapi.NewMessage(target, "📩 Balasan Admin:\n\n"+msg.Text))
+	} else {
+		_, err = bot.Send(tgbotapi.NewCopyMessage(target, msg.Chat.ID, msg.MessageID))
+	}
+	if err != nil {
+		replyError(bot, msg.Chat.ID, "Gagal mengirim balasan: "+err.Error())
+		return true
+	}
+	bot.Send(tgbotapi.NewMessage(msg.Chat.ID, "✅ Balasan terkirim."))
+	return true
+}
+
+// sendPrivateMessageToUser delivers an admin message to the Telegram user
+// bound to the given account.
+func sendPrivateMessageToUser(bot Sender, username string, text string) error {
+	targetID, ok := bindingOwner(username)
+	if !ok {
+		return fmt.Errorf("user belum terhubung ke Telegram")
+	}
+	_, err := bot.Send(tgbotapi.NewMessage(chatForUser(targetID), "📩 Pesan dari Admin:\n\n"+text))
+	return err
+}
+
+// showUserSelectionForMessage lists the accounts bound to a Telegram user
+// as toggles. The ticked usernames are kept comma-separated in
+// tempUserData["message_selected"].
+func showUserSelectionForMessage(bot Sender, chatID int64, userID int64, page int, config *BotConfig) {
+	users, err := getUsers(serverCtx(chatID))
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+
+	var bound []UserData
+	for _, u := range users {
+		if _, ok := bindingOwner(u.Password); ok {
+			bound = append(bound, u)
+		}
+	}
+	if len(bound) == 0 {
+		replyError(bot, chatID, "Belum ada user yang terhubung ke Telegram.")
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range selectedRecipients(userID) {
+		selected[name] = true
+	}
+
+	page, totalPages, start, end := paginate(len(bound), page, 10)
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, u := range bound[start:end] {
+		label := "⬜ " + u.Password
+		if selected[u.Password] {
+			label = "✅ " + u.Password
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(truncateLabel(label), fmt.Sprintf("msg_toggle:%d:%s", page, callbackToken(chatID, u.Password))),
+		))
+	}
+
+	var navRow []tgbotapi.InlineKeyboardButton
+	if page > 1 {
+		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("⬅️ Prev", fmt.Sprintf("msg_page:%d", page-1)))
+	}
+	if page < totalPages {
+		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("Next ➡️", fmt.Sprintf("msg_page:%d", page+1)))
+	}
+	if len(navRow) > 0 {
+		rows = append(rows, navRow)
+	}
+
+	if len(selected) > 0 {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("📨 Kirim ke Terpilih (%d)", len(selected)), "msg_send"),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel")))
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("✉️ Pilih penerima pesan (Halaman %d/%d)\nTerpilih: %d", page, totalPages, len(selected)))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+// toggleMessageRecipient handles "msg_toggle:<page>:<username>".
+func toggleMessageRecipient(bot Sender, chatID int64, userID int64, arg string, config *BotConfig) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	page, _ := strconv.Atoi(parts[0])
+	username := parts[1]
+
+	var names []string
+	removed := false
+	for _, name := range selectedRecipients(userID) {
+		if name == username {
+			removed = true
+			continue
+		}
+		names = append(names, name)
+	}
+	if !removed {
+		names = append(names, username)
+	}
+
+	if tempUserData[userID] == nil {
+		tempUserData[userID] = map[string]string{}
+	}
+	tempUserData[userID]["message_selected"] = strings.Join(names, ",")
+	showUserSelectionForMessage(bot, chatID, userID, page, config)
+}
+
+func selectedRecipients(userID int64) []string {
+	return splitList(tempUserData[userID]["message_selected"])
+}
+
+// splitList splits a comma-separated tempUserData value.
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+func startSelectedMessage(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	count := len(selectedRecipients(userID))
+	if count == 0 {
+		showUserSelectionForMessage(bot, chatID, userID, 1, config)
+		return
+	}
+	setState(userID, "message_selected")
+	sendMessage(bot, chatID, fmt.Sprintf("✍️ Ketik pesan untuk %d user terpilih:", count))
+}
+
+// sendMessageToSelected DMs text to each selected account's owner and
+// reports the result per recipient.
+func sendMessageToSelected(bot Sender, chatID int64, recipients []string, text string, config *BotConfig) {
+	var results []BatchResult
+	for _, username := range recipients {
+		if err := sendPrivateMessageToUser(bot, username, text); err != nil {
+			log.Printf("Direct message to %s failed: %v", username, err)
+			results = append(results, BatchResult{Item: username, Detail: err.Error()})
+			continue
+		}
+		results = append(results, BatchResult{Item: username, OK: true})
+	}
+
+	deleteLastMessage(bot, chatID)
+	sendReport(bot, chatID, "✉️ Pesan ke user terpilih", results)
+	showMainMenu(bot, chatID, config)
+}
+
+// showConnectionHistory shows the latest connections of an account from
+// the API's /user/connections endpoint, if the API provides one.
+func showConnectionHistory(bot Sender, chatID int64, username string, config *BotConfig) {
+	endpoint := fmt.Sprintf("/user/connections?password=%s&limit=%d", url.QueryEscape(username), ConnectionHistoryLimit)
+	res, err := apiCall(serverCtx(chatID), "GET", endpoint, nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound && res == nil {
+		replyError(bot, chatID, "Riwayat koneksi: fitur tidak tersedia di API ini.")
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	if err != nil {
+		replyAPIError(bot, chatID, err)
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	var events []ConnectionEvent
+	dataBytes, _ := json.Marshal(res["data"])
+	json.Unmarshal(dataBytes, &events)
+	if len(events) > ConnectionHistoryLimit {
+		events = events[len(events)-ConnectionHistoryLimit:]
+	}
+
+	text := fmt.Sprintf("🔌 *Koneksi terakhir* `%s`\n", username)
+	if len(events) == 0 {
+		text += "\nBelum ada koneksi tercatat."
+	} else {
+		text += "```\n"
+		for _, e := range events {
+			text += fmt.Sprintf("%-20s %s\n", e.Time, e.IP)
+		}
+		text += "```"
+	}
+
+	reply := tgbotapi.NewMessage(chatID, text)
+	reply.ParseMode = "Markdown"
+	deleteLastMessage(bot, chatID)
+	bot.Send(reply)
+	showMainMenu(bot, chatID, config)
+}
+
+// listUsers shows one page of accounts matching filter ("all", "active"
+// or "expired") with per-category counts in the header.
+func listUsers(bot Sender, chatID int64, userID int64, filter string, page int, config *BotConfig) {
+	users, err := getUsers(serverCtx(chatID))
+	if err != nil {
+		replyAPIError(bot, chatID, err)
+		return
+	}
+
+	counts := map[string]int{}
+	var filtered []UserData
+	for _, u := range users {
+		for _, f := range []string{"all", "active", "expired"} {
+			if userMatchesFilter(u, f) {
+				counts[f]++
+			}
+		}
+		if userMatchesFilter(u, filter) {
+			filtered = append(filtered, u)
+		}
+	}
+
+	page, totalPages, start, end := paginate(len(filtered), page, 20)
+
+	msg := fmt.Sprintf("📋 *List Passwords*\nTotal: %d | 🟢 Aktif: %d | 🔴 Expired: %d\n", counts["all"], counts["active"], counts["expired"])
+	if len(filtered) == 0 {
+		msg += "\n📂 Tidak ada user."
+	}
+	// Customer contacts are for admins only
+	showContacts := hasAdminView(config, userID)
+	now := time.Now().In(botLocation(config))
+	for _, u := range filtered[start:end] {
+		expiry := u.Expired
+		if countdown := expiryCountdown(u.Expired, now); countdown != "" {
+			expiry += ", " + countdown
+		}
+		msg += fmt.Sprintf("\n%s `%s` (%s)", statusIcon(u.Status), u.Password, expiry)
+		if contact := accountContact(u.Password); contact != "" && showContacts {
+			msg += " 📇 " + tgbotapi.EscapeText(tgbotapi.ModeMarkdown, contact)
+		}
+	}
+	if totalPages > 1 {
+		msg += fmt.Sprintf("\n\nHalaman %d/%d", page, totalPages)
+	}
+
+	filterButton := func(label, f string) tgbotapi.InlineKeyboardButton {
+		if f == filter {
+			label = "• " + label + " •"
+		}
+		return tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s (%d)", label, counts[f]), fmt.Sprintf("list_filter:%s:1", f))
+	}
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			filterButton("Semua", "all"),
+			filterButton("Aktif", "active"),
+			filterButton("Expired", "expired"),
+		),
+	}
+
+	var navRow []tgbotapi.InlineKeyboardButton
+	if page > 1 {
+		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("⬅️ Prev", fmt.Sprintf("list_filter:%s:%d", filter, page-1)))
+	}
+	if page < totalPages {
+		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("Next ➡️", fmt.Sprintf("list_filter:%s:%d", filter, page+1)))
+	}
+	if len(navRow) > 0 {
+		rows = append(rows, navRow)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Kembali", "cancel")))
+
+	reply := tgbotapi.NewMessage(chatID, msg)
+	reply.ParseMode = "Markdown"
+	reply.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, reply)
+}
+
+func handleListFilter(bot Sender, chatID int64, userID int64, arg string, config *BotConfig) {
+	parts := strings.Split(arg, ":")
+	page := 1
+	if len(parts) > 1 {
+		page, _ = strconv.Atoi(parts[1])
+	}
+	listUsers(bot, chatID, userID, parts[0], page, config)
+}
+
+// expiryCountdown describes how far an expiry date is from now, e.g.
+// "3 hari lagi" or "kadaluarsa 2 hari lalu". Accounts stay active through
+// their expiry day. Unparseable dates yield "".
+func expiryCountdown(expired string, now time.Time) string {
+	days, ok := daysUntilExpiry(expired, now)
+	if !ok {
+		return ""
+	}
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%d hari lagi", days)
+	case days == 0:
+		return "berakhir hari ini"
+	default:
+		return fmt.Sprintf("kadaluarsa %d hari lalu", -days)
+	}
+}
+
+// daysUntilExpiry returns the calendar days from now's date to the expiry
+// date (0 on the expiry day, negative once past).
+func daysUntilExpiry(expired string, now time.Time) (int, bool) {
+	exp, err := time.ParseInLocation("2006-01-02", expired, now.Location())
+	if err != nil {
+		return 0, false
+	}
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	return int(math.Round(exp.Sub(today).Hours() / 24)), true
+}
+
+// botLocation returns the configured timezone, falling back to the
+// server's local time.
+func botLocation(config *BotConfig) *time.Location {
+	if config.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		log.Printf("Invalid timezone %q: %v", config.Timezone, err)
+		return time.Local
+	}
+	return loc
+}
+
+func systemInfo(bot Sender, chatID int64, config *BotConfig) {
+	res, err := apiCall(serverCtx(chatID), "GET", "/info", nil)
+	if err != nil {
+		replyAPIError(bot, chatID, err)
+		return
+	}
+
+	if res["success"] == true {
+		data := res["data"].(map[string]interface{})
+		ipInfo, _ := getIpInfo()
+		chatsMutex.Lock()
+		chats := len(activeChats)
+		chatsMutex.Unlock()
+
+		msg := fmt.Sprintf("```\n━━━━━━━━━━━━━━━━━━━━━\n    INFO %s\n━━━━━━━━━━━━━━━━━━━━━\nDomain         : %s\nIP Public      : %s\nPort           : %s\nService        : %s\nCITY           : %s\nISP            : %s\nChat Sessions  : %d/%d\n━━━━━━━━━━━━━━━━━━━━━\n```",
+			brandName(config), config.Domain, data["public_ip"], data["port"], data["service"], ipInfo.City, ipInfo.Isp, chats, maxChatSessions)
+
+		reply := tgbotapi.NewMessage(chatID, msg)
+		reply.ParseMode = "Markdown"
+		deleteLastMessage(bot, chatID)
+		bot.Send(reply)
+		showMainMenu(bot, chatID, config)
+	} else {
+		replyError(bot, chatID, "Gagal mengambil info.")
+	}
+}
+
+// pingLatency times one /info call and one Telegram send, then edits the
+// sent message into the result.
+func pingLatency(bot Sender, chatID int64) {
+	start := time.Now()
+	sent, err := bot.Send(tgbotapi.NewMessage(chatID, "🏓 Ping..."))
+	telegram := time.Since(start)
+	if err != nil {
+		log.Printf("Ping: send failed: %v", err)
+		return
+	}
+
+	start = time.Now()
+	_, err = apiCall(serverCtx(chatID), "GET", "/info", nil)
+	api := fmt.Sprintf("%dms", time.Since(start).Milliseconds())
+	if err != nil {
+		api = "gagal (" + apiErrorText(err) + ")"
+	}
+
+	text := fmt.Sprintf("🏓 API: %s, Telegram: %dms", api, telegram.Milliseconds())
+	if _, err := bot.Request(tgbotapi.NewEditMessageText(chatID, sent.MessageID, text)); err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+	}
+}
+
+// checkCapacity compares active accounts with the server's max_users from
+// /info. Near the limit the admin is warned and the create goes ahead; at
+// the limit it is refused. Servers without max_users are not limited.
+func checkCapacity(bot Sender, chatID int64, userID int64, config *BotConfig) bool {
+	res, err := apiCall(serverCtx(chatID), "GET", "/info", nil)
+	if err != nil || res["success"] != true {
+		return true
+	}
+	data, _ := res["data"].(map[string]interface{})
+	maxUsers, _ := strconv.Atoi(fmt.Sprint(data["max_users"]))
+	active, _ := strconv.Atoi(fmt.Sprint(data["active_users"]))
+	if maxUsers <= 0 {
+		return true
+	}
+
+	if active >= maxUsers {
+		replyError(bot, chatID, fmt.Sprintf("Server penuh (%d/%d). Hubungi admin.", active, maxUsers))
+		if userID != config.AdminID {
+			bot.Send(tgbotapi.NewMessage(config.AdminID, fmt.Sprintf("⛔ Server penuh (%d/%d), create ditolak.", active, maxUsers)))
+		}
+		return false
+	}
+	if active*100 >= maxUsers*CapacityWarnPercent {
+		warning := fmt.Sprintf("⚠️ Server hampir penuh (%d/%d)", active, maxUsers)
+		if userID == config.AdminID {
+			sendMessage(bot, chatID, warning)
+		} else {
+			bot.Send(tgbotapi.NewMessage(config.AdminID, warning))
+		}
+	}
+	return true
+}
+
+func showBackupRestoreMenu(bot Sender, chatID int64) {
+	msg := tgbotapi.NewMessage(chatID, "💾 *Backup & Restore*\nSilakan pilih menu:")
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⬇️ Backup Data", "menu_backup_action"),
+			tgbotapi.NewInlineKeyboardButtonData("⬆️ Restore Data", "menu_restore_action"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("❌ Kembali", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+func performBackup(bot Sender, chatID int64, config *BotConfig) {
+	sendMessage(bot, chatID, "⏳ Sedang membuat backup...")
+
+	files := backupSet(config)
+
+	data, included, missing, err := buildBackupZip(files)
+	if err != nil {
+		replyError(bot, chatID, "Gagal membuat file backup.")
+		return
+	}
+	if len(included) == 0 {
+		replyError(bot, chatID, "Backup kosong, file tidak ditemukan:\n"+strings.Join(missing, "\n"))
+		return
+	}
+	if len(data) > MaxTelegramDocumentSize {
+		replyError(bot, chatID, fmt.Sprintf("Ukuran backup %.1f MB melebihi batas Telegram 50 MB. Ambil file langsung dari server.", float64(len(data))/1024/1024))
+		return
+	}
+
+	// Create a temporary file for the upload
+	tmp, err := os.CreateTemp("", fmt.Sprintf("zivpn-backup-%s-*.zip", time.Now().Format("20060102-150405")))
+	if err != nil {
+		replyError(bot, chatID, "Gagal membuat file backup.")
+		return
+	}
+	tmpFile := tmp.Name()
+	defer os.Remove(tmpFile)
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		replyError(bot, chatID, "Gagal membuat file backup.")
+		return
+	}
+
+	caption := "✅ Backup Data ZiVPN\n" + backupFileReport(files, missing)
+
+	deleteLastMessage(bot, chatID)
+	if err := sendDocumentWithRetry(bot, chatID, tgbotapi.FilePath(tmpFile), caption); err != nil {
+		replyError(bot, chatID, "Gagal mengirim backup: "+err.Error())
+	}
+}
+
+// exportSnapshot sends users, bindings, attributions, referrals, notes and
+// chats as one JSON document. Unlike the ZIP backup it is meant for other
+// tooling, not for restore.
+func exportSnapshot(bot Sender, chatID int64) {
+	users, err := getUsers(serverCtx(chatID))
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+
+	snapshot := ExportSnapshot{
+		SchemaVersion: ExportSchemaVersion,
+		ExportedAt:    time.Now(),
+		Users:         users,
+		Bindings:      bindings,
+		Attributions:  attributions,
+		Referrals:     referrals,
+		Notes:         notes,
+	}
+
+	autoRenewMutex.Lock()
+	snapshot.AutoRenew = make(map[string]bool, len(autoRenew))
+	for name, on := range autoRenew {
+		snapshot.AutoRenew[name] = on
+	}
+	autoRenewMutex.Unlock()
+
+	chatsMutex.Lock()
+	for _, session := range activeChats {
+		snapshot.Chats = append(snapshot.Chats, session)
+	}
+	chatsMutex.Unlock()
+	sort.Slice(snapshot.Chats, func(i, j int) bool { return snapshot.Chats[i].UserID < snapshot.Chats[j].UserID })
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		replyError(bot, chatID, "Gagal membuat export.")
+		return
+	}
+	if len(data) > MaxTelegramDocumentSize {
+		replyError(bot, chatID, "Ukuran export melebihi batas Telegram 50 MB.")
+		return
+	}
+
+	file := tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("zivpn-export-%s.json", time.Now().Format("20060102-150405")),
+		Bytes: data,
+	}
+	caption := fmt.Sprintf("📦 Export ZiVPN (schema v%d)\n👥 %d user, 💬 %d chat", ExportSchemaVersion, len(users), len(snapshot.Chats))
+	if err := sendDocumentWithRetry(bot, chatID, file, caption); err != nil {
+		replyError(bot, chatID, "Gagal mengirim export: "+err.Error())
+	}
+}
+
+// exportActiveCredentials sends every active account of the selected
+// server as one .txt, ready to hand over to a customer. The temp file is
+// removed right after the upload.
+func exportActiveCredentials(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	users, err := getUsers(serverCtx(chatID))
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+
+	domain, port := serverAddress(serverCtx(chatID), config)
+
+	var b strings.Builder
+	count := 0
+	for _, u := range users {
+		if u.Status != "Active" {
+			continue
+		}
+		count++
+		fmt.Fprintf(&b, "━━━━━━━━━━━━━━━━━━━━━\nPassword   : %s\nDomain     : %s\nPort       : %s\nExpired On : %s\n", u.Password, domain, port, u.Expired)
+	}
+	if count == 0 {
+		replyError(bot, chatID, "Tidak ada akun aktif.")
+		return
+	}
+	b.WriteString("━━━━━━━━━━━━━━━━━━━━━\n")
+
+	// A temp dir keeps the upload's file name readable for customers
+	dir, err := os.MkdirTemp("", "zivpn-credentials-*")
+	if err != nil {
+		replyError(bot, chatID, "Gagal membuat file.")
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, fmt.Sprintf("akun-aktif-%s.txt", time.Now().Format("20060102")))
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		replyError(bot, chatID, "Gagal membuat file.")
+		return
+	}
+
+	caption := fmt.Sprintf("🔐 %d akun aktif\n⚠️ Berisi password, jangan diteruskan ke pihak yang tidak berhak.", count)
+	audit(userID, "export_credentials", fmt.Sprintf("%d accounts", count))
+	if err := sendDocumentWithRetry(bot, chatID, tgbotapi.FilePath(path), caption); err != nil {
+		replyError(bot, chatID, "Gagal mengirim file: "+err.Error())
+	}
+}
+
+// serverAddress returns the domain and port clients connect to, as
+// reported by the server's /info, falling back to the configured domain.
+func serverAddress(ctx context.Context, config *BotConfig) (string, string) {
+	domain, port := config.Domain, DefaultClientPort
+	if res, err := apiCall(ctx, "GET", "/info", nil); err == nil && res["success"] == true {
+		info, _ := res["data"].(map[string]interface{})
+		if d, ok := info["domain"].(string); ok && d != "" {
+			domain = d
+		}
+		if p, ok := info["port"].(string); ok && p != "" {
+			port = p
+		}
+	}
+	return domain, port
+}
+
+// ImportRow is one account of an import file.
+type ImportRow struct {
+	Password string `json:"password"`
+	Days     int    `json:"days"`
+	IpLimit  int    `json:"ip_limit,omitempty"`
+}
+
+// MaxImportRows caps the accounts created from one import file.
+const MaxImportRows = 500
+
+// processImportFile bulk-creates the accounts of an uploaded CSV or JSON
+// file on the selected server and reports each row.
+func processImportFile(bot Sender, msg *tgbotapi.Message, config *BotConfig) {
+	chatID := msg.Chat.ID
+	resetState(msg.From.ID)
+
+	if msg.Document.FileSize > MaxRestoreFileSize {
+		replyError(bot, chatID, fmt.Sprintf("File terlalu besar (maks %d MB).", MaxRestoreFileSize/1024/1024))
+		return
+	}
+	file, err := getFileWithRetry(bot, msg.Document.FileID)
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengunduh file.")
+		return
+	}
+	tmpPath, err := downloadToTemp(file.Link(config.BotToken), "zivpn-import-*")
+	if tmpPath != "" {
+		defer os.Remove(tmpPath)
+	}
+	if err != nil {
+		log.Printf("Import download failed: %v", err)
+		replyError(bot, chatID, "Gagal mengunduh file content.")
+		return
+	}
+	data, err := ioutil.ReadFile(tmpPath)
+	if err != nil {
+		replyError(bot, chatID, "Gagal membaca file.")
+		return
+	}
+
+	rows, err := parseImportFile(msg.Document.FileName, data)
+	if err != nil {
+		replyError(bot, chatID, "File tidak valid: "+err.Error())
+		return
+	}
+	if len(rows) == 0 || len(rows) > MaxImportRows {
+		replyError(bot, chatID, fmt.Sprintf("File harus berisi 1-%d akun.", MaxImportRows))
+		return
+	}
+
+	users, err := getUsers(serverCtx(chatID))
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+	seen := make(map[string]bool)
+	for _, u := range users {
+		seen[u.Password] = true
+	}
+
+	sendMessage(bot, chatID, fmt.Sprintf("⏳ Mengimport %d akun...", len(rows)))
+	maxDays := maxDurationDays(config, msg.From.ID)
+	var results []BatchResult
+	created := 0
+	for i, row := range rows {
+		item := fmt.Sprintf("#%d %s", i+1, row.Password)
+		row.Password = normalizeUsername(row.Password, config.LowercaseUsernames)
+		if problem := usernameProblem(row.Password, "Password"); problem != "" {
+			results = append(results, BatchResult{Item: item, Detail: problem})
+			continue
+		}
+		if row.Days < 1 || row.Days > maxDays {
+			results = append(results, BatchResult{Item: item, Detail: fmt.Sprintf("days harus 1-%d", maxDays)})
+			continue
+		}
+		if seen[row.Password] {
+			results = append(results, BatchResult{Item: item, Detail: "dilewati, sudah ada"})
+			continue
+		}
+		seen[row.Password] = true
+		if config.DryRun {
+			results = append(results, BatchResult{Item: item, OK: true, Detail: "[DRY RUN]"})
+			continue
+		}
+
+		payload := map[string]interface{}{"password": row.Password, "days": row.Days}
+		if row.IpLimit > 0 {
+			payload["ip_limit"] = row.IpLimit
+		} else if config.DefaultIpLimit > 0 {
+			payload["ip_limit"] = config.DefaultIpLimit
+		}
+		res, err := apiCall(serverCtx(chatID), "POST", "/user/create", payload)
+		if err != nil || res["success"] != true {
+			reason := fmt.Sprint(res["message"])
+			if err != nil {
+				reason = apiErrorText(err)
+			}
+			results = append(results, BatchResult{Item: item, Detail: reason})
+			continue
+		}
+		resData, _ := res["data"].(map[string]interface{})
+		recordAttribution(row.Password, msg.From.ID)
+		runHook(bot, config, "create", config.OnCreateHook, row.Password, strconv.Itoa(row.Days))
+		sendWebhook(config, WebhookEvent{Event: "create", Username: row.Password, Days: row.Days, Expired: fmt.Sprint(resData["expired"]), ByUserID: msg.From.ID})
+		results = append(results, BatchResult{Item: item, OK: true, Detail: "s/d " + fmt.Sprint(resData["expired"])})
+		created++
+	}
+	invalidateUsersCache()
+	audit(msg.From.ID, "import", fmt.Sprintf("%s: %d/%d created", msg.Document.FileName, created, len(rows)))
+
+	deleteLastMessage(bot, chatID)
+	sendReport(bot, chatID, "📥 Import Akun", results)
+	showMainMenu(bot, chatID, config)
+}
+
+// parseImportFile reads rows from JSON (an array of ImportRow) or CSV
+// (password,days[,ip_limit], optional header row).
+func parseImportFile(name string, data []byte) ([]ImportRow, error) {
+	if strings.HasSuffix(strings.ToLower(name), ".json") {
+		var rows []ImportRow
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, err
+		}
+		return rows, nil
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []ImportRow
+	for i, record := range records {
+		if i == 0 && len(record) > 0 && strings.EqualFold(strings.TrimSpace(record[0]), "password") {
+			continue
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("baris %d: butuh minimal password,days", i+1)
+		}
+		row := ImportRow{Password: strings.TrimSpace(record[0])}
+		if row.Days, err = strconv.Atoi(strings.TrimSpace(record[1])); err != nil {
+			return nil, fmt.Errorf("baris %d: days bukan angka", i+1)
+		}
+		if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
+			if row.IpLimit, err = strconv.Atoi(strings.TrimSpace(record[2])); err != nil {
+				return nil, fmt.Errorf("baris %d: ip_limit bukan angka", i+1)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// cleanupTempBackups removes backup, restore and credential temp files
+// left in the temp dir when the bot was killed mid-transfer (e.g. by a
+// restore's restart).
+func cleanupTempBackups(maxAge time.Duration) {
+	var matches []string
+	for _, pattern := range []string{"zivpn-backup-*.zip", "zivpn-restore-*.zip", "zivpn-credentials-*", "zivpn-import-*"} {
+		found, err := filepath.Glob(filepath.Join(os.TempDir(), pattern))
+		if err == nil {
+			matches = append(matches, found...)
+		}
+	}
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Failed to remove stale backup %s: %v", path, err)
+		} else {
+			log.Printf("Removed stale backup %s", path)
+		}
+	}
+}
+
+// buildBackupZip zips the given files (by base name). It returns which
+// files were included and which were missing.
+func buildBackupZip(files []string) (data []byte, included []string, missing []string, err error) {
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			missing = append(missing, filepath.Base(file))
+			continue
+		}
+
+		w, err := zipWriter.Create(filepath.Base(file))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, nil, nil, err
+		}
+		included = append(included, filepath.Base(file))
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, nil, nil, err
+	}
+	return buf.Bytes(), included, missing, nil
+}
+
+// backupFileReport describes each backed-up file on its own line, flagging
+// missing files and JSON files that don't parse.
+func backupFileReport(files []string, missing []string) string {
+	isMissing := make(map[string]bool)
+	for _, name := range missing {
+		isMissing[name] = true
+	}
+
+	var lines []string
 	for _, file := range files {
-		if _, err := os.Stat(file); os.IsNotExist(err) {
+		name := filepath.Base(file)
+		switch {
+		case isMissing[name]:
+			lines = append(lines, "❌ "+name+": tidak ditemukan")
+		case strings.HasSuffix(name, ".json"):
+			if err := validateJSONFile(file); err != nil {
+				lines = append(lines, fmt.Sprintf("⚠️ %s: JSON rusak (%v)", name, err))
+			} else {
+				lines = append(lines, "✅ "+name)
+			}
+		default:
+			lines = append(lines, "✅ "+name)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validateJSON reports whether data is well-formed JSON.
+func validateJSON(data []byte) error {
+	var v interface{}
+	return json.Unmarshal(data, &v)
+}
+
+func validateJSONFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return validateJSON(data)
+}
+
+// sendDocumentWithRetry uploads a file, retrying once on failure.
+func sendDocumentWithRetry(bot Sender, chatID int64, file tgbotapi.RequestFileData, caption string) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		doc := tgbotapi.NewDocument(chatID, file)
+		doc.Caption = caption
+		if _, err = bot.Send(doc); err == nil {
+			return nil
+		}
+		log.Printf("Document upload attempt %d failed: %v", attempt+1, err)
+	}
+	return err
+}
+
+func startRestore(bot Sender, chatID int64, userID int64) {
+	setState(userID, "waiting_restore_file")
+	sendMessage(bot, chatID, "⬆️ *Restore Data*\n\nSilakan kirim file ZIP backup Anda sekarang.\n\n⚠️ PERINGATAN: Data saat ini akan ditimpa!")
+}
+
+func processRestoreFile(bot Sender, msg *tgbotapi.Message, config *BotConfig) {
+	chatID := msg.Chat.ID
+	userID := msg.From.ID
+
+	resetState(userID)
+	sendMessage(bot, chatID, "⏳ Sedang memproses file...")
+
+	tooLarge := fmt.Sprintf("File terlalu besar (maks %d MB).", MaxRestoreFileSize/1024/1024)
+	if msg.Document.FileSize > MaxRestoreFileSize {
+		replyError(bot, chatID, tooLarge)
+		return
+	}
+
+	// Download file
+	fileID := msg.Document.FileID
+	file, err := getFileWithRetry(bot, fileID)
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengunduh file.")
+		return
+	}
+
+	tmpPath, err := downloadToTemp(file.Link(config.BotToken), "zivpn-restore-*.zip")
+	if err != nil {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+		if err == errRestoreTooLarge {
+			replyError(bot, chatID, tooLarge)
+			return
+		}
+		log.Printf("Restore download failed: %v", err)
+		replyError(bot, chatID, "Gagal mengunduh file content.")
+		return
+	}
+
+	loadRestoreZip(bot, chatID, userID, tmpPath, config)
+}
+
+// loadRestoreZip lists the restorable files of the ZIP at tmpPath and
+// opens the restore preview. tmpPath is owned by the restore session from
+// here on.
+func loadRestoreZip(bot Sender, chatID int64, userID int64, tmpPath string, config *BotConfig) {
+	zipFile, err := zip.OpenReader(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		replyError(bot, chatID, "File bukan format ZIP yang valid.")
+		return
+	}
+	allowed := restoreTargets(config)
+	var names []string
+	for _, f := range zipFile.File {
+		if allowed[f.Name] {
+			names = append(names, f.Name)
+		}
+	}
+	zipFile.Close()
+
+	if len(names) == 0 {
+		os.Remove(tmpPath)
+		replyError(bot, chatID, "Tidak ada file yang bisa direstore di dalam ZIP.")
+		return
+	}
+
+	sort.Strings(names)
+	tempUserData[userID] = map[string]string{
+		"restore_path":     tmpPath,
+		"restore_files":    strings.Join(names, ","),
+		"restore_selected": strings.Join(names, ","),
+	}
+	showRestorePreview(bot, chatID, userID)
+}
+
+// backupSet returns backupFiles, plus secretBackupFiles when the owner
+// opted in with backup_secrets.
+func backupSet(config *BotConfig) []string {
+	if !config.BackupSecrets {
+		return backupFiles
+	}
+	return append(append([]string(nil), backupFiles...), secretBackupFiles...)
+}
+
+// restoreTargets is the set of ZIP entries a restore may write: the base
+// names of backupSet, narrowed by RestoreFiles when that is set.
+func restoreTargets(config *BotConfig) map[string]bool {
+	policy := make(map[string]bool)
+	for _, name := range config.RestoreFiles {
+		policy[name] = true
+	}
+	targets := make(map[string]bool)
+	for _, file := range backupSet(config) {
+		name := filepath.Base(file)
+		if len(policy) == 0 || policy[name] {
+			targets[name] = true
+		}
+	}
+	return targets
+}
+
+// showRestorePreview lists the files found in the uploaded backup as
+// toggles; only the ticked ones are written by applyRestore.
+func showRestorePreview(bot Sender, chatID int64, userID int64) {
+	selected := make(map[string]bool)
+	for _, name := range splitList(tempUserData[userID]["restore_selected"]) {
+		selected[name] = true
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, name := range splitList(tempUserData[userID]["restore_files"]) {
+		label := "⬜ " + name
+		if selected[name] {
+			label = "✅ " + name
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, "restore_toggle:"+name),
+		))
+	}
+	if len(selected) > 0 {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("⬆️ Restore (%d file)", len(selected)), "restore_apply"),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel")))
+
+	msg := tgbotapi.NewMessage(chatID, "⬆️ Pilih file yang akan direstore:\n\n⚠️ File terpilih akan ditimpa!")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+// toggleRestoreFile handles "restore_toggle:<name>".
+func toggleRestoreFile(bot Sender, chatID int64, userID int64, name string) {
+	if tempUserData[userID]["restore_path"] == "" {
+		replyError(bot, chatID, "Sesi restore sudah berakhir, kirim ulang file backup.")
+		return
+	}
+
+	var names []string
+	removed := false
+	for _, selected := range splitList(tempUserData[userID]["restore_selected"]) {
+		if selected == name {
+			removed = true
+			continue
+		}
+		names = append(names, selected)
+	}
+	if !removed {
+		names = append(names, name)
+	}
+	tempUserData[userID]["restore_selected"] = strings.Join(names, ",")
+	showRestorePreview(bot, chatID, userID)
+}
+
+// applyRestore writes the selected files from the uploaded backup and
+// restarts the services.
+func applyRestore(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	tmpPath := tempUserData[userID]["restore_path"]
+	selected := make(map[string]bool)
+	for _, name := range splitList(tempUserData[userID]["restore_selected"]) {
+		selected[name] = true
+	}
+	defer resetState(userID)
+
+	if tmpPath == "" || len(selected) == 0 {
+		replyError(bot, chatID, "Sesi restore sudah berakhir, kirim ulang file backup.")
+		return
+	}
+
+	zipFile, err := zip.OpenReader(tmpPath)
+	if err != nil {
+		replyError(bot, chatID, "File backup tidak bisa dibuka.")
+		return
+	}
+	defer zipFile.Close()
+
+	if config.DryRun {
+		var names []string
+		for name := range selected {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		dryRunReply(bot, chatID, "Restore "+strings.Join(names, ", "), config)
+		return
+	}
+
+	snapshot, err := savePreRestoreSnapshot(config)
+	if err != nil {
+		log.Printf("Pre-restore snapshot failed: %v", err)
+		replyError(bot, chatID, "Gagal membuat backup sebelum restore, restore dibatalkan.")
+		return
+	}
+
+	// Security check: only allow specific files
+	allowed := restoreTargets(config)
+	for _, f := range zipFile.File {
+		if !allowed[f.Name] || !selected[f.Name] {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			log.Printf("Failed to read %s from backup: %v", f.Name, err)
+			continue
+		}
+
+		dstPath := filepath.Join("/etc/zivpn", f.Name)
+		if err := keepPreviousFile(dstPath); err != nil {
+			log.Printf("Failed to keep previous %s: %v", dstPath, err)
+		}
+		if err := writeFileAtomic(dstPath, data, 0644); err != nil {
+			log.Printf("Failed to restore %s: %v", dstPath, err)
+		}
+	}
+
+	// Restart Services
+	sendMessage(bot, chatID, "⏳ Merestart service...")
+	var failed []string
+	for _, service := range []string{"zivpn", "zivpn-api"} {
+		if !restartAndVerify(service, restartAttempts(config)) {
+			failed = append(failed, service)
+		}
+	}
+	invalidateUsersCache()
+
+	if len(failed) > 0 {
+		deleteLastMessage(bot, chatID)
+		text := fmt.Sprintf("⚠️ Restore ditulis, tapi service gagal jalan: %s\nFile sebelumnya disimpan sebagai *.bak di /etc/zivpn untuk pemulihan manual.", strings.Join(failed, ", "))
+		if snapshot != "" {
+			text += "\nSnapshot lengkap: " + snapshot
+		}
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	msgSuccess := tgbotapi.NewMessage(chatID, "✅ Restore Berhasil!\nService ZiVPN, API, dan Bot telah direstart.")
+	if snapshot != "" {
+		msgSuccess.Text += "\n\n↩️ Data sebelum restore disimpan di " + snapshot
+		msgSuccess.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("↩️ Kembalikan", "restore_revert:"+filepath.Base(snapshot)),
+			),
+		)
+	}
+	bot.Send(msgSuccess)
+
+	// Restart Bot with delay to allow message sending
+	go func() {
+		time.Sleep(2 * time.Second)
+		exec.Command("systemctl", "restart", "zivpn-bot").Run()
+	}()
+
+	showMainMenu(bot, chatID, config)
+}
+
+// errRestoreTooLarge is returned when a download exceeds MaxRestoreFileSize.
+var errRestoreTooLarge = errors.New("restore file too large")
+
+// getFileWithRetry calls GetFile, waiting once if Telegram answers with a
+// flood-wait (retry_after).
+func getFileWithRetry(bot Sender, fileID string) (tgbotapi.File, error) {
+	file, err := bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 && tgErr.RetryAfter <= 30 {
+		time.Sleep(time.Duration(tgErr.RetryAfter) * time.Second)
+		file, err = bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	}
+	return file, err
+}
+
+// downloadToTemp streams url into a temp file named after pattern,
+// aborting after RestoreDownloadTimeout or once MaxRestoreFileSize is
+// exceeded. The temp path is returned (even on error) so the caller can
+// remove it.
+func downloadToTemp(url string, pattern string) (string, error) {
+	client := &http.Client{Timeout: RestoreDownloadTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download returned %s", resp.Status)
+	}
+	if resp.ContentLength > MaxRestoreFileSize {
+		return "", errRestoreTooLarge
+	}
+
+	tmp, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, MaxRestoreFileSize+1))
+	if err != nil {
+		return tmp.Name(), err
+	}
+	if n > MaxRestoreFileSize {
+		return tmp.Name(), errRestoreTooLarge
+	}
+	return tmp.Name(), nil
+}
+
+// startWatchdog checks zivpn and zivpn-api every WatchdogInterval. A
+// service must be down on two checks in a row (so restarts by a restore
+// are not caught); the owner is told when it goes down and comes back.
+// With watchdog_auto_restart it is restarted, at most
+// watchdog_max_restarts times per hour.
+func startWatchdog(bot Sender, config *BotConfig) {
+	services := []string{"zivpn", "zivpn-api"}
+	failures := make(map[string]int)
+	down := make(map[string]bool)
+	restarts := make(map[string][]time.Time)
+
+	ticker := time.NewTicker(WatchdogInterval)
+	for range ticker.C {
+		for _, service := range services {
+			if exec.Command("systemctl", "is-active", "--quiet", service).Run() == nil {
+				failures[service] = 0
+				if down[service] {
+					down[service] = false
+					audit(0, "watchdog_recovered", service)
+					bot.Send(tgbotapi.NewMessage(config.AdminID, fmt.Sprintf("✅ %s kembali berjalan.", service)))
+				}
+				continue
+			}
+
+			failures[service]++
+			if failures[service] < 2 {
+				continue
+			}
+			if !down[service] {
+				down[service] = true
+				audit(0, "watchdog_down", service)
+				text := fmt.Sprintf("⚠️ %s mati", service)
+				if config.WatchdogAutoRestart {
+					text += ", mencoba restart"
+				}
+				bot.Send(tgbotapi.NewMessage(config.AdminID, text))
+			}
+			if !config.WatchdogAutoRestart {
+				continue
+			}
+
+			var recent []time.Time
+			for _, at := range restarts[service] {
+				if time.Since(at) < time.Hour {
+					recent = append(recent, at)
+				}
+			}
+			if len(recent) >= watchdogMaxRestarts(config) {
+				if len(recent) == watchdogMaxRestarts(config) {
+					audit(0, "watchdog_gave_up", service)
+					bot.Send(tgbotapi.NewMessage(config.AdminID, fmt.Sprintf("⛔ %s sudah direstart %d kali dalam 1 jam, auto-restart dihentikan sementara. Cek: journalctl -u %s", service, len(recent), service)))
+					// Marks the notice as sent until the window frees up
+					recent = append(recent, time.Now())
+				}
+				restarts[service] = recent
+				continue
+			}
+			restarts[service] = append(recent, time.Now())
+
+			ok := restartAndVerify(service, 1)
+			audit(0, "watchdog_restart", fmt.Sprintf("%s ok=%v", service, ok))
+			if !ok {
+				log.Printf("Watchdog restart of %s failed", service)
+			}
+		}
+	}
+}
+
+// startClockCheck compares the server clock with a reference at startup
+// and every ClockCheckInterval. The owner is told when the drift crosses
+// clock_drift_seconds and again once it is back in range.
+func startClockCheck(bot Sender, config *BotConfig) {
+	threshold := config.ClockDriftSeconds
+	if threshold < 0 {
+		return
+	}
+	if threshold == 0 {
+		threshold = DefaultClockDriftSeconds
+	}
+	source := config.ClockCheckURL
+	if source == "" {
+		source = DefaultClockCheckURL
+	}
+
+	warned := false
+	for {
+		drift, err := clockDrift(source)
+		if err != nil {
+			log.Printf("Clock check against %s failed: %v", source, err)
+		} else {
+			off := math.Abs(drift.Seconds()) > float64(threshold)
+			if off && !warned {
+				direction := "terlambat"
+				if drift > 0 {
+					direction = "terlalu cepat"
+				}
+				log.Printf("Clock drift %s against %s", drift.Round(time.Second), source)
+				audit(0, "clock_drift", drift.Round(time.Second).String())
+				bot.Send(tgbotapi.NewMessage(config.AdminID, fmt.Sprintf("⚠️ Jam server meleset %s (%s) dibanding %s.\nPerhitungan expired dan pengingat bisa salah. Perbaiki dengan: timedatectl set-ntp true",
+					formatDrift(drift), direction, source)))
+			} else if !off && warned {
+				bot.Send(tgbotapi.NewMessage(config.AdminID, "✅ Jam server sudah sesuai kembali."))
+			}
+			warned = off
+		}
+		time.Sleep(ClockCheckInterval)
+	}
+}
+
+// clockDrift returns local time minus the Date header of source, measured
+// at the midpoint of the request.
+func clockDrift(source string) (time.Duration, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	sent := time.Now()
+	resp, err := client.Head(source)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	received := time.Now()
+
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no usable Date header: %v", err)
+	}
+	local := sent.Add(received.Sub(sent) / 2)
+	return local.Sub(remote), nil
+}
+
+// formatDrift renders a drift as "3 menit" or "45 detik".
+func formatDrift(drift time.Duration) string {
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift >= time.Minute {
+		return fmt.Sprintf("%d menit", int(drift.Minutes()))
+	}
+	return fmt.Sprintf("%d detik", int(drift.Seconds()))
+}
+
+func watchdogMaxRestarts(config *BotConfig) int {
+	if config.WatchdogMaxRestarts > 0 {
+		return config.WatchdogMaxRestarts
+	}
+	return DefaultWatchdogMaxRestarts
+}
+
+// preRestorePattern matches snapshot names, so a callback can't point
+// restore_revert anywhere else.
+var preRestorePattern = regexp.MustCompile(`^pre-restore-[0-9]{8}-[0-9]{6}\.zip$`)
+
+// savePreRestoreSnapshot zips the current backupSet into PreRestoreDir
+// and prunes old snapshots. It returns "" when snapshots are turned off.
+func savePreRestoreSnapshot(config *BotConfig) (string, error) {
+	keep := config.PreRestoreKeep
+	if keep < 0 {
+		return "", nil
+	}
+	if keep == 0 {
+		keep = DefaultPreRestoreKeep
+	}
+
+	data, _, _, err := buildBackupZip(backupSet(config))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(PreRestoreDir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(PreRestoreDir, "pre-restore-"+time.Now().Format("20060102-150405")+".zip")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+
+	// Names sort by time; drop all but the newest keep
+	matches, _ := filepath.Glob(filepath.Join(PreRestoreDir, "pre-restore-*.zip"))
+	sort.Strings(matches)
+	for len(matches) > keep {
+		if err := os.Remove(matches[0]); err != nil {
+			log.Printf("Failed to prune %s: %v", matches[0], err)
+		}
+		matches = matches[1:]
+	}
+	return path, nil
+}
+
+// revertRestore loads a pre-restore snapshot into the normal restore
+// preview, so reverting is reviewed like any other restore.
+func revertRestore(bot Sender, chatID int64, userID int64, name string, config *BotConfig) {
+	if !preRestorePattern.MatchString(name) {
+		replyError(bot, chatID, "Snapshot tidak valid.")
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(PreRestoreDir, name))
+	if err != nil {
+		replyError(bot, chatID, "Snapshot sudah tidak ada.")
+		return
+	}
+
+	// The session deletes its ZIP when done, so work on a copy
+	tmp, err := os.CreateTemp("", "zivpn-restore-*.zip")
+	if err != nil {
+		replyError(bot, chatID, "Gagal menyiapkan snapshot.")
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		replyError(bot, chatID, "Gagal menyiapkan snapshot.")
+		return
+	}
+	resetState(userID)
+	loadRestoreZip(bot, chatID, userID, tmp.Name(), config)
+}
+
+// keepPreviousFile copies path to path.bak before a restore overwrites it.
+func keepPreviousFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(path+".bak", data, 0644)
+}
+
+// restartAndVerify restarts a systemd service and waits until it is active.
+// For zivpn-api it also waits for /info to answer. It retries the restart
+// up to attempts times.
+func restartAndVerify(service string, attempts int) bool {
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err := exec.Command("systemctl", "restart", service).Run(); err != nil {
+			log.Printf("Restart %s attempt %d failed: %v", service, attempt, err)
+			continue
+		}
+
+		deadline := time.Now().Add(RestartVerifyTimeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+			if exec.Command("systemctl", "is-active", "--quiet", service).Run() != nil {
+				continue
+			}
+			if service != "zivpn-api" {
+				return true
+			}
+			if res, err := apiCall(appCtx, "GET", "/info", nil); err == nil && res["success"] == true {
+				return true
+			}
+		}
+		log.Printf("Service %s not up after attempt %d", service, attempt)
+	}
+	return false
+}
+
+func restartAttempts(config *BotConfig) int {
+	if config.RestartAttempts <= 0 {
+		return DefaultRestartAttempts
+	}
+	return config.RestartAttempts
+}
+
+// runHook executes a configured provisioning hook in the background and
+// reports failures (with the command output) to the admin.
+func runHook(bot Sender, config *BotConfig, event string, hook string, args ...string) {
+	if hook == "" {
+		return
+	}
+	bot = backgroundSender(bot)
+	go func() {
+		ctx, cancel := context.WithTimeout(appCtx, HookTimeout)
+		defer cancel()
+
+		output, err := exec.CommandContext(ctx, hook, args...).CombinedOutput()
+		if err == nil {
+			return
+		}
+		log.Printf("Hook %s failed: %v: %s", event, err, output)
+
+		text := fmt.Sprintf("⚠️ Hook %s gagal untuk %s: %v", event, args[0], err)
+		if out := strings.TrimSpace(string(output)); out != "" {
+			if len(out) > 1000 {
+				out = out[:1000] + "…"
+			}
+			text += "\n\n" + out
+		}
+		bot.Send(tgbotapi.NewMessage(config.AdminID, text))
+	}()
+}
+
+// sendWebhook POSTs a signed lifecycle event to the configured webhook.
+// It is fire-and-forget and retries once on failure.
+func sendWebhook(config *BotConfig, event WebhookEvent) {
+	hook := config.Webhooks
+	if hook == nil || hook.URL == "" || !webhookWants(hook, event.Event) {
+		return
+	}
+	event.Timestamp = time.Now().Unix()
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Webhook %s: %v", event.Event, err)
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	go func() {
+		var lastErr error
+		for attempt := 0; attempt < 2; attempt++ {
+			if lastErr = postWebhook(hook.URL, body, signature); lastErr == nil {
+				return
+			}
+		}
+		log.Printf("Webhook %s for %s failed: %v", event.Event, event.Username, lastErr)
+	}()
+}
+
+func postWebhook(url string, body []byte, signature string) error {
+	ctx, cancel := context.WithTimeout(appCtx, WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-ZiVPN-Signature", signature)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func webhookWants(hook *WebhookConfig, event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// ==========================================
+// Referrals & Deep Links
+// ==========================================
+
+// startPayloadPattern is the character set Telegram allows in deep links.
+var startPayloadPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// handleStartPayload routes "/start <payload>" deep links such as
+// ?start=create, ?start=claim_<password> and ?start=ref_<code>. Unknown
+// payloads fall back to the normal menu.
+func handleStartPayload(bot Sender, msg *tgbotapi.Message, payload string, config *BotConfig) {
+	chatID := msg.Chat.ID
+	userID := msg.From.ID
+
+	if !startPayloadPattern.MatchString(payload) {
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	switch {
+	case payload == "create":
+		startCreateUser(bot, chatID, userID, config)
+	case strings.HasPrefix(payload, "claim_"):
+		claimAccount(bot, chatID, userID, strings.TrimPrefix(payload, "claim_"), config)
+	case strings.HasPrefix(payload, "ref_"):
+		registerReferral(bot, chatID, userID, strings.TrimPrefix(payload, "ref_"), config)
+		showMainMenu(bot, chatID, config)
+	default:
+		showMainMenu(bot, chatID, config)
+	}
+}
+
+// claimAccount binds an existing account to the Telegram user who knows
+// its password, so direct messages and reminders reach them.
+func claimAccount(bot Sender, chatID int64, userID int64, username string, config *BotConfig) {
+	user, found, err := fetchUser(serverCtx(chatID), username, config)
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+	if !found {
+		replyError(bot, chatID, "Akun tidak ditemukan.")
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	username = user.Password
+	if owner, bound := bindingOwner(username); bound && owner != userID {
+		replyError(bot, chatID, "Akun sudah terhubung ke pengguna lain.")
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	bindAccount(username, userID, serverName(serverCtx(chatID)))
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Akun %s terhubung ke Telegram Anda.", username))
+	deleteLastMessage(bot, chatID)
+	bot.Send(msg)
+	showMainMenu(bot, chatID, config)
+}
+
+// showTerms asks the user to accept the configured terms before the menu
+// is shown.
+func showTerms(bot Sender, chatID int64, config *BotConfig) {
+	msg := tgbotapi.NewMessage(chatID, "📜 Syarat & Ketentuan\n\n"+applyPlaceholders(config.TermsText, config))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Setuju", "accept_terms"),
+		),
+	)
+	deleteLastMessage(bot, chatID)
+	sendAndTrack(bot, msg)
+}
+
+// referralCode is a short, stable code derived from the Telegram user ID.
+func referralCode(userID int64) string {
+	return strconv.FormatInt(userID, 36)
+}
+
+// registerReferral remembers who referred a new user. Self-referrals,
+// users that already own accounts and users already referred are ignored.
+func registerReferral(bot Sender, chatID int64, userID int64, code string, config *BotConfig) {
+	if config.ReferralBonusDays <= 0 {
+		return
+	}
+	referrerID, err := strconv.ParseInt(code, 36, 64)
+	if err != nil || referrerID <= 0 {
+		return
+	}
+	if referrerID == userID {
+		bot.Send(tgbotapi.NewMessage(chatID, "❌ Tidak bisa memakai kode referral sendiri."))
+		return
+	}
+	if _, exists := referrals[userID]; exists {
+		return
+	}
+	for _, creator := range attributions {
+		if creator == userID {
+			return
+		}
+	}
+
+	referrals[userID] = Referral{ReferrerID: referrerID, CreatedAt: time.Now()}
+	if err := writeJSONAtomic(ReferralsFile, referrals); err != nil {
+		log.Printf("Failed to save referrals: %v", err)
+	}
+}
+
+// rewardReferral adds the bonus days to an account of the user's referrer
+// the first time the referred user creates an account.
+func rewardReferral(bot Sender, userID int64, config *BotConfig) {
+	ref, ok := referrals[userID]
+	if !ok || ref.Rewarded || config.ReferralBonusDays <= 0 {
+		return
+	}
+
+	// The bonus goes to the referrer's account that expires soonest
+	// (expiry dates are YYYY-MM-DD, so they compare as strings). Accounts
+	// may live on a remote server.
+	target, oldExpiry := "", ""
+	for _, username := range accountsOf(ref.ReferrerID) {
+		user, found, err := getUser(withServer(appCtx, bindingServer(username)), username)
+		if err != nil || !found {
+			continue
+		}
+		if target == "" || user.Expired < oldExpiry {
+			target, oldExpiry = username, user.Expired
+		}
+	}
+	if target == "" {
+		// Referrer has no account yet; reward on a later create
+		return
+	}
+
+	ctx := withServer(appCtx, bindingServer(target))
+	res, err := apiCall(ctx, "POST", "/user/renew", map[string]interface{}{
+		"password": target,
+		"days":     config.ReferralBonusDays,
+	})
+	invalidateUsersCache()
+	if err != nil || res["success"] != true {
+		log.Printf("Referral bonus for %s failed: %v %v", target, err, res["message"])
+		return
+	}
+	data, _ := res["data"].(map[string]interface{})
+	recordRenewal(config, target, oldExpiry, fmt.Sprint(data["expired"]), config.ReferralBonusDays, 0)
+
+	ref.Rewarded = true
+	referrals[userID] = ref
+	if err := writeJSONAtomic(ReferralsFile, referrals); err != nil {
+		log.Printf("Failed to save referrals: %v", err)
+	}
+
+	text := fmt.Sprintf("🎁 Selamat! Akun %s mendapat bonus %d hari dari referral.", target, config.ReferralBonusDays)
+	bot.Send(tgbotapi.NewMessage(chatForUser(ref.ReferrerID), text))
+}
+
+func showReferralInfo(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	rewarded := 0
+	for _, ref := range referrals {
+		if ref.ReferrerID == userID && ref.Rewarded {
+			rewarded++
+		}
+	}
+
+	text := fmt.Sprintf("🎁 Referral\n\nBagikan link ini. Setiap teman yang membuat akun memberi bonus %d hari untuk akun Anda:\n\nhttps://t.me/%s?start=ref_%s\n\nReferral berhasil: %d",
+		config.ReferralBonusDays, botUsername, referralCode(userID), rewarded)
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Kembali", "cancel")),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// ==========================================
+// Account Notes
+// ==========================================
+
+// setNote replaces the note of the given visibility; empty text removes it.
+func setNote(username string, text string, public bool) {
+	putNote(username, Note{Text: text, Public: public})
+}
+
+// setContact stores the customer contact captured on create (admin only).
+func setContact(username string, contact string) {
+	putNote(username, Note{Text: contact, Kind: "contact"})
+}
+
+// accountContact returns the stored customer contact, or "".
+func accountContact(username string) string {
+	for _, note := range notes[username] {
+		if note.Kind == "contact" {
+			return note.Text
+		}
+	}
+	return ""
+}
+
+// putNote replaces the note with the same visibility and kind as note.
+func putNote(username string, note Note) {
+	var kept []Note
+	for _, existing := range notes[username] {
+		if existing.Public != note.Public || existing.Kind != note.Kind {
+			kept = append(kept, existing)
+		}
+	}
+	if note.Text != "" {
+		note.UpdatedAt = time.Now()
+		kept = append(kept, note)
+	}
+	if len(kept) == 0 {
+		delete(notes, username)
+	} else {
+		notes[username] = kept
+	}
+	saveNotes()
+}
+
+// publicNote returns the note the account's owner may see, or "".
+func publicNote(username string) string {
+	for _, note := range notes[username] {
+		if note.Public && note.Kind == "" {
+			return note.Text
+		}
+	}
+	return ""
+}
+
+func removeNotes(username string) {
+	if _, ok := notes[username]; !ok {
+		return
+	}
+	delete(notes, username)
+	saveNotes()
+}
+
+func saveNotes() {
+	if err := writeJSONAtomic(NotesFile, notes); err != nil {
+		log.Printf("Failed to save notes: %v", err)
+	}
+}
+
+func startAccountComment(bot Sender, chatID int64, userID int64, username string, config *BotConfig) {
+	user, found := requireUser(bot, chatID, username, "comment", config)
+	if !found {
+		return
+	}
+	tempUserData[userID] = map[string]string{"username": user.Password}
+	setState(userID, "account_comment")
+	current := publicNote(user.Password)
+	if current == "" {
+		current = "-"
+	}
+	sendMessage(bot, chatID, fmt.Sprintf("💬 Pesan untuk %s (terlihat oleh user di /myaccount)\nSaat ini: %s\n\nKirim pesan baru, atau - untuk menghapus:", user.Password, current))
+}
+
+// showMyAccounts implements /myaccount: the accounts bound to userID with
+// their expiry and the admin's message.
+func showMyAccounts(bot Sender, chatID int64, userID int64) {
+	accounts := accountsOf(userID)
+	if len(accounts) == 0 {
+		sendMessage(bot, chatID, "👤 Belum ada akun yang terhubung dengan Telegram Anda.")
+		return
+	}
+
+	var lines []string
+	for _, name := range accounts {
+		line := "👤 " + name
+		user, found, err := getUser(withServer(appCtx, bindingServer(name)), name)
+		switch {
+		case err != nil:
+			line += "\n📅 Expired : (gagal memuat)"
+		case !found:
+			line += "\n📅 Expired : (akun tidak ditemukan)"
+		default:
+			line += fmt.Sprintf("\n📅 Expired : %s (%s)", user.Expired, user.Status)
+		}
+		if note := publicNote(name); note != "" {
+			line += "\n💬 " + note
+		}
+		lines = append(lines, line)
+	}
+	sendMessage(bot, chatID, "📱 Akun Saya\n\n"+strings.Join(lines, "\n\n"))
+}
+
+// ==========================================
+// Auto-Renew
+// ==========================================
+
+func isAutoRenew(username string) bool {
+	autoRenewMutex.Lock()
+	defer autoRenewMutex.Unlock()
+	return autoRenew[username]
+}
+
+func setAutoRenew(username string, enabled bool) {
+	autoRenewMutex.Lock()
+	defer autoRenewMutex.Unlock()
+
+	if autoRenew[username] == enabled {
+		return
+	}
+	if enabled {
+		autoRenew[username] = true
+	} else {
+		delete(autoRenew, username)
+	}
+	if err := writeJSONAtomic(AutoRenewFile, autoRenew); err != nil {
+		log.Printf("Failed to save auto-renew flags: %v", err)
+	}
+}
+
+func toggleAutoRenew(bot Sender, chatID int64, username string, config *BotConfig) {
+	user, found := requireUser(bot, chatID, username, "autorenew", config)
+	if !found {
+		return
+	}
+	enabled := !isAutoRenew(user.Password)
+	setAutoRenew(user.Password, enabled)
+
+	state := "OFF"
+	if enabled {
+		state = fmt.Sprintf("ON (+%d hari, %d hari sebelum expired)", autoRenewDays(config), autoRenewBeforeDays(config))
+	}
+	deleteLastMessage(bot, chatID)
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("♻️ Auto-renew %s: %s", user.Password, state)))
+	showMainMenu(bot, chatID, config)
+}
+
+func autoRenewDays(config *BotConfig) int {
+	if config.AutoRenewDays > 0 {
+		return config.AutoRenewDays
+	}
+	return defaultDays(config)
+}
+
+func autoRenewBeforeDays(config *BotConfig) int {
+	if config.AutoRenewBeforeDays > 0 {
+		return config.AutoRenewBeforeDays
+	}
+	return 1
+}
+
+// startAutoRenewScheduler hourly renews flagged accounts that expire
+// within auto_renew_before_days.
+func startAutoRenewScheduler(bot Sender, config *BotConfig) {
+	ticker := time.NewTicker(1 * time.Hour)
+	for range ticker.C {
+		runAutoRenew(bot, config)
+	}
+}
+
+func runAutoRenew(bot Sender, config *BotConfig) {
+	var results []BatchResult
+	for _, name := range serverNames() {
+		results = append(results, autoRenewServer(bot, withServer(appCtx, name), config)...)
+	}
+
+	if len(results) > 0 {
+		sendReport(bot, config.AdminID, "♻️ Auto-renew", results)
+	}
+}
+
+// autoRenewServer renews the flagged accounts on the server in ctx.
+// Accounts on remote servers are reported as "<server>/<name>".
+func autoRenewServer(bot Sender, ctx context.Context, config *BotConfig) []BatchResult {
+	server := serverName(ctx)
+	users, err := getUsers(ctx)
+	if err != nil {
+		log.Printf("Auto-renew: failed to get users on %s: %v", server, err)
+		return nil
+	}
+
+	now := time.Now().In(botLocation(config))
+	days := autoRenewDays(config)
+	var results []BatchResult
+	for _, u := range users {
+		if !isAutoRenew(u.Password) {
+			continue
+		}
+		left, ok := daysUntilExpiry(u.Expired, now)
+		if !ok || left > autoRenewBeforeDays(config) {
+			continue
+		}
+		item := u.Password
+		if server != LocalServerName {
+			item = server + "/" + u.Password
+		}
+		if config.DryRun {
+			log.Printf("[DRY RUN] Auto-renew %s (+%d days)", item, days)
+			continue
+		}
+
+		res, err := apiCall(ctx, "POST", "/user/renew", map[string]interface{}{
+			"password": u.Password,
+			"days":     days,
+		})
+		invalidateUsersCache()
+		if err != nil || res["success"] != true {
+			log.Printf("Auto-renew %s failed: %v %v", item, err, res["message"])
+			reason := fmt.Sprint(res["message"])
+			if err != nil {
+				reason = apiErrorText(err)
+			}
+			results = append(results, BatchResult{Item: item, Detail: reason})
+			continue
+		}
+
+		data, _ := res["data"].(map[string]interface{})
+		expired := fmt.Sprint(data["expired"])
+		recordRenewal(config, u.Password, u.Expired, expired, days, 0)
+		sendWebhook(config, WebhookEvent{Event: "renew", Username: u.Password, Days: days, Expired: expired})
+		log.Printf("Auto-renewed %s until %s", item, expired)
+
+		text := fmt.Sprintf("♻️ Akun %s diperpanjang otomatis %d hari.\n📅 Expired: %s", u.Password, days, expired)
+		detail := "s/d " + expired
+		if err := sendPrivateMessageToUser(bot, u.Password, text); err != nil {
+			detail += " (owner tidak terhubung)"
+		}
+		results = append(results, BatchResult{Item: item, OK: true, Detail: detail})
+	}
+	return results
+}
+
+// ==========================================
+// Renewal History
+// ==========================================
+
+func renewHistoryMax(config *BotConfig) int {
+	if config.RenewHistoryMax > 0 {
+		return config.RenewHistoryMax
+	}
+	return DefaultRenewHistoryMax
+}
+
+// recordRenewal appends a renewal to the account's history, keeping the
+// newest renew_history_max entries. byUserID is 0 for the bot itself.
+func recordRenewal(config *BotConfig, username, oldExpiry, newExpiry string, days int, byUserID int64) {
+	renewHistoryMutex.Lock()
+	defer renewHistoryMutex.Unlock()
+
+	history := append(renewHistory[username], RenewEvent{
+		OldExpiry: oldExpiry,
+		NewExpiry: newExpiry,
+		Days:      days,
+		At:        time.Now(),
+		ByUserID:  byUserID,
+	})
+	if limit := renewHistoryMax(config); len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	renewHistory[username] = history
+	saveRenewHistory()
+}
+
+// removeRenewHistory drops an account's history. It reports whether there
+// was any.
+func removeRenewHistory(username string) bool {
+	renewHistoryMutex.Lock()
+	defer renewHistoryMutex.Unlock()
+
+	if _, ok := renewHistory[username]; !ok {
+		return false
+	}
+	delete(renewHistory, username)
+	saveRenewHistory()
+	return true
+}
+
+// saveRenewHistory persists renewHistory. Callers must hold
+// renewHistoryMutex.
+func saveRenewHistory() {
+	if err := writeJSONAtomic(RenewHistoryFile, renewHistory); err != nil {
+		log.Printf("Failed to save renew history: %v", err)
+	}
+}
+
+// showRenewHistory lists an account's renewals, newest first.
+func showRenewHistory(bot Sender, chatID int64, username string, config *BotConfig) {
+	user, found := requireUser(bot, chatID, username, "history", config)
+	if !found {
+		return
+	}
+
+	renewHistoryMutex.Lock()
+	history := append([]RenewEvent(nil), renewHistory[user.Password]...)
+	renewHistoryMutex.Unlock()
+
+	text := fmt.Sprintf("📜 *Riwayat Renew* `%s`\nExpired sekarang: %s\n", user.Password, user.Expired)
+	if len(history) == 0 {
+		text += "\nBelum ada renew tercatat."
+	} else {
+		text += "```\n"
+		for i := len(history) - 1; i >= 0; i-- {
+			e := history[i]
+			by := "otomatis"
+			if e.ByUserID != 0 {
+				by = strconv.FormatInt(e.ByUserID, 10)
+			}
+			oldExpiry := e.OldExpiry
+			if oldExpiry == "" {
+				oldExpiry = "?"
+			}
+			text += fmt.Sprintf("%s +%d hari\n  %s -> %s (%s)\n", e.At.In(botLocation(config)).Format("2006-01-02 15:04"), e.Days, oldExpiry, e.NewExpiry, by)
+		}
+		text += "```"
+	}
+
+	reply := tgbotapi.NewMessage(chatID, text)
+	reply.ParseMode = "Markdown"
+	deleteLastMessage(bot, chatID)
+	bot.Send(reply)
+	showMainMenu(bot, chatID, config)
+}
+
+// ==========================================
+// Dashboard
+// ==========================================
+
+// handleDashboard handles "/dashboard [pin|off]". A new dashboard replaces
+// the previous one.
+func handleDashboard(bot Sender, chatID int64, arg string, config *BotConfig) {
+	dashboardMutex.Lock()
+	defer dashboardMutex.Unlock()
+
+	if dashboard.MessageID != 0 {
+		if dashboard.Pinned {
+			bot.Request(tgbotapi.UnpinChatMessageConfig{ChatID: dashboard.ChatID, MessageID: dashboard.MessageID})
+		}
+		bot.Request(tgbotapi.NewDeleteMessage(dashboard.ChatID, dashboard.MessageID))
+		dashboard = Dashboard{}
+	}
+
+	switch arg {
+	case "off":
+		saveDashboard()
+		bot.Send(tgbotapi.NewMessage(chatID, "📊 Dashboard dimatikan."))
+		return
+	case "", "pin":
+	default:
+		replyError(bot, chatID, "Format: /dashboard [pin|off]")
+		return
+	}
+
+	sent, err := bot.Send(tgbotapi.NewMessage(chatID, dashboardText(config)))
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengirim dashboard.")
+		return
+	}
+	dashboard = Dashboard{ChatID: chatID, MessageID: sent.MessageID}
+	if arg == "pin" {
+		pin := tgbotapi.PinChatMessageConfig{ChatID: chatID, MessageID: sent.MessageID, DisableNotification: true}
+		if _, err := bot.Request(pin); err != nil {
+			log.Printf("Failed to pin dashboard: %v", err)
+		} else {
+			dashboard.Pinned = true
+		}
+	}
+	saveDashboard()
+}
+
+// startDashboardUpdater refreshes the dashboard message in place every
+// DashboardInterval. A deleted message turns the dashboard off.
+func startDashboardUpdater(bot Sender, config *BotConfig) {
+	ticker := time.NewTicker(DashboardInterval)
+	for range ticker.C {
+		dashboardMutex.Lock()
+		if dashboard.MessageID != 0 {
+			edit := tgbotapi.NewEditMessageText(dashboard.ChatID, dashboard.MessageID, dashboardText(config))
+			if _, err := bot.Request(edit); err != nil && !strings.Contains(err.Error(), "message is not modified") {
+				log.Printf("Dashboard update failed: %v", err)
+				if strings.Contains(err.Error(), "not found") {
+					dashboard = Dashboard{}
+					saveDashboard()
+				}
+			}
+		}
+		dashboardMutex.Unlock()
+	}
+}
+
+// dashboardText summarizes users per server, chats, mode and API health.
+func dashboardText(config *BotConfig) string {
+	var lines []string
+	total, active, expired := 0, 0, 0
+	for _, name := range serverNames() {
+		users, err := getUsers(withServer(appCtx, name))
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("🔴 %s: %s", name, apiErrorText(err)))
+			continue
+		}
+		serverActive := 0
+		for _, u := range users {
+			switch u.Status {
+			case "Active":
+				serverActive++
+			case "Expired":
+				expired++
+			}
+		}
+		total += len(users)
+		active += serverActive
+		lines = append(lines, fmt.Sprintf("🟢 %s: %d akun (%d aktif)", name, len(users), serverActive))
+	}
+
+	chatsMutex.Lock()
+	chats := len(activeChats)
+	chatsMutex.Unlock()
+
+	modeMutex.RLock()
+	public, maintenance := config.Mode == "public", config.Maintenance
+	modeMutex.RUnlock()
+
+	mode := "Private"
+	if public {
+		mode = "Public"
+	}
+	if maintenance {
+		mode += " (maintenance)"
+	}
+
+	return fmt.Sprintf("📊 Dashboard %s\n\n👥 Total: %d | Aktif: %d | Expired: %d\n💬 Chat aktif: %d\n🔐 Mode: %s\n\nAPI:\n%s\n\n🕒 Update: %s",
+		brandName(config), total, active, expired, chats, mode, strings.Join(lines, "\n"),
+		time.Now().In(botLocation(config)).Format("2006-01-02 15:04"))
+}
+
+// saveDashboard persists the dashboard. Callers must hold dashboardMutex.
+func saveDashboard() {
+	if err := writeJSONAtomic(DashboardFile, dashboard); err != nil {
+		log.Printf("Failed to save dashboard: %v", err)
+	}
+}
+
+// ==========================================
+// Servers
+// ==========================================
+
+// showServerMenu lists the local API and the configured backends with
+// their account counts, plus the fleet total.
+func showServerMenu(bot Sender, chatID int64) {
+	names := serverNames()
+	current := serverName(serverCtx(chatID))
+	var lines []string
+	var rows [][]tgbotapi.InlineKeyboardButton
+	total, totalActive := 0, 0
+	for _, name := range names {
+		line := name + ": "
+		if users, err := getUsers(withServer(appCtx, name)); err != nil {
+			line += "⚠️ " + apiErrorText(err)
+		} else {
+			active := 0
+			for _, u := range users {
+				if u.Status == "Active" {
+					active++
+				}
+			}
+			total += len(users)
+			totalActive += active
+			line += fmt.Sprintf("%d akun (%d aktif)", len(users), active)
+		}
+
+		label := name
+		if name == current {
+			label = "✅ " + name
+			line = "▶️ " + line
+		} else {
+			line = "• " + line
+		}
+		lines = append(lines, line)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(truncateLabel(label), "server_select:"+callbackToken(chatID, name)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🚚 Pindah Akun ke Server Lain", "menu_migrate"),
+	))
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Kembali", "cancel")))
+
+	text := fmt.Sprintf("🖥 Server\n\n%s\n\nTotal: %d akun (%d aktif)\nPilih server yang dikelola:", strings.Join(lines, "\n"), total, totalActive)
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+func selectServer(bot Sender, chatID int64, name string, config *BotConfig) {
+	if _, ok := apiServers[name]; !ok && name != LocalServerName {
+		replyError(bot, chatID, "Server tidak ditemukan.")
+		return
+	}
+	if name == LocalServerName {
+		delete(selectedServers, chatID)
+	} else {
+		selectedServers[chatID] = name
+	}
+	log.Printf("Chat %d now manages server %s", chatID, name)
+	showMainMenu(bot, chatID, config)
+}
+
+// chooseMigrationTarget asks which server an account should move to.
+func chooseMigrationTarget(bot Sender, chatID int64, userID int64, username string, config *BotConfig) {
+	user, found := requireUser(bot, chatID, username, "migrate", config)
+	if !found {
+		return
+	}
+	if isProtected(config, user.Password) {
+		replyError(bot, chatID, fmt.Sprintf("Akun dilindungi: %s tidak bisa dipindah.", user.Password))
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	current := serverName(serverCtx(chatID))
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, name := range serverNames() {
+		if name == current {
+			continue
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(truncateLabel("➡️ "+name), "migrate_to:"+callbackToken(chatID, name)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel")))
+
+	tempUserData[userID] = map[string]string{"migrate_user": user.Password}
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("🚚 Pindahkan %s dari %s ke:", user.Password, current))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+func confirmMigration(bot Sender, chatID int64, userID int64, target string, config *BotConfig) {
+	username := tempUserData[userID]["migrate_user"]
+	if username == "" {
+		replyError(bot, chatID, "Sesi pindah server sudah berakhir.")
+		return
+	}
+	if _, ok := apiServers[target]; !ok && target != LocalServerName {
+		replyError(bot, chatID, "Server tidak ditemukan.")
+		return
+	}
+	tempUserData[userID]["migrate_to"] = target
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("❓ Pindahkan %s dari %s ke %s?\n\nAkun dibuat di server tujuan dengan sisa masa aktifnya, lalu dihapus dari server asal.",
+		username, serverName(serverCtx(chatID)), target))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Ya, Pindahkan", "migrate_confirm"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// migrateUser re-creates the selected account on the target server with
+// its remaining days and then deletes it from the source. If the source
+// delete fails, the copy on the target is removed again.
+func migrateUser(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	username := tempUserData[userID]["migrate_user"]
+	target := tempUserData[userID]["migrate_to"]
+	resetState(userID)
+	if username == "" || target == "" {
+		replyError(bot, chatID, "Sesi pindah server sudah berakhir.")
+		return
+	}
+
+	srcCtx := serverCtx(chatID)
+	dstCtx := withServer(appCtx, target)
+	source := serverName(srcCtx)
+	if source == serverName(dstCtx) {
+		replyError(bot, chatID, "Server asal dan tujuan sama.")
+		return
+	}
+
+	user, found := requireUser(bot, chatID, username, "migrate", config)
+	if !found {
+		return
+	}
+	days, ok := daysUntilExpiry(user.Expired, time.Now().In(botLocation(config)))
+	if !ok || days < 1 {
+		replyError(bot, chatID, fmt.Sprintf("Akun %s sudah expired, tidak dipindah.", user.Password))
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	if config.DryRun {
+		dryRunReply(bot, chatID, fmt.Sprintf("Pindah %s %s → %s (%d hari)", user.Password, source, target, days), config)
+		return
+	}
+
+	payload := map[string]interface{}{"password": user.Password, "days": days}
+	if user.IpLimit > 0 {
+		payload["ip_limit"] = user.IpLimit
+	}
+	res, err := apiCall(dstCtx, "POST", "/user/create", payload)
+	invalidateUsersCache()
+	if err != nil || res["success"] != true {
+		reason := fmt.Sprint(res["message"])
+		if err != nil {
+			reason = apiErrorText(err)
+		}
+		log.Printf("Migrate %s to %s: create failed: %s", user.Password, target, reason)
+		replyError(bot, chatID, fmt.Sprintf("Gagal membuat akun di %s: %s\nAkun di %s tidak diubah.", target, reason, source))
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	data, _ := res["data"].(map[string]interface{})
+
+	if user.Status == "Locked" {
+		if _, err := apiCall(dstCtx, "POST", "/user/lock", map[string]interface{}{"password": user.Password}); err != nil {
+			log.Printf("Migrate %s: lock on %s failed: %v", user.Password, target, err)
+		}
+	}
+
+	res, err = apiCall(srcCtx, "POST", "/user/delete", map[string]interface{}{"password": user.Password})
+	invalidateUsersCache()
+	if err != nil || res["success"] != true {
+		log.Printf("Migrate %s: delete on %s failed, rolling back: %v %v", user.Password, source, err, res["message"])
+		if _, rbErr := apiCall(dstCtx, "POST", "/user/delete", map[string]interface{}{"password": user.Password}); rbErr != nil {
+			log.Printf("Migrate %s: rollback on %s failed: %v", user.Password, target, rbErr)
+			replyError(bot, chatID, fmt.Sprintf("Gagal menghapus %s dari %s dan rollback di %s juga gagal. Akun kini ada di kedua server, periksa manual.", user.Password, source, target))
+		} else {
+			replyError(bot, chatID, fmt.Sprintf("Gagal menghapus %s dari %s, perubahan di %s dibatalkan.", user.Password, source, target))
+		}
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	if owner, bound := bindingOwner(user.Password); bound {
+		bindAccount(user.Password, owner, target)
+	}
+	log.Printf("Migrated %s from %s to %s", user.Password, source, target)
+	deleteLastMessage(bot, chatID)
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ %s dipindah %s → %s\n📅 Expired: %s", user.Password, source, target, fmt.Sprint(data["expired"]))))
+	showMainMenu(bot, chatID, config)
+}
+
+// serverNames lists "local" followed by the remote servers, sorted.
+func serverNames() []string {
+	names := []string{LocalServerName}
+	for name := range apiServers {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// ==========================================
+// Scheduled Activation
+// ==========================================
+
+func startCreateLater(bot Sender, chatID int64, userID int64) {
+	setState(userID, "create_start_date")
+	tempUserData[userID] = make(map[string]string)
+	sendMessage(bot, chatID, "📅 Masukkan tanggal mulai aktif (format 2006-01-02):")
+}
+
+// createLaterUser creates the account with its duration counted from
+// startDate, locks it, and queues it for the activation scheduler. It
+// reports whether the account was created.
+func createLaterUser(bot Sender, chatID int64, userID int64, username string, password string, days int, startDate string, config *BotConfig) bool {
+	offset, ok := daysUntilExpiry(startDate, time.Now().In(botLocation(config)))
+	if !ok || offset < 1 {
+		replyError(bot, chatID, "Tanggal mulai sudah lewat.")
+		showMainMenu(bot, chatID, config)
+		return false
+	}
+	username = normalizeUsername(username, config.LowercaseUsernames)
+	if !createUser(bot, chatID, userID, username, password, days+offset, config) {
+		return false
+	}
+
+	res, err := apiCall(serverCtx(chatID), "POST", "/user/lock", map[string]interface{}{"password": username})
+	invalidateUsersCache()
+	if err != nil || res["success"] != true {
+		log.Printf("Lock %s for scheduled activation failed: %v %v", username, err, res["message"])
+		replyError(bot, chatID, fmt.Sprintf("Akun %s dibuat tapi gagal dikunci, akun sudah aktif sekarang.", username))
+		return true
+	}
+
+	activationsMutex.Lock()
+	activations[username] = PendingActivation{StartDate: startDate, Days: days, CreatedBy: userID, Server: selectedServers[chatID]}
+	if err := writeJSONAtomic(ActivationsFile, activations); err != nil {
+		log.Printf("Failed to save pending activations: %v", err)
+	}
+	activationsMutex.Unlock()
+
+	sendMessage(bot, chatID, fmt.Sprintf("📅 Akun %s dikunci dan aktif otomatis pada %s (%d hari).", username, startDate, days))
+	return true
+}
+
+func removeActivation(username string) {
+	activationsMutex.Lock()
+	defer activationsMutex.Unlock()
+
+	if _, ok := activations[username]; !ok {
+		return
+	}
+	delete(activations, username)
+	if err := writeJSONAtomic(ActivationsFile, activations); err != nil {
+		log.Printf("Failed to save pending activations: %v", err)
+	}
+}
+
+// startActivationScheduler hourly unlocks accounts whose start date has
+// come.
+func startActivationScheduler(bot Sender, config *BotConfig) {
+	runActivations(bot, config)
+	ticker := time.NewTicker(1 * time.Hour)
+	for range ticker.C {
+		runActivations(bot, config)
+	}
+}
+
+func runActivations(bot Sender, config *BotConfig) {
+	now := time.Now().In(botLocation(config))
+
+	activationsMutex.Lock()
+	due := make(map[string]PendingActivation)
+	for username, pending := range activations {
+		if left, ok := daysUntilExpiry(pending.StartDate, now); ok && left <= 0 {
+			due[username] = pending
+		}
+	}
+	activationsMutex.Unlock()
+
+	for username, pending := range due {
+		if config.DryRun {
+			log.Printf("[DRY RUN] Activate %s", username)
+			continue
+		}
+		res, err := apiCall(withServer(appCtx, pending.Server), "POST", "/user/unlock", map[string]interface{}{"password": username})
+		invalidateUsersCache()
+		if err != nil || res["success"] != true {
+			log.Printf("Activation of %s failed: %v %v", username, err, res["message"])
+			continue
+		}
+		removeActivation(username)
+		log.Printf("Activated %s (start %s)", username, pending.StartDate)
+
+		bot.Send(tgbotapi.NewMessage(config.AdminID, fmt.Sprintf("▶️ Akun %s aktif mulai hari ini (%d hari).", username, pending.Days)))
+		sendPrivateMessageToUser(bot, username, fmt.Sprintf("▶️ Akun %s sudah aktif mulai hari ini.", username))
+	}
+}
+
+// ==========================================
+// Expiry Reminders
+// ==========================================
+
+// startReminderScheduler hourly reminds the owners of bound accounts
+// that expire in one of reminder_days.
+func startReminderScheduler(bot Sender, config *BotConfig) {
+	ticker := time.NewTicker(1 * time.Hour)
+	for range ticker.C {
+		if len(config.ReminderDays) > 0 {
+			runReminders(bot, config)
+		}
+	}
+}
+
+func runReminders(bot Sender, config *BotConfig) {
+	users, err := getUsers(appCtx)
+	if err != nil {
+		log.Printf("Reminders: failed to get users: %v", err)
+		return
+	}
+
+	remindOn := make(map[int]bool)
+	for _, days := range config.ReminderDays {
+		remindOn[days] = true
+	}
+
+	now := time.Now().In(botLocation(config))
+	changed := false
+	for _, u := range users {
+		left, ok := daysUntilExpiry(u.Expired, now)
+		if !ok || !remindOn[left] || isAutoRenew(u.Password) {
+			continue
+		}
+		key := fmt.Sprintf("%s:%d", u.Expired, left)
+		remindersMutex.Lock()
+		done := remindersSent[u.Password] == key
+		remindersMutex.Unlock()
+		if done {
+			continue
+		}
+		owner, bound := bindingOwner(u.Password)
+		if !bound || bindingServer(u.Password) != LocalServerName {
+			continue
+		}
+
+		text := fmt.Sprintf("⏰ Akun %s akan expired dalam %d hari (%s).", u.Password, left, u.Expired)
+		if left == 0 {
+			text = fmt.Sprintf("⏰ Akun %s expired hari ini (%s).", u.Password, u.Expired)
+		}
+		days := reminderRenewDays(config, owner)
+		msg := tgbotapi.NewMessage(chatForUser(owner), text)
+		if keyboard, ok := reminderKeyboard(u.Password, days); ok {
+			msg.ReplyMarkup = keyboard
+		}
+		if _, err := bot.Send(msg); err != nil {
+			log.Printf("Reminder for %s failed: %v", u.Password, err)
+		}
+		if config.ReminderCopyOwner && owner != config.AdminID {
+			copyMsg := tgbotapi.NewMessage(config.AdminID, "📋 Salinan pengingat:\n"+text)
+			if keyboard, ok := reminderKeyboard(u.Password, reminderRenewDays(config, config.AdminID)); ok {
+				copyMsg.ReplyMarkup = keyboard
+			}
+			bot.Send(copyMsg)
+		}
+
+		remindersMutex.Lock()
+		remindersSent[u.Password] = key
+		remindersMutex.Unlock()
+		changed = true
+	}
+
+	if changed {
+		remindersMutex.Lock()
+		err := writeJSONAtomic(RemindersFile, remindersSent)
+		remindersMutex.Unlock()
+		if err != nil {
+			log.Printf("Failed to save sent reminders: %v", err)
+		}
+	}
+}
+
+// reminderKeyboard builds the one-tap renew button. The username goes into
+// the callback as is (the token map belongs to the main loop), so very
+// long names get no button.
+func reminderKeyboard(username string, days int) (tgbotapi.InlineKeyboardMarkup, bool) {
+	data := "remind_renew:" + username
+	if len(data) > 64 || strings.ContainsAny(username, ":~") {
+		return tgbotapi.InlineKeyboardMarkup{}, false
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🔄 Perpanjang %d hari", days), data),
+		),
+	), true
+}
+
+func reminderRenewDays(config *BotConfig, userID int64) int {
+	days := defaultDays(config)
+	if limit := maxDurationDays(config, userID); days > limit {
+		days = limit
+	}
+	return days
+}
+
+// renewFromReminder renews an account from a reminder button. Only admins
+// and the account's bound owner may use it. Reminders are for the local
+// server, so an owner managing another server is switched back first.
+func renewFromReminder(bot Sender, chatID int64, userID int64, username string, config *BotConfig) {
+	if owner, _ := bindingOwner(username); !hasAdminView(config, userID) && owner != userID {
+		replyError(bot, chatID, "Anda tidak berhak memperpanjang akun ini.")
+		return
+	}
+	if serverName(serverCtx(chatID)) != LocalServerName {
+		delete(selectedServers, chatID)
+		sendMessage(bot, chatID, "🖥 Server aktif dipindah ke "+LocalServerName+".")
+	}
+	renewUser(bot, chatID, userID, username, reminderRenewDays(config, userID), config)
+}
+
+// ==========================================
+// Broadcast
+// ==========================================
+
+func showBroadcastMenu(bot Sender, chatID int64) {
+	scheduleMutex.Lock()
+	pending := len(scheduledBroadcasts)
+	scheduleMutex.Unlock()
+
+	msg := tgbotapi.NewMessage(chatID, "📢 *Broadcast*\nSilakan pilih menu:")
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✍️ Tulis Broadcast", "broadcast_compose"),
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🗓 Terjadwal (%d)", pending), "broadcast_schedules"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🛠 Jadwal Maintenance", "maintenance_window"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Kembali", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+func startBroadcastCompose(bot Sender, chatID int64, userID int64) {
+	setState(userID, "broadcast_message")
+	tempUserData[userID] = make(map[string]string)
+	sendMessage(bot, chatID, "📢 Kirim pesan broadcast (mendukung Markdown).\nBisa juga kirim foto/dokumen dengan caption:")
+}
+
+func showBroadcastConfirm(bot Sender, chatID int64, userID int64) {
+	content := broadcastFromTemp(userID)
+	target := "semua"
+	if content.Server != "" {
+		target = "server " + content.Server
+	}
+	preview := fmt.Sprintf("📢 Konfirmasi Broadcast\n\nPenerima: %d chat (%s)\n🔕 Opt-out: %d chat\n━━━━━━━━━━━━━━━━━━━━━\n%s", len(broadcastRecipients(chatID, content.Server)), target, broadcastOptOuts(), content.Text)
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Kirim Sekarang", "broadcast_send"),
+			tgbotapi.NewInlineKeyboardButtonData("🕒 Jadwalkan", "broadcast_schedule"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("👁 Test Send", "broadcast_test"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	}
+
+	// Per-server targeting, only with several servers
+	if len(apiServers) > 0 {
+		label := "🌐 Semua"
+		if content.Server == "" {
+			label = "✅ Semua"
+		}
+		targetRow := []tgbotapi.InlineKeyboardButton{tgbotapi.NewInlineKeyboardButtonData(label, "broadcast_target:")}
+		for _, name := range serverNames() {
+			label := fmt.Sprintf("🖥 %s (%d)", name, len(broadcastRecipients(chatID, name)))
+			if content.Server == name {
+				label = "✅ " + label
+			}
+			targetRow = append(targetRow, tgbotapi.NewInlineKeyboardButtonData(truncateLabel(label), "broadcast_target:"+callbackToken(chatID, name)))
+		}
+		rows = append(rows, targetRow)
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+
+	switch content.MediaType {
+	case "photo":
+		photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(content.MediaID))
+		photo.Caption = preview
+		photo.ReplyMarkup = keyboard
+		sendTracked(bot, chatID, photo)
+	case "document":
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileID(content.MediaID))
+		doc.Caption = preview
+		doc.ReplyMarkup = keyboard
+		sendTracked(bot, chatID, doc)
+	default:
+		msg := tgbotapi.NewMessage(chatID, preview)
+		msg.ReplyMarkup = keyboard
+		sendAndTrack(bot, msg)
+	}
+}
+
+// testBroadcast sends the composed broadcast, exactly as recipients would
+// get it, only to the admin and returns to the confirm screen.
+func testBroadcast(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	content := broadcastFromTemp(userID)
+	if content.Text == "" && content.MediaID == "" {
+		replyError(bot, chatID, "Tidak ada pesan broadcast.")
+		return
+	}
+	if _, err := bot.Send(content.message(chatID, config)); err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "❌ Test gagal, periksa format Markdown: "+err.Error()))
+	}
+	showBroadcastConfirm(bot, chatID, userID)
+}
+
+func confirmBroadcast(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	content := broadcastFromTemp(userID)
+	resetState(userID)
+	if content.Text == "" && content.MediaID == "" {
+		replyError(bot, chatID, "Tidak ada pesan broadcast.")
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	startBroadcast(bot, chatID, content, config)
+}
+
+// setBroadcastTarget limits the pending broadcast to one server ("" for
+// all) and refreshes the confirm step.
+func setBroadcastTarget(bot Sender, chatID int64, userID int64, server string) {
+	if tempUserData[userID]["broadcast_text"] == "" && tempUserData[userID]["broadcast_media_id"] == "" {
+		replyError(bot, chatID, "Sesi broadcast sudah berakhir.")
+		return
+	}
+	if _, ok := apiServers[server]; !ok && server != "" && server != LocalServerName {
+		replyError(bot, chatID, "Server tidak ditemukan.")
+		return
+	}
+	tempUserData[userID]["broadcast_server"] = server
+	showBroadcastConfirm(bot, chatID, userID)
+}
+
+func broadcastFromTemp(userID int64) BroadcastContent {
+	data := tempUserData[userID]
+	return BroadcastContent{
+		Text:      data["broadcast_text"],
+		MediaType: data["broadcast_media_type"],
+		MediaID:   data["broadcast_media_id"],
+		Server:    data["broadcast_server"],
+	}
+}
+
+// message builds the Telegram message delivering the broadcast to chatID,
+// with a button to opt out of further broadcasts.
+func (c BroadcastContent) message(chatID int64, config *BotConfig) tgbotapi.Chattable {
+	footer := broadcastFooter(config)
+	optOut := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔕 Berhenti Broadcast", "broadcast_optout"),
+		),
+	)
+	switch c.MediaType {
+	case "photo":
+		photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileID(c.MediaID))
+		photo.Caption = c.Text + footer
+		photo.ParseMode = "Markdown"
+		photo.ReplyMarkup = optOut
+		return photo
+	case "document":
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileID(c.MediaID))
+		doc.Caption = c.Text + footer
+		doc.ParseMode = "Markdown"
+		doc.ReplyMarkup = optOut
+		return doc
+	default:
+		msg := tgbotapi.NewMessage(chatID, c.Text+footer)
+		msg.ParseMode = "Markdown"
+		msg.ReplyMarkup = optOut
+		return msg
+	}
+}
+
+// startBroadcast sends content to every known chat in the background and
+// DMs the admin a report when done.
+func startBroadcast(bot Sender, adminChatID int64, content BroadcastContent, config *BotConfig) {
+	count, ok := launchBroadcast(bot, adminChatID, content, config)
+	if !ok {
+		replyError(bot, adminChatID, "Broadcast lain masih berjalan.")
+		return
+	}
+
+	msg := tgbotapi.NewMessage(adminChatID, fmt.Sprintf("📤 Broadcast sedang mengirim di latar belakang ke %d chat...\nLaporan akan dikirim setelah selesai.", count))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⛔ Stop Broadcast", "broadcast_cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// launchBroadcast starts the delivery worker and returns the number of
+// recipients. Only one broadcast runs at a time; ok is false when another
+// one is still in progress.
+func launchBroadcast(bot Sender, adminChatID int64, content BroadcastContent, config *BotConfig) (count int, ok bool) {
+	broadcastMutex.Lock()
+	if broadcastCancel != nil {
+		broadcastMutex.Unlock()
+		return 0, false
+	}
+	ctx, cancel := context.WithCancel(appCtx)
+	broadcastCancel = cancel
+	broadcastMutex.Unlock()
+
+	recipients := broadcastRecipients(adminChatID, content.Server)
+	go runBroadcast(ctx, backgroundSender(bot), adminChatID, recipients, content, config)
+	return len(recipients), true
+}
+
+func runBroadcast(ctx context.Context, bot Sender, adminChatID int64, recipients []int64, content BroadcastContent, config *BotConfig) {
+	defer func() {
+		broadcastMutex.Lock()
+		broadcastCancel()
+		broadcastCancel = nil
+		broadcastMutex.Unlock()
+	}()
+
+	workers, rate := broadcastLimits(config)
+	limiter := time.NewTicker(time.Second / time.Duration(rate))
+	defer limiter.Stop()
+
+	var mu sync.Mutex
+	var sent, failed int
+	var blocked []int64
+
+	jobs := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				select {
+				case <-ctx.Done():
+					return
+				case <-limiter.C:
+				}
+
+				err := sendBroadcastMessage(ctx, bot, content.message(target, config))
+
+				mu.Lock()
+				if err != nil {
+					failed++
+					if isBlockedError(err) {
+						blocked = append(blocked, target)
+					}
+				} else {
+					sent++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, target := range recipients {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- target:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	forgetChats(blocked)
+
+	title := "✅ Broadcast selesai"
+	if ctx.Err() != nil {
+		title = "⛔ Broadcast dihentikan"
+	}
+	report := fmt.Sprintf("%s\n\n📤 Terkirim : %d\n❌ Gagal    : %d\n🚫 Diblokir : %d\n👥 Total    : %d",
+		title, sent, failed, len(blocked), len(recipients))
+	bot.Send(tgbotapi.NewMessage(adminChatID, report))
+}
+
+// sendBroadcastMessage sends one broadcast message. On a flood-wait the
+// worker sleeps for retry_after (unless the broadcast is stopped) and
+// tries once more, so a 429 slows the pool down instead of dropping chats.
+func sendBroadcastMessage(ctx context.Context, bot Sender, c tgbotapi.Chattable) error {
+	_, err := bot.Send(c)
+	var tgErr *tgbotapi.Error
+	if !errors.As(err, &tgErr) || tgErr.RetryAfter <= 0 {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return err
+	case <-time.After(time.Duration(tgErr.RetryAfter) * time.Second):
+	}
+	_, err = bot.Send(c)
+	return err
+}
+
+func cancelBroadcast(bot Sender, chatID int64) {
+	broadcastMutex.Lock()
+	defer broadcastMutex.Unlock()
+
+	if broadcastCancel == nil {
+		replyError(bot, chatID, "Tidak ada broadcast yang berjalan.")
+		return
+	}
+	broadcastCancel()
+	sendMessage(bot, chatID, "⛔ Menghentikan broadcast...")
+}
+
+func startScheduleBroadcast(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	if _, ok := tempUserData[userID]; !ok {
+		replyError(bot, chatID, "Tidak ada pesan broadcast.")
+		return
+	}
+	setState(userID, "broadcast_schedule_time")
+	sendMessage(bot, chatID, fmt.Sprintf("🕒 Masukkan waktu kirim (format: %s)\nContoh: %s", ScheduleTimeLayout, time.Now().In(botLocation(config)).Add(time.Hour).Format(ScheduleTimeLayout)))
+}
+
+func scheduleBroadcast(bot Sender, chatID int64, at time.Time, content BroadcastContent, config *BotConfig) {
+	if err := queueBroadcast(chatID, at, content); err != nil {
+		replyError(bot, chatID, "Gagal menyimpan jadwal broadcast.")
+		return
+	}
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("🗓 Broadcast dijadwalkan pada %s.", at.Format(ScheduleTimeLayout)))
+	deleteLastMessage(bot, chatID)
+	bot.Send(msg)
+	showMainMenu(bot, chatID, config)
+}
+
+// queueBroadcast adds a broadcast for startBroadcastScheduler to send at at.
+func queueBroadcast(chatID int64, at time.Time, content BroadcastContent) error {
+	item := ScheduledBroadcast{
+		ID:          strconv.FormatInt(time.Now().UnixNano(), 36),
+		At:          at,
+		AdminChatID: chatID,
+		Content:     content,
+	}
+
+	scheduleMutex.Lock()
+	defer scheduleMutex.Unlock()
+	scheduledBroadcasts = append(scheduledBroadcasts, item)
+	return saveScheduledBroadcasts()
+}
+
+func showScheduledBroadcasts(bot Sender, chatID int64) {
+	scheduleMutex.Lock()
+	items := append([]ScheduledBroadcast(nil), scheduledBroadcasts...)
+	scheduleMutex.Unlock()
+
+	if len(items) == 0 && len(maintenanceWindows) == 0 {
+		sendMessage(bot, chatID, "🗓 Tidak ada broadcast terjadwal.")
+		return
+	}
+
+	text := "🗓 Broadcast Terjadwal\n"
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, item := range items {
+		summary := item.Content.Text
+		if len([]rune(summary)) > 40 {
+			summary = string([]rune(summary)[:40]) + "…"
+		}
+		if item.Content.MediaType != "" {
+			summary = "[" + item.Content.MediaType + "] " + summary
+		}
+		text += fmt.Sprintf("\n%d. %s — %s", i+1, item.At.Format(ScheduleTimeLayout), summary)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🗑 Batalkan #%d", i+1), "schedule_cancel:"+item.ID),
+		))
+	}
+	for _, window := range maintenanceWindows {
+		text += fmt.Sprintf("\n🛠 Maintenance %s — %s", window.Start.Format(ScheduleTimeLayout), window.End.Format("15:04"))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗑 Batalkan maintenance "+window.Start.Format("02/01 15:04"), "maintenance_cancel:"+window.ID),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Kembali", "cancel")))
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+func cancelScheduledBroadcast(bot Sender, chatID int64, id string) {
+	scheduleMutex.Lock()
+	found := false
+	for i, item := range scheduledBroadcasts {
+		if item.ID == id {
+			scheduledBroadcasts = append(scheduledBroadcasts[:i], scheduledBroadcasts[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if found {
+		if err := saveScheduledBroadcasts(); err != nil {
+			log.Printf("Failed to save scheduled broadcasts: %v", err)
+		}
+	}
+	scheduleMutex.Unlock()
+
+	if !found {
+		replyError(bot, chatID, "Jadwal sudah tidak ada.")
+	}
+	showScheduledBroadcasts(bot, chatID)
+}
+
+// startBroadcastScheduler dispatches due scheduled broadcasts. A broadcast
+// that is due while another one runs stays queued until the next tick.
+func startBroadcastScheduler(bot Sender, config *BotConfig) {
+	ticker := time.NewTicker(30 * time.Second)
+	for range ticker.C {
+		scheduleMutex.Lock()
+		var pending []ScheduledBroadcast
+		for _, item := range scheduledBroadcasts {
+			if item.At.After(time.Now()) {
+				pending = append(pending, item)
+				continue
+			}
+			count, ok := launchBroadcast(bot, item.AdminChatID, item.Content, config)
+			if !ok {
+				pending = append(pending, item)
+				continue
+			}
+			bot.Send(tgbotapi.NewMessage(item.AdminChatID, fmt.Sprintf("📤 Broadcast terjadwal (%s) mulai dikirim ke %d chat.", item.At.Format(ScheduleTimeLayout), count)))
+		}
+		if len(pending) != len(scheduledBroadcasts) {
+			scheduledBroadcasts = pending
+			if err := saveScheduledBroadcasts(); err != nil {
+				log.Printf("Failed to save scheduled broadcasts: %v", err)
+			}
+		}
+		scheduleMutex.Unlock()
+	}
+}
+
+// ==========================================
+// Maintenance Window
+// ==========================================
+
+func startMaintenanceWindow(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	tempUserData[userID] = make(map[string]string)
+	setState(userID, "maintenance_start")
+	sendMessage(bot, chatID, fmt.Sprintf("🛠 Jadwal Maintenance\n\n🕒 Masukkan waktu mulai (format: %s)\nContoh: %s", ScheduleTimeLayout, time.Now().In(botLocation(config)).Add(3*time.Hour).Format(ScheduleTimeLayout)))
+}
+
+// maintenanceWindowFromTemp reads the window entered in the flow.
+func maintenanceWindowFromTemp(userID int64, config *BotConfig) (MaintenanceWindow, bool) {
+	data := tempUserData[userID]
+	start, err := time.ParseInLocation(ScheduleTimeLayout, data["maintenance_start"], botLocation(config))
+	minutes, err2 := strconv.Atoi(data["maintenance_minutes"])
+	if err != nil || err2 != nil {
+		return MaintenanceWindow{}, false
+	}
+	return MaintenanceWindow{
+		ID:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		Start: start,
+		End:   start.Add(time.Duration(minutes) * time.Minute),
+	}, true
+}
+
+// maintenanceNotice is the announcement broadcast for window.
+func maintenanceNotice(config *BotConfig, window MaintenanceWindow) string {
+	return fmt.Sprintf("🛠 *Pemberitahuan Maintenance*\n\n%s akan menjalani maintenance:\n📅 Mulai   : %s\n⏱ Selesai : %s (%d menit)\n\nSelama maintenance koneksi dan bot mungkin tidak tersedia. Mohon maaf atas ketidaknyamanannya 🙏",
+		brandName(config), window.Start.Format(ScheduleTimeLayout), window.End.Format(ScheduleTimeLayout), int(window.End.Sub(window.Start).Minutes()))
+}
+
+func showMaintenanceWindowConfirm(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	window, ok := maintenanceWindowFromTemp(userID, config)
+	if !ok {
+		replyError(bot, chatID, "Sesi maintenance sudah berakhir.")
+		return
+	}
+	preview := fmt.Sprintf("🛠 Konfirmasi Maintenance\n\nPengumuman dikirim sekarang ke %d chat, pengingat %s sebelum mulai.\n━━━━━━━━━━━━━━━━━━━━━\n%s",
+		len(broadcastRecipients(chatID, "")), MaintenanceReminderLead, maintenanceNotice(config, window))
+	msg := tgbotapi.NewMessage(chatID, preview)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Umumkan + Auto Maintenance", "maintenance_confirm:auto"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📤 Umumkan Saja", "maintenance_confirm:notice"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// confirmMaintenanceWindow queues the announcement and the reminder and,
+// with auto, saves the window so maintenance mode follows it.
+func confirmMaintenanceWindow(bot Sender, chatID int64, userID int64, auto bool, config *BotConfig) {
+	window, ok := maintenanceWindowFromTemp(userID, config)
+	resetState(userID)
+	if !ok {
+		replyError(bot, chatID, "Sesi maintenance sudah berakhir.")
+		return
+	}
+	if !window.Start.After(time.Now()) {
+		replyError(bot, chatID, "Waktu mulai sudah lewat.")
+		showMainMenu(bot, chatID, config)
+		return
+	}
+
+	// Queued rather than sent directly, so a running broadcast only delays it
+	notice := maintenanceNotice(config, window)
+	if err := queueBroadcast(chatID, time.Now(), BroadcastContent{Text: notice}); err != nil {
+		replyError(bot, chatID, "Gagal menyimpan jadwal broadcast.")
+		return
+	}
+	summary := "🛠 Pengumuman maintenance akan dikirim dalam 1 menit."
+	if remindAt := window.Start.Add(-MaintenanceReminderLead); remindAt.After(time.Now()) {
+		reminder := strings.Replace(notice, "🛠 *Pemberitahuan Maintenance*", "⏰ *Pengingat: Maintenance 1 jam lagi*", 1)
+		if err := queueBroadcast(chatID, remindAt, BroadcastContent{Text: reminder}); err != nil {
+			log.Printf("Failed to queue maintenance reminder: %v", err)
+		} else {
+			summary += fmt.Sprintf("\n⏰ Pengingat dijadwalkan %s.", remindAt.Format(ScheduleTimeLayout))
+		}
+	}
+	if auto {
+		maintenanceWindows = append(maintenanceWindows, window)
+		saveMaintenanceWindows()
+		summary += fmt.Sprintf("\n🔧 Mode maintenance otomatis ON %s dan OFF %s.", window.Start.Format(ScheduleTimeLayout), window.End.Format(ScheduleTimeLayout))
+	}
+	audit(userID, "maintenance_window", fmt.Sprintf("%s - %s auto=%t", window.Start.Format(ScheduleTimeLayout), window.End.Format(ScheduleTimeLayout), auto))
+
+	deleteLastMessage(bot, chatID)
+	bot.Send(tgbotapi.NewMessage(chatID, summary))
+	showMainMenu(bot, chatID, config)
+}
+
+// cancelMaintenanceWindow drops a window; one already running ends now.
+func cancelMaintenanceWindow(bot Sender, chatID int64, id string, config *BotConfig) {
+	for i, window := range maintenanceWindows {
+		if window.ID == id {
+			maintenanceWindows = append(maintenanceWindows[:i], maintenanceWindows[i+1:]...)
+			saveMaintenanceWindows()
+			if window.Started {
+				setMaintenanceMode(bot, false, config)
+			}
+			showScheduledBroadcasts(bot, chatID)
+			return
+		}
+	}
+	replyError(bot, chatID, "Jadwal sudah tidak ada.")
+	showScheduledBroadcasts(bot, chatID)
+}
+
+// runMaintenanceWindows switches maintenance mode at the start and end of
+// saved windows. It runs from the main loop.
+func runMaintenanceWindows(bot Sender, config *BotConfig) {
+	now := time.Now()
+	var pending []MaintenanceWindow
+	changed := false
+	for _, window := range maintenanceWindows {
+		if !window.Started && !now.Before(window.Start) {
+			window.Started = true
+			changed = true
+			setMaintenanceMode(bot, true, config)
+		}
+		if !now.Before(window.End) {
+			changed = true
+			setMaintenanceMode(bot, false, config)
+			continue
+		}
+		pending = append(pending, window)
+	}
+	if changed {
+		maintenanceWindows = pending
+		saveMaintenanceWindows()
+	}
+}
+
+// setMaintenanceMode switches maintenance mode for a window and tells the
+// owner.
+func setMaintenanceMode(bot Sender, on bool, config *BotConfig) {
+	if config.Maintenance == on {
+		return
+	}
+	modeMutex.Lock()
+	config.Maintenance = on
+	modeMutex.Unlock()
+	if err := saveConfig(config); err != nil {
+		log.Printf("Failed to save config: %v", err)
+	}
+	text := "🔧 Jadwal maintenance dimulai, mode maintenance ON."
+	if !on {
+		text = "✅ Jadwal maintenance selesai, mode maintenance OFF."
+	}
+	log.Printf("Maintenance window: maintenance=%t", on)
+	bot.Send(tgbotapi.NewMessage(config.AdminID, text))
+}
+
+func saveMaintenanceWindows() {
+	if err := writeJSONAtomic(MaintenanceFile, maintenanceWindows); err != nil {
+		log.Printf("Failed to save maintenance windows: %v", err)
+	}
+}
+
+// saveScheduledBroadcasts persists the queue. Callers must hold scheduleMutex.
+func saveScheduledBroadcasts() error {
+	return writeJSONAtomic(ScheduleFile, scheduledBroadcasts)
+}
+
+func loadScheduledBroadcasts() error {
+	return loadJSONFile(ScheduleFile, &scheduledBroadcasts)
+}
+
+// broadcastRecipients lists the chat of every known session except the
+// sender's own chat and chats that opted out.
+func broadcastRecipients(excludeChatID int64, server string) []int64 {
+	var owners map[int64]bool
+	if server != "" {
+		owners = make(map[int64]bool)
+		bindingsMutex.RLock()
+		for username, owner := range bindings {
+			if serverOfBinding(username) == server {
+				owners[owner] = true
+			}
+		}
+		bindingsMutex.RUnlock()
+	}
+
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+
+	var recipients []int64
+	for userID, session := range activeChats {
+		if session.ChatID == excludeChatID || session.NoBroadcast || (owners != nil && !owners[userID]) {
+			continue
+		}
+		recipients = append(recipients, session.ChatID)
+	}
+	return recipients
+}
+
+func broadcastLimits(config *BotConfig) (workers int, rate int) {
+	workers = config.BroadcastWorkers
+	if workers <= 0 {
+		workers = DefaultBroadcastWorkers
+	}
+	rate = config.BroadcastRate
+	if rate <= 0 {
+		rate = DefaultBroadcastRate
+	}
+	if rate > MaxBroadcastRate {
+		rate = MaxBroadcastRate
+	}
+	return workers, rate
+}
+
+// isBlockedError reports whether Telegram refused delivery because the
+// user blocked the bot or the chat no longer exists.
+func isBlockedError(err error) bool {
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) {
+		return tgErr.Code == http.StatusForbidden
+	}
+	return false
+}
+
+// ==========================================
+// UI & Helpers
+// ==========================================
+
+func showMainMenu(bot Sender, chatID int64, config *BotConfig) {
+	ipInfo, _ := getIpInfo()
+	domain := config.Domain
+	if domain == "" {
+		domain = "(Not Configured)"
+	}
+
+	serverLine := ""
+	if len(apiServers) > 0 && hasAdminView(config, chatID) {
+		serverLine = fmt.Sprintf(" • Server   : %s\n", serverName(serverCtx(chatID)))
+	}
+
+	msgText := fmt.Sprintf("```\n━━━━━━━━━━━━━━━━━━━━━\n    MENU %s\n━━━━━━━━━━━━━━━━━━━━━\n%s • Domain   : %s\n • City     : %s\n • ISP      : %s\n━━━━━━━━━━━━━━━━━━━━━\n```\n%s",
+		brandName(config), serverLine, domain, ipInfo.City, ipInfo.Isp, footerText(config))
+
+	if previewMode[chatID] {
+		msgText = "👁 *MODE PREVIEW* — tampilan sebagai user biasa\n" + msgText
+	}
+	if config.DryRun {
+		msgText = "🧪 *[DRY RUN]* — aksi tidak mengubah data\n" + msgText
+	}
+	if config.Maintenance && chatID == config.AdminID {
+		msgText = "🛠 *MAINTENANCE AKTIF* — user lain diblokir (/maintenance off)\n" + msgText
+	}
+
+	msg := tgbotapi.NewMessage(chatID, msgText)
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = getMainMenuKeyboard(config, chatID)
+	sendAndTrack(bot, msg)
+}
+
+func getMainMenuKeyboard(config *BotConfig, userID int64) tgbotapi.InlineKeyboardMarkup {
+	// Public Menu (Everyone)
+	rows := [][]tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("👤 Create Password", "menu_create"),
+			tgbotapi.NewInlineKeyboardButtonData("🗑️ Delete Password", "menu_delete"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Renew Password", "menu_renew"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("⚡ Quick Create (%d hari)", defaultDays(config)), "menu_quick_create"),
+		),
+	}
+
+	if config.ReferralBonusDays > 0 {
+		rows[2] = append(rows[2], tgbotapi.NewInlineKeyboardButtonData("🎁 Referral", "menu_referral"))
+	}
+
+	if last, ok := lastCreated[userID]; ok && time.Since(last.CreatedAt) < LastCreatedTTL {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(truncateLabel("📨 Kirim Ulang "+last.Password), "resend_last"),
+		))
+	}
+
+	if previewMode[userID] {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Keluar Preview", "preview_exit"),
+		))
+	}
+
+	// Admin Menu (Admin Only)
+	if hasAdminView(config, userID) {
+		modeLabel := "🔐 Mode: Private"
+		if config.Mode == "public" {
+			modeLabel = "🌍 Mode: Public"
+		}
+
+		rows[1] = append(rows[1], tgbotapi.NewInlineKeyboardButtonData("📋 List Passwords", "menu_list"))
+		rows[1] = append(rows[1], tgbotapi.NewInlineKeyboardButtonData("🔌 Koneksi", "menu_connections"))
+		rows[1] = append(rows[1], tgbotapi.NewInlineKeyboardButtonData("📜 Riwayat", "menu_renew_history"))
+		rows[2] = append(rows[2], tgbotapi.NewInlineKeyboardButtonData("📄 Export", "menu_export"))
+		rows[2] = append(rows[2], tgbotapi.NewInlineKeyboardButtonData("♻️ Auto-Renew", "menu_autorenew"))
+		rows[0] = append(rows[0], tgbotapi.NewInlineKeyboardButtonData("📅 Create Terjadwal", "menu_create_later"))
+
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📊 System Info", "menu_info"),
+			tgbotapi.NewInlineKeyboardButtonData("💾 Backup & Restore", "menu_backup_restore"),
+			tgbotapi.NewInlineKeyboardButtonData("💬 Pesan Akun", "menu_comment"),
+		))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📢 Broadcast", "menu_broadcast"),
+			tgbotapi.NewInlineKeyboardButtonData("✉️ Pesan User", "menu_message"),
+			tgbotapi.NewInlineKeyboardButtonData("🧹 Prune Chats", "menu_prune_chats"),
+		))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(modeLabel, "toggle_mode"),
+			tgbotapi.NewInlineKeyboardButtonData("👁 Preview as User", "preview_enter"),
+		))
+		if len(apiServers) > 0 {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(truncateLabel("🖥 Server: "+serverName(serverCtx(userID))), "menu_servers"),
+			))
+		}
+	} else {
+		if can(config, userID, "list") {
+			rows[1] = append(rows[1], tgbotapi.NewInlineKeyboardButtonData("📋 List Passwords", "menu_list"))
+		}
+		if can(config, userID, "export") {
+			rows[2] = append(rows[2], tgbotapi.NewInlineKeyboardButtonData("📄 Export", "menu_export"))
+		}
+		if can(config, userID, "broadcast") {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("📢 Broadcast", "menu_broadcast"),
+				tgbotapi.NewInlineKeyboardButtonData("✉️ Pesan User", "menu_message"),
+			))
+		}
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(permittedRows(config, userID, rows)...)
+}
+
+// textMenuSender renders the inline keyboards of messages to /menu chats
+// as numbered lines, for clients that don't show the buttons. Other
+// chats and message kinds pass through unchanged.
+type textMenuSender struct {
+	Sender
+}
+
+func (s textMenuSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if msg, ok := c.(tgbotapi.MessageConfig); ok && textMenuChats[msg.ChatID] {
+		if keyboard, ok := msg.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); ok {
+			msg.Text += renderTextMenu(msg.ChatID, msg.ParseMode, keyboard)
+			msg.ReplyMarkup = nil
+			c = msg
+		}
+	}
+	return s.Sender.Send(c)
+}
+
+func (s textMenuSender) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	if edit, ok := c.(tgbotapi.EditMessageTextConfig); ok && textMenuChats[edit.ChatID] && edit.ReplyMarkup != nil {
+		edit.Text += renderTextMenu(edit.ChatID, edit.ParseMode, *edit.ReplyMarkup)
+		edit.ReplyMarkup = nil
+		c = edit
+	}
+	return s.Sender.Request(c)
+}
+
+// backgroundSender strips textMenuSender from bot before it is handed to
+// a goroutine: the wrapper uses the text menu maps of the main loop.
+func backgroundSender(bot Sender) Sender {
+	if s, ok := bot.(textMenuSender); ok {
+		return s.Sender
+	}
+	return bot
+}
+
+// renderTextMenu numbers the buttons of keyboard, remembers them as the
+// chat's choices and returns the lines to append to the message.
+func renderTextMenu(chatID int64, parseMode string, keyboard tgbotapi.InlineKeyboardMarkup) string {
+	choices := make(map[string]string)
+	var b strings.Builder
+	b.WriteString("\n")
+	for _, row := range keyboard.InlineKeyboard {
+		for _, button := range row {
+			label := button.Text
+			if parseMode != "" {
+				label = tgbotapi.EscapeText(parseMode, label)
+			}
+			switch {
+			case button.CallbackData != nil:
+				number := strconv.Itoa(len(choices) + 1)
+				choices[number] = *button.CallbackData
+				fmt.Fprintf(&b, "\n%s. %s", number, label)
+			case button.URL != nil:
+				fmt.Fprintf(&b, "\n🔗 %s: %s", label, *button.URL)
+			}
+		}
+	}
+	textMenuChoices[chatID] = choices
+	b.WriteString("\n\nBalas dengan nomor, atau 0 untuk keluar dari menu teks.")
+	return b.String()
+}
+
+// handleTextMenuReply runs the choice behind a number typed in a /menu
+// chat. Numbers typed while a flow waits for input (e.g. a duration) are
+// left to the flow; it reports whether msg was handled.
+func handleTextMenuReply(bot Sender, msg *tgbotapi.Message, config *BotConfig) bool {
+	chatID := msg.Chat.ID
+	text := strings.TrimSpace(msg.Text)
+	if !textMenuChats[chatID] || msg.IsCommand() || !isDigits(text) {
+		return false
+	}
+	if state, exists := userStates[msg.From.ID]; exists && awaitsTextInput(state) {
+		return false
+	}
+
+	if text == "0" {
+		delete(textMenuChats, chatID)
+		delete(textMenuChoices, chatID)
+		resetState(msg.From.ID)
+		sendMessage(bot, chatID, "Keluar dari menu teks. Ketik /menu untuk membuka lagi.")
+		return true
+	}
+	data, ok := textMenuChoices[chatID][text]
+	if !ok {
+		sendMessage(bot, chatID, "❌ Nomor tidak ada di menu. Coba lagi, atau 0 untuk keluar:")
+		return true
+	}
+	runTextMenuChoice(bot, msg, data, config)
+	return true
+}
+
+// awaitsTextInput reports whether handleState takes typed input in state.
+// The others wait for a button (or a file) only.
+func awaitsTextInput(state string) bool {
+	switch state {
+	case "renew_confirm", "waiting_restore_file", "waiting_import_file":
+		return false
+	}
+	return true
+}
+
+func isDigits(text string) bool {
+	if text == "" {
+		return false
+	}
+	for _, r := range text {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// runTextMenuChoice runs the callback route behind a /menu choice with
+// the same token, preview and permission checks as handleCallback.
+func runTextMenuChoice(bot Sender, msg *tgbotapi.Message, data string, config *BotConfig) {
+	chatID := msg.Chat.ID
+	userID := msg.From.ID
+	data, ok := resolveCallbackTokens(chatID, data)
+	if !ok {
+		replyError(bot, chatID, "Pilihan kadaluarsa, buka menu lagi")
+		resetState(userID)
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	route, arg, found := findCallbackRoute(data)
+	if !found {
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	if route.Mutating && previewMode[userID] {
+		replyError(bot, chatID, "🔒 Mode preview: aksi dinonaktifkan")
+		return
+	}
+	if action := route.action(); action != "" && !can(config, userID, action) {
+		denyAction(userID, action, data)
+		replyError(bot, chatID, "Akses Ditolak")
+		return
+	}
+	query := &tgbotapi.CallbackQuery{From: msg.From, Message: msg, Data: data}
+	route.Handle(bot, CallbackRequest{Query: query, ChatID: chatID, UserID: userID, Arg: arg}, config)
+}
+
+// permittedRows drops the buttons whose route userID's role may not use,
+// and rows left empty by that.
+func permittedRows(config *BotConfig, userID int64, rows [][]tgbotapi.InlineKeyboardButton) [][]tgbotapi.InlineKeyboardButton {
+	var kept [][]tgbotapi.InlineKeyboardButton
+	for _, row := range rows {
+		var buttons []tgbotapi.InlineKeyboardButton
+		for _, button := range row {
+			if button.CallbackData != nil {
+				if route, _, found := findCallbackRoute(*button.CallbackData); found {
+					if action := route.action(); action != "" && !can(config, userID, action) {
+						continue
+					}
+				}
+			}
+			buttons = append(buttons, button)
+		}
+		if len(buttons) > 0 {
+			kept = append(kept, buttons)
+		}
+	}
+	return kept
+}
+
+// sendAccountInfo shows an account's details, below header when set.
+func sendAccountInfo(bot Sender, chatID int64, data map[string]interface{}, header string, config *BotConfig) {
+	ipInfo, _ := getIpInfo()
+	username, _ := data["username"].(string)
+	msg := "```\n" + accountInfoText(username, fmt.Sprint(data["password"]), fmt.Sprint(data["expired"]), ipInfo, config) + "```"
+	if header != "" {
+		msg = header + "\n" + msg
+	}
+	if config.AccountNote != "" {
+		account := username
+		if account == "" {
+			account = fmt.Sprint(data["password"])
+		}
+		msg += "\n" + accountNote(config, account, fmt.Sprint(data["expired"]))
+	}
+
+	reply := tgbotapi.NewMessage(chatID, msg)
+	reply.ParseMode = "Markdown"
+	if keyboard, ok := clientFormatKeyboard(chatID, fmt.Sprint(data["password"]), config); ok {
+		reply.ReplyMarkup = keyboard
+	}
+	applyPlainText(&reply)
+	if !config.KeepAccountMessages {
+		deleteLastMessage(bot, chatID)
+	}
+	bot.Send(reply)
+	showMainMenu(bot, chatID, config)
+}
+
+// clientFormatLabels are the buttons for each supported client format.
+var clientFormatLabels = map[string]string{
+	"text": "📝 Teks",
+	"uri":  "🔗 Link",
+	"file": "📁 File Config",
+}
+
+// clientFormats returns the formats offered for an account, in the
+// configured order. Unknown names are skipped.
+func clientFormats(config *BotConfig) []string {
+	if config.ClientFormats == nil {
+		return []string{"text", "uri", "file"}
+	}
+	var formats []string
+	for _, format := range config.ClientFormats {
+		if _, ok := clientFormatLabels[format]; ok {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// clientFormatKeyboard returns one button per offered format for the
+// account with password, false when no format is offered.
+func clientFormatKeyboard(chatID int64, password string, config *BotConfig) (tgbotapi.InlineKeyboardMarkup, bool) {
+	formats := clientFormats(config)
+	if len(formats) == 0 {
+		return tgbotapi.InlineKeyboardMarkup{}, false
+	}
+	token := callbackToken(chatID, password)
+	var row []tgbotapi.InlineKeyboardButton
+	for _, format := range formats {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(clientFormatLabels[format], "client_format:"+format+":"+token))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row), true
+}
+
+// clientUri renders the client_uri template for an account.
+func clientUri(config *BotConfig, password, domain, port string) string {
+	template := config.ClientUri
+	if template == "" {
+		template = DefaultClientUri
+	}
+	return strings.NewReplacer(
+		"{password}", url.QueryEscape(password),
+		"{domain}", domain,
+		"{port}", port,
+		"{brand}", url.QueryEscape(brandName(config)),
+	).Replace(template)
+}
+
+// ClientConfig is the downloadable config file for the ZIVPN client.
+type ClientConfig struct {
+	Server   string `json:"server"`
+	Obfs     string `json:"obfs"`
+	AuthStr  string `json:"auth_str"`
+	Insecure bool   `json:"insecure"` // The server uses a self-signed certificate
+}
+
+// sendClientFormat renders an account in one client format; arg is
+// "<format>:<password>".
+func sendClientFormat(bot Sender, chatID int64, arg string, config *BotConfig) {
+	format, password, _ := strings.Cut(arg, ":")
+	user, found, err := fetchUser(serverCtx(chatID), password, config)
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+	if !found {
+		replyError(bot, chatID, fmt.Sprintf("User %s sudah tidak ada.", password))
+		return
+	}
+	domain, port := serverAddress(serverCtx(chatID), config)
+
+	switch format {
+	case "text":
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Domain   : %s\nPort     : %s\nPassword : %s\nExpired  : %s", domain, port, user.Password, user.Expired)))
+	case "uri":
+		bot.Send(tgbotapi.NewMessage(chatID, clientUri(config, user.Password, domain, port)))
+	case "file":
+		data, err := json.MarshalIndent(ClientConfig{
+			Server:   net.JoinHostPort(domain, port),
+			Obfs:     ClientObfs,
+			AuthStr:  user.Password,
+			Insecure: true,
+		}, "", "  ")
+		if err != nil {
+			replyError(bot, chatID, "Gagal membuat file.")
+			return
+		}
+		file := tgbotapi.FileBytes{Name: user.Password + ".json", Bytes: data}
+		if err := sendDocumentWithRetry(bot, chatID, file, "📁 Config "+user.Password); err != nil {
+			replyError(bot, chatID, "Gagal mengirim file: "+err.Error())
+		}
+	default:
+		replyError(bot, chatID, "Format tidak dikenal.")
+	}
+}
+
+// resendLastCreated re-sends the credentials of the account userID created
+// last, as long as it is recent.
+func resendLastCreated(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	last, ok := lastCreated[userID]
+	if !ok || time.Since(last.CreatedAt) >= LastCreatedTTL {
+		delete(lastCreated, userID)
+		replyError(bot, chatID, "Tidak ada akun baru untuk dikirim ulang.")
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	sendAccountInfo(bot, chatID, map[string]interface{}{"password": last.Password, "expired": last.Expired}, "", config)
+}
+
+// accountInfoText renders the credentials block shared by the account
+// info message and the exported credentials file. username is shown only
+// when it differs from the password (separate_password mode).
+func accountInfoText(username string, password string, expired string, ipInfo IpInfo, config *BotConfig) string {
+	domain := config.Domain
+	if domain == "" {
+		domain = "(Not Configured)"
+	}
+
+	userLine := ""
+	if username != "" && username != password {
+		userLine = "Username   : " + username + "\n"
+	}
+
+	return fmt.Sprintf("━━━━━━━━━━━━━━━━━━━━━\n  ACCOUNT %s\n━━━━━━━━━━━━━━━━━━━━━\n%sPassword   : %s\nCITY       : %s\nISP        : %s\nIP ISP     : %s\nDomain     : %s\nExpired On : %s\n━━━━━━━━━━━━━━━━━━━━━\n",
+		brandName(config),
+		userLine,
+		password,
+		ipInfo.City,
+		ipInfo.Isp,
+		ipInfo.Query,
+		domain,
+		expired,
+	)
+}
+
+func showUserSelection(bot Sender, chatID int64, page int, action string) {
+	users, err := getUsers(serverCtx(chatID))
+	if err != nil {
+		replyError(bot, chatID, "Gagal mengambil data user.")
+		return
+	}
+
+	if len(users) == 0 {
+		sendMessage(bot, chatID, "📂 Tidak ada user.")
+		return
+	}
+
+	page, totalPages, start, end := paginate(len(users), page, 10)
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, u := range users[start:end] {
+		label := fmt.Sprintf("%s %s (%s)", statusIcon(u.Status), u.Password, u.Status)
+		if isAutoRenew(u.Password) {
+			label += " ♻️"
+		}
+		data := fmt.Sprintf("select_%s:%s", action, callbackToken(chatID, u.Password))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(truncateLabel(label), data),
+		))
+	}
+
+	var navRow []tgbotapi.InlineKeyboardButton
+	if page > 1 {
+		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("⬅️ Prev", fmt.Sprintf("page_%s:%d", action, page-1)))
+	}
+	if page < totalPages {
+		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("Next ➡️", fmt.Sprintf("page_%s:%d", action, page+1)))
+	}
+	if len(navRow) > 0 {
+		rows = append(rows, navRow)
+	}
+
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel")))
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("📋 Pilih User untuk %s (Halaman %d/%d):", strings.Title(action), page, totalPages))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	sendAndTrack(bot, msg)
+}
+
+func statusIcon(status string) string {
+	if status == "Expired" {
+		return "🔴"
+	}
+	return "🟢"
+}
+
+func userMatchesFilter(u UserData, filter string) bool {
+	switch filter {
+	case "active":
+		return u.Status == "Active"
+	case "expired":
+		return u.Status == "Expired"
+	default:
+		return true
+	}
+}
+
+// paginate clamps page to [1, totalPages] and returns the slice bounds of
+// that page. totalPages is at least 1.
+func paginate(total int, page int, perPage int) (int, int, int, int) {
+	totalPages := (total + perPage - 1) / perPage
+	if totalPages < 1 {
+		totalPages = 1
+	}
+	if page < 1 {
+		page = 1
+	}
+	if page > totalPages {
+		page = totalPages
+	}
+
+	start := (page - 1) * perPage
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	return page, totalPages, start, end
+}
+
+func sendMessage(bot Sender, chatID int64, text string) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	if _, inState := userStates[chatID]; inState {
+		cancelKb := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel")),
+		)
+		msg.ReplyMarkup = cancelKb
+	}
+	sendAndTrack(bot, msg)
+}
+
+func answerCallback(bot Sender, queryID string, text string) {
+	bot.Request(tgbotapi.NewCallback(queryID, text))
+}
+
+func replyError(bot Sender, chatID int64, text string) {
+	sendMessage(bot, chatID, "❌ "+text)
+}
+
+// replyAPIError explains a failed API call according to its class.
+func replyAPIError(bot Sender, chatID int64, err error) {
+	log.Printf("API error: %v", err)
+	replyError(bot, chatID, apiErrorText(err))
+}
+
+// replyAPIErrorWithRetry reports a failed action. Outages get a
+// "Coba Lagi" button that runs retry again, so flows don't have to be
+// re-entered; other errors return to the main menu as before.
+func replyAPIErrorWithRetry(bot Sender, chatID int64, err error, retry func(), config *BotConfig) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Class == APIUserError {
+		replyAPIError(bot, chatID, err)
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	log.Printf("API error: %v", err)
+	retryActions[chatID] = RetryAction{Run: retry, At: time.Now()}
+
+	msg := tgbotapi.NewMessage(chatID, "❌ "+apiErrorText(err))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔁 Coba Lagi", "retry_last"),
+			tgbotapi.NewInlineKeyboardButtonData("🏠 Menu", "cancel"),
+		),
+	)
+	sendAndTrack(bot, msg)
+}
+
+// runRetry re-runs the failed action stored for chatID.
+func runRetry(bot Sender, chatID int64, config *BotConfig) {
+	action, ok := retryActions[chatID]
+	delete(retryActions, chatID)
+	if !ok || time.Since(action.At) > RetryActionTTL {
+		replyError(bot, chatID, "Aksi sudah kedaluwarsa, silakan ulangi dari menu.")
+		showMainMenu(bot, chatID, config)
+		return
+	}
+	action.Run()
+}
+
+func apiErrorText(err error) string {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return "Error API: " + err.Error()
+	}
+	text := apiErrorMessage(apiErr)
+	if apiErr.RequestID != "" {
+		text += " (ID: " + apiErr.RequestID + ")"
+	}
+	return text
+}
+
+func apiErrorMessage(apiErr *APIError) string {
+	switch apiErr.Class {
+	case APIDown:
+		return "API tidak berjalan. Cek service: systemctl status zivpn-api"
+	case APIOutage:
+		return "Server sedang bermasalah, coba lagi."
+	}
+	if apiErr.Status == http.StatusUnauthorized {
+		return "API key ditolak. Cek /etc/zivpn/apikey."
+	}
+	if apiErr.Message != "" {
+		return apiErr.Message
+	}
+	return fmt.Sprintf("Permintaan ditolak (HTTP %d).", apiErr.Status)
+}
+
+func sendAndTrack(bot Sender, msg tgbotapi.MessageConfig) {
+	applyPlainText(&msg)
+	if editTracked(bot, msg) {
+		return
+	}
+	sendTracked(bot, msg.ChatID, msg)
+}
+
+// editTracked turns the message of the current callback into msg. It
+// reports false when there is nothing to edit or Telegram refuses, so the
+// caller sends a new message instead.
+func editTracked(bot Sender, msg tgbotapi.MessageConfig) bool {
+	msgID, ok := editableMessages[msg.ChatID]
+	if !ok {
+		return false
+	}
+	delete(editableMessages, msg.ChatID)
+
+	edit := tgbotapi.NewEditMessageText(msg.ChatID, msgID, msg.Text)
+	edit.ParseMode = msg.ParseMode
+	switch markup := msg.ReplyMarkup.(type) {
+	case nil:
+	case tgbotapi.InlineKeyboardMarkup:
+		edit.ReplyMarkup = &markup
+	default:
+		// Reply keyboards can't be attached by editing
+		return false
+	}
+
+	if _, err := bot.Request(edit); err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("Edit message failed, sending instead: %v", err)
+		return false
+	}
+	if lastID, ok := lastMessageIDs[msg.ChatID]; ok && lastID != msgID {
+		bot.Request(tgbotapi.NewDeleteMessage(msg.ChatID, lastID))
+	}
+	lastMessageIDs[msg.ChatID] = msgID
+	return true
+}
+
+// sendTracked replaces the last tracked message in chatID with c, which may
+// be any kind of message (text, photo, document).
+func sendTracked(bot Sender, chatID int64, c tgbotapi.Chattable) {
+	deleteLastMessage(bot, chatID)
+	sentMsg, err := bot.Send(c)
+	if err == nil {
+		lastMessageIDs[chatID] = sentMsg.MessageID
+	}
+}
+
+func deleteLastMessage(bot Sender, chatID int64) {
+	if msgID, ok := lastMessageIDs[chatID]; ok {
+		deleteMsg := tgbotapi.NewDeleteMessage(chatID, msgID)
+		bot.Request(deleteMsg)
+		delete(lastMessageIDs, chatID)
+		if editableMessages[chatID] == msgID {
+			delete(editableMessages, chatID)
+		}
+	}
+}
+
+// consumeCallback marks a one-shot callback as processed. It returns false
+// when the same button on the same message was already handled.
+func consumeCallback(userID int64, query *tgbotapi.CallbackQuery) bool {
+	key := fmt.Sprintf("%d:%s", query.Message.MessageID, query.Data)
+	if consumedCallbacks[userID] == key {
+		return false
+	}
+	consumedCallbacks[userID] = key
+	return true
+}
+
+// dryRunReply reports an action that dry_run mode skipped.
+func dryRunReply(bot Sender, chatID int64, action string, config *BotConfig) {
+	log.Printf("[DRY RUN] %s", action)
+	deleteLastMessage(bot, chatID)
+	bot.Send(tgbotapi.NewMessage(chatID, "🧪 [DRY RUN] "+action+"\nTidak ada perubahan yang dilakukan."))
+	showMainMenu(bot, chatID, config)
+}
+
+func resetState(userID int64) {
+	if path := tempUserData[userID]["restore_path"]; path != "" {
+		os.Remove(path)
+	}
+	delete(userStates, userID)
+	delete(stateUpdatedAt, userID)
+	delete(tempUserData, userID)
+}
+
+// setState puts userID into an input state and starts its idle timer.
+func setState(userID int64, state string) {
+	userStates[userID] = state
+	stateUpdatedAt[userID] = time.Now()
+}
+
+// expireStates cancels input states idle for longer than the state
+// timeout, so a later unrelated message isn't taken as flow input.
+func expireStates(bot Sender, config *BotConfig) {
+	timeout := stateTimeout(config)
+	for userID, at := range stateUpdatedAt {
+		if time.Since(at) < timeout {
 			continue
 		}
+		resetState(userID)
+		chatID := chatForUser(userID)
+		deleteLastMessage(bot, chatID)
+		bot.Send(tgbotapi.NewMessage(chatID, "⌛ Sesi dibatalkan karena tidak aktif."))
+		showMainMenu(bot, chatID, config)
+	}
+}
+
+func stateTimeout(config *BotConfig) time.Duration {
+	if config.StateTimeoutMinutes > 0 {
+		return time.Duration(config.StateTimeoutMinutes) * time.Minute
+	}
+	return DefaultStateTimeout
+}
+
+func callbackDebounce(config *BotConfig) time.Duration {
+	if config.CallbackDebounceMs < 0 {
+		return 0
+	}
+	if config.CallbackDebounceMs > 0 {
+		return time.Duration(config.CallbackDebounceMs) * time.Millisecond
+	}
+	return DefaultCallbackDebounce
+}
+
+// BatchResult is the outcome of one item of a batch action.
+type BatchResult struct {
+	Item   string
+	OK     bool
+	Detail string
+}
+
+// InlineReportLimit is the largest batch reported inline; bigger reports
+// are attached as a .txt file.
+const InlineReportLimit = 20
+
+// buildReport summarizes a batch action. For more than InlineReportLimit
+// items the per-item lines go into a .txt document and text holds only
+// the summary.
+func buildReport(title string, results []BatchResult) (text string, doc *tgbotapi.FileBytes) {
+	ok := 0
+	lines := make([]string, 0, len(results))
+	for _, r := range results {
+		icon := "❌"
+		if r.OK {
+			icon = "✅"
+			ok++
+		}
+		line := icon + " " + r.Item
+		if r.Detail != "" {
+			line += " — " + r.Detail
+		}
+		lines = append(lines, line)
+	}
+	summary := fmt.Sprintf("%s\n✅ Berhasil: %d | ❌ Gagal: %d", title, ok, len(results)-ok)
+
+	if len(results) <= InlineReportLimit {
+		return summary + "\n\n" + strings.Join(lines, "\n"), nil
+	}
+	return summary + "\n📎 Detail di lampiran.", &tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("report-%s.txt", time.Now().Format("20060102-150405")),
+		Bytes: []byte(summary + "\n\n" + strings.Join(lines, "\n") + "\n"),
+	}
+}
+
+// sendReport delivers buildReport's output to chatID.
+func sendReport(bot Sender, chatID int64, title string, results []BatchResult) {
+	text, doc := buildReport(title, results)
+	if doc == nil {
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+		return
+	}
+	if err := sendDocumentWithRetry(bot, chatID, *doc, text); err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, text+"\n(Lampiran gagal dikirim: "+err.Error()+")"))
+	}
+}
+
+// ==========================================
+// Validation Helpers
+// ==========================================
+
+func validateUsername(bot Sender, chatID int64, text string, label string) bool {
+	if problem := usernameProblem(text, label); problem != "" {
+		sendMessage(bot, chatID, "❌ "+problem+" Coba lagi:")
+		return false
+	}
+	return true
+}
+
+// usernameProblem describes why text is not a valid account name, or
+// returns "".
+func usernameProblem(text string, label string) string {
+	if len(text) < 3 || len(text) > 20 {
+		return fmt.Sprintf("%s harus 3-20 karakter.", label)
+	}
+	if !regexp.MustCompile(`^[a-zA-Z0-9_-]+$`).MatchString(text) {
+		return fmt.Sprintf("%s hanya boleh huruf, angka, - dan _.", label)
+	}
+	return ""
+}
+
+// validatePassword checks the connection password asked for in
+// separate_password mode.
+func validatePassword(bot Sender, chatID int64, text string) bool {
+	if len(text) < 4 || len(text) > 32 {
+		sendMessage(bot, chatID, "❌ Password harus 4-32 karakter. Coba lagi:")
+		return false
+	}
+	if strings.ContainsAny(text, " \t\n") {
+		sendMessage(bot, chatID, "❌ Password tidak boleh mengandung spasi. Coba lagi:")
+		return false
+	}
+	return true
+}
+
+func validateNumber(bot Sender, chatID int64, text string, min, max int, fieldName string) (int, bool) {
+	val, err := strconv.Atoi(text)
+	if err != nil || val < min || val > max {
+		sendMessage(bot, chatID, fmt.Sprintf("❌ %s harus angka positif (%d-%d). Coba lagi:", fieldName, min, max))
+		return 0, false
+	}
+	return val, true
+}
+
+// ==========================================
+// Configuration & Utils
+// ==========================================
+
+func brandName(config *BotConfig) string {
+	if config.BrandName != "" {
+		return config.BrandName
+	}
+	return DefaultBrandName
+}
+
+func footerText(config *BotConfig) string {
+	if config.FooterText == "" {
+		return DefaultFooterText
+	}
+	return applyPlaceholders(config.FooterText, config)
+}
+
+// broadcastFooter returns the line appended to broadcasts: broadcast_footer
+// if set, otherwise "Broadcast dari" the brand (or Admin).
+func broadcastFooter(config *BotConfig) string {
+	if config.BroadcastFooter != "" {
+		return "\n\n" + applyPlaceholders(config.BroadcastFooter, config)
+	}
+	from := DefaultBroadcastFrom
+	if config.BrandName != "" {
+		// Markdown can't escape inside italics: close, escape, reopen
+		from = strings.ReplaceAll(config.BrandName, "_", "_\\__")
+	}
+	return "\n\n_• Broadcast dari " + from + " •_"
+}
+
+// accountNote renders account_note for one delivered account.
+func accountNote(config *BotConfig, username string, expired string) string {
+	return strings.NewReplacer(
+		"{username}", username,
+		"{expired}", expired,
+	).Replace(applyPlaceholders(config.AccountNote, config))
+}
+
+// renderTemplate returns the configured (or built-in) text for event with
+// values and the common placeholders filled in.
+func renderTemplate(config *BotConfig, event string, values map[string]string) string {
+	text, ok := config.Templates[event]
+	if !ok || templateProblem(event, text) != "" {
+		text = defaultTemplates[event]
+	}
+	var pairs []string
+	for placeholder, value := range values {
+		pairs = append(pairs, placeholder, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(applyPlaceholders(text, config))
+}
+
+// templateProblem explains why a configured template can't be used, or
+// returns "". Such templates fall back to the built-in text.
+func templateProblem(event string, text string) string {
+	if _, ok := defaultTemplates[event]; !ok {
+		return fmt.Sprintf("unknown event %q", event)
+	}
+	for _, placeholder := range placeholderPattern.FindAllString(text, -1) {
+		if !templatePlaceholders[placeholder] {
+			return fmt.Sprintf("%s: unknown placeholder %s", event, placeholder)
+		}
+	}
+	return ""
+}
+
+// applyPlaceholders fills the {brand} and {domain} placeholders of a
+// user-configured text.
+func applyPlaceholders(text string, config *BotConfig) string {
+	return strings.NewReplacer(
+		"{brand}", brandName(config),
+		"{domain}", config.Domain,
+	).Replace(text)
+}
+
+// maxDurationDays is the longest create/renew duration userID may enter.
+// The owner may always go up to MaxDurationDays.
+func maxDurationDays(config *BotConfig, userID int64) int {
+	if userID == config.AdminID || config.MaxDurationDays <= 0 || config.MaxDurationDays > MaxDurationDays {
+		return MaxDurationDays
+	}
+	return config.MaxDurationDays
+}
 
-		f, err := os.Open(file)
+func defaultDays(config *BotConfig) int {
+	if config.DefaultDays > 0 {
+		return config.DefaultDays
+	}
+	return DefaultDays
+}
+
+// randomPassword returns a random lowercase alphanumeric password that
+// passes validateUsername.
+func randomPassword(length int) (string, error) {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	buf := make([]byte, length)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
 		if err != nil {
-			continue
+			return "", err
 		}
-		defer f.Close()
+		buf[i] = alphabet[n.Int64()]
+	}
+	return string(buf), nil
+}
 
-		w, err := zipWriter.Create(filepath.Base(file))
-		if err != nil {
+// hasAdminView reports whether admin menus and actions are available to
+// userID. It is false for the owner while previewing as a regular user.
+func hasAdminView(config *BotConfig, userID int64) bool {
+	return can(config, userID, "admin")
+}
+
+func isAllowed(config *BotConfig, userID int64) bool {
+	return config.Mode == "public" || userID == config.AdminID || assignedRole(config, userID) != ""
+}
+
+// ==========================================
+// Permissions
+// ==========================================
+
+// permissionActions are the actions a role can be granted in
+// permissions; "*" grants all of them.
+var permissionActions = []string{"create", "renew", "delete", "list", "export", "broadcast", "admin"}
+
+// defaultPermissions keep the behaviour from before roles existed.
+var defaultPermissions = map[string][]string{
+	"owner": {"*"},
+	"user":  {"create", "renew", "delete"},
+}
+
+// assignedRole returns the configured role userID belongs to, or "" when
+// none. Role names are checked in order so the result is stable.
+func assignedRole(config *BotConfig, userID int64) string {
+	names := make([]string, 0, len(config.Roles))
+	for name := range config.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "owner" {
 			continue
 		}
+		for _, id := range config.Roles[name] {
+			if id == userID {
+				return name
+			}
+		}
+	}
+	return ""
+}
 
-		if _, err := io.Copy(w, f); err != nil {
-			continue
+// roleOf returns the role whose permissions apply to userID. The owner
+// counts as a regular user while previewing.
+func roleOf(config *BotConfig, userID int64) string {
+	if userID == config.AdminID {
+		if previewMode[userID] {
+			return "user"
 		}
+		return "owner"
 	}
+	if role := assignedRole(config, userID); role != "" {
+		return role
+	}
+	return "user"
+}
 
-	zipWriter.Close()
+// rolePermissions returns the actions granted to role.
+func rolePermissions(config *BotConfig, role string) []string {
+	if role == "owner" {
+		return defaultPermissions["owner"]
+	}
+	if actions, ok := config.Permissions[role]; ok {
+		return actions
+	}
+	if actions, ok := config.Permissions["user"]; ok {
+		return actions
+	}
+	return defaultPermissions["user"]
+}
 
-	fileName := fmt.Sprintf("zivpn-backup-%s.zip", time.Now().Format("20060102-150405"))
+// can reports whether userID's role grants action.
+func can(config *BotConfig, userID int64, action string) bool {
+	for _, granted := range rolePermissions(config, roleOf(config, userID)) {
+		if granted == "*" || granted == action {
+			return true
+		}
+	}
+	return false
+}
 
-	// Create a temporary file for the upload
-	tmpFile := "/tmp/" + fileName
-	if err := ioutil.WriteFile(tmpFile, buf.Bytes(), 0644); err != nil {
-		replyError(bot, chatID, "Gagal membuat file backup.")
-		return
+func knownPermission(action string) bool {
+	for _, known := range permissionActions {
+		if known == action {
+			return true
+		}
 	}
-	defer os.Remove(tmpFile)
+	return false
+}
 
-	doc := tgbotapi.NewDocument(chatID, tgbotapi.FilePath(tmpFile))
-	doc.Caption = "✅ Backup Data ZiVPN"
+// denyAction records a refused action in the audit log.
+func denyAction(userID int64, action, target string) {
+	log.Printf("Denied %s (%s) for user %d", action, target, userID)
+	audit(userID, "denied", fmt.Sprintf("%s: %s", action, target))
+}
 
-	deleteLastMessage(bot, chatID)
-	bot.Send(doc)
+// logPermissions prints the effective permissions at startup and warns
+// about unknown actions, so typos in the config don't go unnoticed.
+func logPermissions(config *BotConfig) {
+	roles := []string{"owner", "user"}
+	for name := range config.Roles {
+		if name != "owner" && name != "user" {
+			roles = append(roles, name)
+		}
+	}
+	sort.Strings(roles[2:])
+	for _, role := range roles {
+		actions := rolePermissions(config, role)
+		for _, action := range actions {
+			if action != "*" && !knownPermission(action) {
+				log.Printf("Warning: unknown permission %q for role %s", action, role)
+			}
+		}
+		log.Printf("Role %s (%d users): %s", role, len(config.Roles[role]), strings.Join(actions, ", "))
+	}
+	for name := range config.Permissions {
+		if name != "owner" && name != "user" && config.Roles[name] == nil {
+			log.Printf("Warning: permissions for role %s, which has no users", name)
+		}
+	}
+	if _, ok := config.Permissions["owner"]; ok {
+		log.Printf("Warning: permissions for the owner are ignored, the owner can do everything")
+	}
 }
 
-func startRestore(bot *tgbotapi.BotAPI, chatID int64, userID int64) {
-	userStates[userID] = "waiting_restore_file"
-	sendMessage(bot, chatID, "⬆️ *Restore Data*\n\nSilakan kirim file ZIP backup Anda sekarang.\n\n⚠️ PERINGATAN: Data saat ini akan ditimpa!")
+func saveConfig(config *BotConfig) error {
+	return writeJSONAtomic(BotConfigFile, config)
 }
 
-func processRestoreFile(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, config *BotConfig) {
-	chatID := msg.Chat.ID
-	userID := msg.From.ID
+func loadConfig() (BotConfig, error) {
+	var config BotConfig
+	file, err := ioutil.ReadFile(BotConfigFile)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(file, &config)
 
-	resetState(userID)
-	sendMessage(bot, chatID, "⏳ Sedang memproses file...")
+	// Jika domain kosong di config, coba baca dari file domain
+	if config.Domain == "" {
+		config.Domain = readDomainFile()
+	}
 
-	// Download file
-	fileID := msg.Document.FileID
-	file, err := bot.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	return config, err
+}
+
+// readDomainFile returns the domain written by the installer, or "".
+func readDomainFile() string {
+	domainBytes, err := ioutil.ReadFile(DomainFile)
 	if err != nil {
-		replyError(bot, chatID, "Gagal mengunduh file.")
-		return
+		return ""
 	}
+	return strings.TrimSpace(string(domainBytes))
+}
 
-	fileUrl := file.Link(config.BotToken)
-	resp, err := http.Get(fileUrl)
-	if err != nil {
-		replyError(bot, chatID, "Gagal mengunduh file content.")
+// setDomain writes domain to both the bot config and DomainFile so menus
+// and backups agree.
+func setDomain(config *BotConfig, domain string) error {
+	if err := writeFileAtomic(DomainFile, []byte(domain+"\n"), 0644); err != nil {
+		return err
+	}
+	config.Domain = domain
+	return saveConfig(config)
+}
+
+// hostnamePattern accepts dotted hostnames like vpn.example.com.
+var hostnamePattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// handleSetDomain implements "/setdomain <domain>".
+func handleSetDomain(bot Sender, chatID int64, arg string, config *BotConfig) {
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(arg), "."))
+	if domain == "" {
+		replyError(bot, chatID, "Format: /setdomain <domain>")
 		return
 	}
-	defer resp.Body.Close()
+	if len(domain) > 253 || !hostnamePattern.MatchString(domain) {
+		replyError(bot, chatID, fmt.Sprintf("%s bukan hostname yang valid.", domain))
+		return
+	}
+	if err := setDomain(config, domain); err != nil {
+		replyError(bot, chatID, "Gagal menyimpan domain: "+err.Error())
+		return
+	}
+	deleteLastMessage(bot, chatID)
+	bot.Send(tgbotapi.NewMessage(chatID, "✅ Domain disetel ke "+domain))
+	showMainMenu(bot, chatID, config)
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		replyError(bot, chatID, "Gagal membaca file.")
+// checkDomainMismatch warns the owner at startup when the bot config and
+// DomainFile name different domains, and lets them pick one.
+func checkDomainMismatch(bot Sender, config *BotConfig) {
+	fileDomain := readDomainFile()
+	if fileDomain == "" || config.Domain == "" || fileDomain == config.Domain {
 		return
 	}
+	log.Printf("Warning: domain mismatch, config has %q but %s has %q", config.Domain, DomainFile, fileDomain)
 
-	// Unzip
-	zipReader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
-	if err != nil {
-		replyError(bot, chatID, "File bukan format ZIP yang valid.")
+	msg := tgbotapi.NewMessage(config.AdminID, fmt.Sprintf("⚠️ Domain tidak sama:\n• Config : %s\n• File   : %s\n\nMenu memakai config, backup memakai file. Pilih yang benar:", config.Domain, fileDomain))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(truncateLabel("Pakai "+config.Domain), "domain_keep_config"),
+			tgbotapi.NewInlineKeyboardButtonData(truncateLabel("Pakai "+fileDomain), "domain_keep_file"),
+		),
+	)
+	bot.Send(msg)
+}
+
+func resolveDomainMismatch(bot Sender, chatID int64, domain string, config *BotConfig) {
+	if domain == "" {
+		replyError(bot, chatID, "Domain kosong, gunakan /setdomain.")
+		return
+	}
+	if err := setDomain(config, domain); err != nil {
+		replyError(bot, chatID, "Gagal menyimpan domain: "+err.Error())
 		return
 	}
+	deleteLastMessage(bot, chatID)
+	bot.Send(tgbotapi.NewMessage(chatID, "✅ Domain disetel ke "+domain))
+	showMainMenu(bot, chatID, config)
+}
 
-	for _, f := range zipReader.File {
-		// Security check: only allow specific files
-		validFiles := map[string]bool{
-			"config.json":     true,
-			"users.json":      true,
-			"bot-config.json": true,
-			"domain":          true,
-			"apikey":          true,
-		}
+func bindAccount(username string, userID int64, server string) {
+	bindingsMutex.Lock()
+	defer bindingsMutex.Unlock()
 
-		if !validFiles[f.Name] {
-			continue
-		}
+	bindings[username] = userID
+	if server == LocalServerName {
+		delete(bindingServers, username)
+	} else {
+		bindingServers[username] = server
+	}
+	if err := saveBindings(); err != nil {
+		log.Printf("Failed to save bindings: %v", err)
+	}
+}
 
-		rc, err := f.Open()
-		if err != nil {
-			continue
-		}
-		defer rc.Close()
+func unbindAccount(username string) {
+	bindingsMutex.Lock()
+	defer bindingsMutex.Unlock()
 
-		dstPath := filepath.Join("/etc/zivpn", f.Name)
-		dst, err := os.Create(dstPath)
-		if err != nil {
-			continue
-		}
-		defer dst.Close()
+	if _, ok := bindings[username]; !ok {
+		return
+	}
+	delete(bindings, username)
+	delete(bindingServers, username)
+	if err := saveBindings(); err != nil {
+		log.Printf("Failed to save bindings: %v", err)
+	}
+}
 
-		io.Copy(dst, rc)
+// saveBindings writes both binding files. Callers hold bindingsMutex.
+func saveBindings() error {
+	if err := writeJSONAtomic(BindingServersFile, bindingServers); err != nil {
+		return err
 	}
+	return writeJSONAtomic(BindingsFile, bindings)
+}
 
-	// Restart Services
-	exec.Command("systemctl", "restart", "zivpn").Run()
-	exec.Command("systemctl", "restart", "zivpn-api").Run()
+// bindingOwner returns the Telegram user an account is bound to.
+func bindingOwner(username string) (int64, bool) {
+	bindingsMutex.RLock()
+	defer bindingsMutex.RUnlock()
 
-	msgSuccess := tgbotapi.NewMessage(chatID, "✅ Restore Berhasil!\nService ZiVPN, API, dan Bot telah direstart.")
-	bot.Send(msgSuccess)
+	owner, ok := bindings[username]
+	return owner, ok
+}
 
-	// Restart Bot with delay to allow message sending
-	go func() {
-		time.Sleep(2 * time.Second)
-		exec.Command("systemctl", "restart", "zivpn-bot").Run()
-	}()
+// bindingServer returns the server of a bound account.
+func bindingServer(username string) string {
+	bindingsMutex.RLock()
+	defer bindingsMutex.RUnlock()
 
-	showMainMenu(bot, chatID, config)
+	return serverOfBinding(username)
 }
 
-// ==========================================
-// UI & Helpers
-// ==========================================
+// serverOfBinding is bindingServer for callers holding bindingsMutex.
+func serverOfBinding(username string) string {
+	if server, ok := bindingServers[username]; ok {
+		return server
+	}
+	return LocalServerName
+}
 
-func showMainMenu(bot *tgbotapi.BotAPI, chatID int64, config *BotConfig) {
-	ipInfo, _ := getIpInfo()
-	domain := config.Domain
-	if domain == "" {
-		domain = "(Not Configured)"
+func loadBindings() error {
+	return loadJSONFile(BindingsFile, &bindings)
+}
+
+// recordAttribution remembers which Telegram user created an account.
+func recordAttribution(username string, userID int64) {
+	attributions[username] = userID
+	if err := writeJSONAtomic(AttributionsFile, attributions); err != nil {
+		log.Printf("Failed to save attributions: %v", err)
 	}
+}
 
-	msgText := fmt.Sprintf("```\n━━━━━━━━━━━━━━━━━━━━━\n    MENU ZIVPN UDP\n━━━━━━━━━━━━━━━━━━━━━\n • Domain   : %s\n • City     : %s\n • ISP      : %s\n━━━━━━━━━━━━━━━━━━━━━\n```\n👇 Silakan pilih menu dibawah ini:", domain, ipInfo.City, ipInfo.Isp)
+func removeAttribution(username string) {
+	if _, ok := attributions[username]; !ok {
+		return
+	}
+	delete(attributions, username)
+	if err := writeJSONAtomic(AttributionsFile, attributions); err != nil {
+		log.Printf("Failed to save attributions: %v", err)
+	}
+}
 
-	msg := tgbotapi.NewMessage(chatID, msgText)
-	msg.ParseMode = "Markdown"
-	msg.ReplyMarkup = getMainMenuKeyboard(config, chatID)
-	sendAndTrack(bot, msg)
+// countAccountsCreatedBy counts the still existing accounts created by userID.
+func countAccountsCreatedBy(userID int64, users []UserData) int {
+	count := 0
+	for _, u := range users {
+		if creator, ok := attributions[u.Password]; ok && creator == userID {
+			count++
+		}
+	}
+	return count
 }
 
-func getMainMenuKeyboard(config *BotConfig, userID int64) tgbotapi.InlineKeyboardMarkup {
-	// Public Menu (Everyone)
-	rows := [][]tgbotapi.InlineKeyboardButton{
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("👤 Create Password", "menu_create"),
-			tgbotapi.NewInlineKeyboardButtonData("🗑️ Delete Password", "menu_delete"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔄 Renew Password", "menu_renew"),
-		),
+// writeJSONAtomic writes v as indented JSON to path, see writeFileAtomic.
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
 	}
+	return writeFileAtomic(path, data, 0644)
+}
 
-	// Admin Menu (Admin Only)
-	if userID == config.AdminID {
-		modeLabel := "🔐 Mode: Private"
-		if config.Mode == "public" {
-			modeLabel = "🌍 Mode: Public"
+// writeFileAtomic writes data to a temp file next to path and renames it
+// into place, so a crash mid-write (e.g. the restart after a restore)
+// leaves either the old or the new file, never a truncated one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadJSONFile reads JSON from path into v. A missing file is not an error.
+func loadJSONFile(path string, v interface{}) error {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
+	}
+	return json.Unmarshal(file, v)
+}
 
-		rows[1] = append(rows[1], tgbotapi.NewInlineKeyboardButtonData("📋 List Passwords", "menu_list"))
+// saveChatSession records the chat a user is talking from. ChatID and
+// LastSeen are refreshed on every contact.
+func saveChatSession(from *tgbotapi.User, chatID int64) {
+	if from == nil {
+		return
+	}
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
 
-		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("📊 System Info", "menu_info"),
-			tgbotapi.NewInlineKeyboardButtonData("💾 Backup & Restore", "menu_backup_restore"),
-		))
-		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(modeLabel, "toggle_mode"),
-		))
+	session, exists := activeChats[from.ID]
+	if !exists {
+		session = ChatSession{UserID: from.ID, JoinedAt: time.Now()}
+	}
+	name := strings.TrimSpace(from.FirstName + " " + from.LastName)
+	changed := !exists || session.ChatID != chatID || session.Name != name
+	session.ChatID = chatID
+	session.Name = name
+	session.LastSeen = time.Now()
+	activeChats[from.ID] = session
+	if !exists {
+		trimChats()
 	}
 
-	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+	// Every update lands here; only write when something besides
+	// LastSeen changed, or the last write is old
+	if !changed && time.Since(chatsSavedAt) < ChatsSaveInterval {
+		return
+	}
+	if err := saveChats(); err != nil {
+		log.Printf("Failed to save chats: %v", err)
+		return
+	}
+	chatsSavedAt = time.Now()
 }
 
-func sendAccountInfo(bot *tgbotapi.BotAPI, chatID int64, data map[string]interface{}, config *BotConfig) {
-	ipInfo, _ := getIpInfo()
-	domain := config.Domain
-	if domain == "" {
-		domain = "(Not Configured)"
+// termsAccepted reports whether userID may use the bot under the current
+// terms. Terms only apply in public mode and never to the owner.
+func termsAccepted(config *BotConfig, userID int64) bool {
+	if config.TermsText == "" || config.Mode != "public" || userID == config.AdminID {
+		return true
+	}
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+
+	session, ok := activeChats[userID]
+	return ok && !session.TermsAcceptedAt.IsZero() && session.TermsVersion == config.TermsVersion
+}
+
+// acceptTerms records that userID accepted the given terms version.
+func acceptTerms(userID int64, version int) {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+
+	session, ok := activeChats[userID]
+	if !ok {
+		return
+	}
+	session.TermsVersion = version
+	session.TermsAcceptedAt = time.Now()
+	activeChats[userID] = session
+
+	if err := saveChats(); err != nil {
+		log.Printf("Failed to save chats: %v", err)
 	}
+}
+
+// togglePlainText flips the /plain preference of userID and returns the
+// new value.
+func togglePlainText(userID int64) bool {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+
+	session, ok := activeChats[userID]
+	if !ok {
+		session = ChatSession{UserID: userID, ChatID: userID, JoinedAt: time.Now(), LastSeen: time.Now()}
+	}
+	session.PlainText = !session.PlainText
+	activeChats[userID] = session
+
+	if err := saveChats(); err != nil {
+		log.Printf("Failed to save chats: %v", err)
+	}
+	return session.PlainText
+}
+
+// setBroadcastOptOut records whether userID wants to stop receiving
+// broadcasts. It reports whether the setting changed.
+func setBroadcastOptOut(userID int64, optOut bool) bool {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+
+	session, ok := activeChats[userID]
+	if !ok {
+		session = ChatSession{UserID: userID, ChatID: userID, JoinedAt: time.Now(), LastSeen: time.Now()}
+	}
+	if session.NoBroadcast == optOut {
+		return false
+	}
+	session.NoBroadcast = optOut
+	activeChats[userID] = session
+
+	if err := saveChats(); err != nil {
+		log.Printf("Failed to save chats: %v", err)
+	}
+	return true
+}
 
-	msg := fmt.Sprintf("```\n━━━━━━━━━━━━━━━━━━━━━\n  ACCOUNT ZIVPN UDP\n━━━━━━━━━━━━━━━━━━━━━\nPassword   : %s\nCITY       : %s\nISP        : %s\nIP ISP     : %s\nDomain     : %s\nExpired On : %s\n━━━━━━━━━━━━━━━━━━━━━\n```",
-		data["password"],
-		ipInfo.City,
-		ipInfo.Isp,
-		ipInfo.Query,
-		domain,
-		data["expired"],
-	)
+// broadcastOptOuts counts the chats that opted out of broadcasts.
+func broadcastOptOuts() int {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
 
-	reply := tgbotapi.NewMessage(chatID, msg)
-	reply.ParseMode = "Markdown"
-	deleteLastMessage(bot, chatID)
-	bot.Send(reply)
-	showMainMenu(bot, chatID, config)
+	count := 0
+	for _, session := range activeChats {
+		if session.NoBroadcast {
+			count++
+		}
+	}
+	return count
 }
 
-func showUserSelection(bot *tgbotapi.BotAPI, chatID int64, page int, action string) {
-	users, err := getUsers()
-	if err != nil {
-		replyError(bot, chatID, "Gagal mengambil data user.")
-		return
+// wantsPlainText reports whether the user behind chatID asked for /plain.
+func wantsPlainText(chatID int64) bool {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+
+	if session, ok := activeChats[chatID]; ok {
+		return session.PlainText
 	}
+	for _, session := range activeChats {
+		if session.ChatID == chatID {
+			return session.PlainText
+		}
+	}
+	return false
+}
 
-	if len(users) == 0 {
-		sendMessage(bot, chatID, "📂 Tidak ada user.")
+// plainMarkdownReplacer drops Markdown markers and unescapes escaped
+// characters so the text reads the same without a parse mode.
+var plainMarkdownReplacer = strings.NewReplacer(
+	"```\n", "", "```", "", "`", "", "*", "",
+	"\\_", "_", "\\*", "*", "\\`", "`", "\\[", "[",
+)
+
+// applyPlainText strips the parse mode from msg for /plain users.
+func applyPlainText(msg *tgbotapi.MessageConfig) {
+	if msg.ParseMode == "" || !wantsPlainText(msg.ChatID) {
 		return
 	}
+	if msg.ParseMode == "Markdown" {
+		msg.Text = plainMarkdownReplacer.Replace(msg.Text)
+	}
+	msg.ParseMode = ""
+}
 
-	perPage := 10
-	totalPages := (len(users) + perPage - 1) / perPage
+// chatForUser returns the latest known chat of a user, falling back to the
+// user ID itself (which is the private chat ID in Telegram).
+func chatForUser(userID int64) int64 {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
 
-	if page < 1 {
-		page = 1
+	if session, ok := activeChats[userID]; ok {
+		return session.ChatID
 	}
-	if page > totalPages {
-		page = totalPages
+	return userID
+}
+
+// pruneChats forgets sessions whose LastSeen is older than the TTL and
+// returns how many were removed.
+func pruneChats(ttl time.Duration) int {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+
+	cutoff := time.Now().Add(-ttl)
+	pruned := 0
+	for userID, session := range activeChats {
+		if session.LastSeen.Before(cutoff) {
+			delete(activeChats, userID)
+			pruned++
+		}
 	}
 
-	start := (page - 1) * perPage
-	end := start + perPage
-	if end > len(users) {
-		end = len(users)
+	if pruned > 0 {
+		if err := saveChats(); err != nil {
+			log.Printf("Failed to save chats: %v", err)
+		}
 	}
+	return pruned
+}
 
-	var rows [][]tgbotapi.InlineKeyboardButton
-	for _, u := range users[start:end] {
-		label := fmt.Sprintf("%s (%s)", u.Password, u.Status)
-		if u.Status == "Expired" {
-			label = fmt.Sprintf("🔴 %s", label)
-		} else {
-			label = fmt.Sprintf("🟢 %s", label)
+// forgetChats drops the sessions of the given chats, e.g. after the user
+// blocked the bot.
+func forgetChats(chatIDs []int64) {
+	if len(chatIDs) == 0 {
+		return
+	}
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+
+	drop := make(map[int64]bool)
+	for _, id := range chatIDs {
+		drop[id] = true
+	}
+	for userID, session := range activeChats {
+		if drop[session.ChatID] {
+			delete(activeChats, userID)
 		}
-		data := fmt.Sprintf("select_%s:%s", action, u.Password)
-		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(label, data),
-		))
 	}
+	if err := saveChats(); err != nil {
+		log.Printf("Failed to save chats: %v", err)
+	}
+}
 
-	var navRow []tgbotapi.InlineKeyboardButton
-	if page > 1 {
-		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("⬅️ Prev", fmt.Sprintf("page_%s:%d", action, page-1)))
+// trimChats evicts the least recently seen sessions beyond
+// maxChatSessions and returns how many were dropped. Callers must hold
+// chatsMutex.
+func trimChats() int {
+	excess := len(activeChats) - maxChatSessions
+	if excess <= 0 {
+		return 0
 	}
-	if page < totalPages {
-		navRow = append(navRow, tgbotapi.NewInlineKeyboardButtonData("Next ➡️", fmt.Sprintf("page_%s:%d", action, page+1)))
+	sessions := make([]ChatSession, 0, len(activeChats))
+	for _, session := range activeChats {
+		sessions = append(sessions, session)
 	}
-	if len(navRow) > 0 {
-		rows = append(rows, navRow)
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.Before(sessions[j].LastSeen)
+	})
+	for _, session := range sessions[:excess] {
+		delete(activeChats, session.UserID)
 	}
+	return excess
+}
 
-	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel")))
+// trimChatsNow applies trimChats and persists the result.
+func trimChatsNow() int {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
 
-	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("📋 Pilih User untuk %s (Halaman %d/%d):", strings.Title(action), page, totalPages))
-	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
-	sendAndTrack(bot, msg)
+	trimmed := trimChats()
+	if trimmed > 0 {
+		if err := saveChats(); err != nil {
+			log.Printf("Failed to save chats: %v", err)
+		}
+	}
+	return trimmed
 }
 
-func sendMessage(bot *tgbotapi.BotAPI, chatID int64, text string) {
-	msg := tgbotapi.NewMessage(chatID, text)
-	if _, inState := userStates[chatID]; inState {
-		cancelKb := tgbotapi.NewInlineKeyboardMarkup(
-			tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("❌ Batal", "cancel")),
-		)
-		msg.ReplyMarkup = cancelKb
+func chatSessionLimit(config *BotConfig) int {
+	if config.MaxChatSessions <= 0 {
+		return DefaultMaxChats
 	}
-	sendAndTrack(bot, msg)
+	return config.MaxChatSessions
 }
 
-func replyError(bot *tgbotapi.BotAPI, chatID int64, text string) {
-	sendMessage(bot, chatID, "❌ "+text)
+func chatTTL(config *BotConfig) time.Duration {
+	days := config.ChatTTLDays
+	if days <= 0 {
+		days = DefaultChatTTLDays
+	}
+	return time.Duration(days) * 24 * time.Hour
 }
 
-func sendAndTrack(bot *tgbotapi.BotAPI, msg tgbotapi.MessageConfig) {
-	deleteLastMessage(bot, msg.ChatID)
-	sentMsg, err := bot.Send(msg)
-	if err == nil {
-		lastMessageIDs[msg.ChatID] = sentMsg.MessageID
+// startSecretWatcher notices when the apikey file or the bot token in
+// bot-config.json change. A new API key is picked up right away; a new
+// bot token needs a restart, so the owner is only warned.
+func startSecretWatcher(bot Sender, config *BotConfig) {
+	botToken := config.BotToken
+	ticker := time.NewTicker(SecretCheckInterval)
+	for range ticker.C {
+		if keyBytes, err := ioutil.ReadFile(ApiKeyFile); err == nil {
+			key := strings.TrimSpace(string(keyBytes))
+			apiKeyMutex.Lock()
+			changed := key != "" && key != ApiKey
+			if changed {
+				ApiKey = key
+			}
+			apiKeyMutex.Unlock()
+			if changed {
+				log.Printf("API key changed (fingerprint %s), reloaded", secretFingerprint(key))
+				bot.Send(tgbotapi.NewMessage(config.AdminID, fmt.Sprintf("🔑 API key di %s berubah (fingerprint %s) dan sudah dimuat ulang.\nJika ini bukan Anda, segera periksa server!", ApiKeyFile, secretFingerprint(key))))
+			}
+		}
+
+		var fileConfig BotConfig
+		if err := loadJSONFile(BotConfigFile, &fileConfig); err == nil && fileConfig.BotToken != "" && fileConfig.BotToken != botToken {
+			botToken = fileConfig.BotToken
+			log.Printf("Bot token in %s changed (fingerprint %s), restart required", BotConfigFile, secretFingerprint(botToken))
+			bot.Send(tgbotapi.NewMessage(config.AdminID, fmt.Sprintf("🔑 Bot token di %s berubah (fingerprint %s).\nRestart bot agar token baru dipakai: systemctl restart zivpn-bot\nJika ini bukan Anda, segera periksa server!", BotConfigFile, secretFingerprint(botToken))))
+		}
 	}
 }
 
-func deleteLastMessage(bot *tgbotapi.BotAPI, chatID int64) {
-	if msgID, ok := lastMessageIDs[chatID]; ok {
-		deleteMsg := tgbotapi.NewDeleteMessage(chatID, msgID)
-		bot.Request(deleteMsg)
-		delete(lastMessageIDs, chatID)
-	}
+// secretFingerprint identifies a secret in messages without revealing it.
+func secretFingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:4])
 }
 
-func resetState(userID int64) {
-	delete(userStates, userID)
-	delete(tempUserData, userID)
+func startChatPruner(config *BotConfig) {
+	ticker := time.NewTicker(1 * time.Hour)
+	for range ticker.C {
+		if pruned := pruneChats(chatTTL(config)); pruned > 0 {
+			log.Printf("Pruned %d stale chat sessions", pruned)
+		}
+	}
 }
 
-// ==========================================
-// Validation Helpers
-// ==========================================
+// saveChats persists activeChats. Callers must hold chatsMutex.
+func saveChats() error {
+	return writeJSONAtomic(ChatsFile, activeChats)
+}
 
-func validateUsername(bot *tgbotapi.BotAPI, chatID int64, text string) bool {
-	if len(text) < 3 || len(text) > 20 {
-		sendMessage(bot, chatID, "❌ Password harus 3-20 karakter. Coba lagi:")
-		return false
-	}
-	if !regexp.MustCompile(`^[a-zA-Z0-9_-]+$`).MatchString(text) {
-		sendMessage(bot, chatID, "❌ Password hanya boleh huruf, angka, - dan _. Coba lagi:")
-		return false
+// flushChats writes the LastSeen times saveChatSession held back.
+func flushChats() {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+	if err := saveChats(); err != nil {
+		log.Printf("Failed to save chats: %v", err)
 	}
-	return true
 }
 
-func validateNumber(bot *tgbotapi.BotAPI, chatID int64, text string, min, max int, fieldName string) (int, bool) {
-	val, err := strconv.Atoi(text)
-	if err != nil || val < min || val > max {
-		sendMessage(bot, chatID, fmt.Sprintf("❌ %s harus angka positif (%d-%d). Coba lagi:", fieldName, min, max))
-		return 0, false
-	}
-	return val, true
+func loadChats() error {
+	return loadJSONFile(ChatsFile, &activeChats)
 }
 
 // ==========================================
-// Configuration & Utils
+// Audit Log
 // ==========================================
 
-func isAllowed(config *BotConfig, userID int64) bool {
-	return config.Mode == "public" || userID == config.AdminID
+// AuditEntry is one line of AuditLogFile.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	ActorID int64     `json:"actor_id"` // 0 for the bot itself
+	Action  string    `json:"action"`
+	Detail  string    `json:"detail,omitempty"`
 }
 
-func saveConfig(config *BotConfig) error {
-	data, err := json.MarshalIndent(config, "", "  ")
+var auditMutex = &sync.Mutex{}
+
+// audit appends an entry to the audit log (JSON lines). Failures are only
+// logged; auditing never blocks the action itself.
+func audit(actorID int64, action string, detail string) {
+	data, err := json.Marshal(AuditEntry{Time: time.Now(), ActorID: actorID, Action: action, Detail: detail})
 	if err != nil {
-		return err
+		return
 	}
-	return ioutil.WriteFile(BotConfigFile, data, 0644)
-}
 
-func loadConfig() (BotConfig, error) {
-	var config BotConfig
-	file, err := ioutil.ReadFile(BotConfigFile)
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	f, err := os.OpenFile(AuditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		return config, err
+		log.Printf("Failed to open audit log: %v", err)
+		return
 	}
-	err = json.Unmarshal(file, &config)
-
-	// Jika domain kosong di config, coba baca dari file domain
-	if config.Domain == "" {
-		if domainBytes, err := ioutil.ReadFile(DomainFile); err == nil {
-			config.Domain = strings.TrimSpace(string(domainBytes))
-		}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
 	}
-
-	return config, err
 }
 
 // ==========================================
 // API Client
 // ==========================================
 
-func apiCall(method, endpoint string, payload interface{}) (map[string]interface{}, error) {
+// LocalServerName names the API on this VPS in the server menu.
+const LocalServerName = "local"
+
+type serverCtxKey struct{}
+
+// serverCtx returns the context for API calls made on behalf of chatID,
+// carrying the server that chat has selected.
+func serverCtx(chatID int64) context.Context {
+	if name, ok := selectedServers[chatID]; ok {
+		return withServer(appCtx, name)
+	}
+	return appCtx
+}
+
+func withServer(ctx context.Context, name string) context.Context {
+	if name == "" || name == LocalServerName {
+		return ctx
+	}
+	return context.WithValue(ctx, serverCtxKey{}, name)
+}
+
+// serverName returns the server an API call in ctx goes to.
+func serverName(ctx context.Context) string {
+	if name, ok := ctx.Value(serverCtxKey{}).(string); ok {
+		return name
+	}
+	return LocalServerName
+}
+
+// serverEndpoint returns the base URL and key for the server in ctx. An
+// unknown name (e.g. removed from the config) falls back to local.
+func serverEndpoint(ctx context.Context) (string, string) {
+	if server, ok := apiServers[serverName(ctx)]; ok {
+		return strings.TrimRight(server.Url, "/"), server.Key
+	}
+	apiKeyMutex.RLock()
+	defer apiKeyMutex.RUnlock()
+	return ApiUrl, ApiKey
+}
+
+func apiCall(ctx context.Context, method, endpoint string, payload interface{}) (map[string]interface{}, error) {
 	var reqBody []byte
 	var err error
 
@@ -820,30 +7644,210 @@ func apiCall(method, endpoint string, payload interface{}) (map[string]interface
 		}
 	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest(method, ApiUrl+endpoint, bytes.NewBuffer(reqBody))
+	ctx, cancel := context.WithTimeout(ctx, ApiTimeout)
+	defer cancel()
+
+	baseURL, key := serverEndpoint(ctx)
+	req, err := http.NewRequestWithContext(ctx, method, baseURL+endpoint, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return nil, err
 	}
 
+	requestID := newRequestID()
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-API-Key", ApiKey)
+	req.Header.Set(RequestIDHeader, requestID)
+	if ApiAuthScheme != "" {
+		req.Header.Set(ApiAuthHeader, ApiAuthScheme+" "+key)
+	} else {
+		req.Header.Set(ApiAuthHeader, key)
+	}
 
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := apiClient.Do(req)
 	if err != nil {
-		return nil, err
+		apiErr := classifyTransportError(err)
+		apiErr.RequestID = requestID
+		logAPICall(ctx, method, endpoint, err.Error(), time.Since(start), requestID, true)
+		return nil, apiErr
 	}
 	defer resp.Body.Close()
 
 	body, _ := ioutil.ReadAll(resp.Body)
+	logAPICall(ctx, method, endpoint, strconv.Itoa(resp.StatusCode), time.Since(start), requestID, resp.StatusCode >= 400)
 	var result map[string]interface{}
 	json.Unmarshal(body, &result)
 
+	if resp.StatusCode >= 400 {
+		apiErr := &APIError{Class: APIOutage, Status: resp.StatusCode, RequestID: requestID}
+		if resp.StatusCode < 500 {
+			apiErr.Class = APIUserError
+		}
+		if result != nil {
+			apiErr.Message = fmt.Sprint(result["message"])
+		}
+		return result, apiErr
+	}
+
 	return result, nil
 }
 
+// newRequestID returns a short random correlation ID for one API call.
+func newRequestID() string {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// logAPICall logs one API call. Failures are always logged, successes
+// only with api_debug_log. The endpoint is redacted first: its query
+// carries account passwords.
+func logAPICall(ctx context.Context, method, endpoint, status string, latency time.Duration, requestID string, failed bool) {
+	if !failed && !apiDebugLog {
+		return
+	}
+	log.Printf("API %s %s %s on %s: %s in %s", requestID, method, redactEndpoint(endpoint), serverName(ctx), status, latency.Round(time.Millisecond))
+}
+
+// redactEndpoint masks the password query parameter of an API endpoint.
+func redactEndpoint(endpoint string) string {
+	path, query, found := strings.Cut(endpoint, "?")
+	if !found {
+		return endpoint
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return path + "?<redacted>"
+	}
+	if values.Has("password") {
+		values.Set("password", "***")
+	}
+	return path + "?" + values.Encode()
+}
+
+// classifyTransportError turns a failed request into an APIError: a
+// refused connection means the API is not running, anything else
+// (timeouts, resets) is treated as an outage.
+func classifyTransportError(err error) *APIError {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return &APIError{Class: APIDown, Err: err}
+	}
+	return &APIError{Class: APIOutage, Err: err}
+}
+
+// apiScheme returns "https" when configured, otherwise "http".
+func apiScheme(config *BotConfig) string {
+	if strings.EqualFold(config.ApiScheme, "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// newApiClient builds the HTTP client for the zivpn-api, trusting
+// api_ca_cert in addition to the system roots when set.
+func newApiClient(config *BotConfig) (*http.Client, error) {
+	if config.ApiCACert == "" && !config.ApiInsecureSkipVerify {
+		return &http.Client{}, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.ApiInsecureSkipVerify}
+	if config.ApiCACert != "" {
+		pem, err := ioutil.ReadFile(config.ApiCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.ApiCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// Last release check, see cachedLatestRelease
+var latestReleaseTag string
+var latestReleaseAt time.Time
+var latestReleaseMutex = &sync.Mutex{}
+
+// showVersion implements /version: the running build and, for admins with
+// release_check_url set, the latest release.
+func showVersion(bot Sender, chatID int64, userID int64, config *BotConfig) {
+	text := fmt.Sprintf("🤖 %s bot\nVersi : %s\nGo    : %s", brandName(config), Version, runtime.Version())
+	if config.ReleaseCheckURL != "" && hasAdminView(config, userID) {
+		latest, err := cachedLatestRelease(config.ReleaseCheckURL)
+		switch {
+		case err != nil:
+			log.Printf("Release check failed: %v", err)
+			text += "\n\n⚠️ Gagal mengecek rilis terbaru."
+		case latest == Version:
+			text += "\n\n✅ Sudah versi terbaru."
+		default:
+			text += "\n\n⬆️ Rilis terbaru: " + latest
+		}
+	}
+	sendMessage(bot, chatID, text)
+}
+
+// cachedLatestRelease returns latestRelease, checked at most once per
+// ReleaseCheckTTL. Failures are not cached.
+func cachedLatestRelease(releaseURL string) (string, error) {
+	latestReleaseMutex.Lock()
+	defer latestReleaseMutex.Unlock()
+
+	if latestReleaseTag != "" && time.Since(latestReleaseAt) < ReleaseCheckTTL {
+		return latestReleaseTag, nil
+	}
+	latest, err := latestRelease(releaseURL)
+	if err != nil {
+		return "", err
+	}
+	latestReleaseTag, latestReleaseAt = latest, time.Now()
+	return latest, nil
+}
+
+// latestRelease reads the latest version from releaseURL, either the
+// tag_name of a GitHub release or the first line of a plain text body.
+func latestRelease(releaseURL string) (string, error) {
+	client := &http.Client{Timeout: ReleaseCheckTimeout}
+	resp, err := client.Get(releaseURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if json.Unmarshal(body, &release) == nil && release.TagName != "" {
+		return release.TagName, nil
+	}
+	latest := strings.TrimSpace(strings.SplitN(string(body), "\n", 2)[0])
+	if latest == "" {
+		return "", errors.New("empty response")
+	}
+	return latest, nil
+}
+
+// IpInfoURL returns the server's location shown in menus and account info.
+var IpInfoURL = "http://ip-api.com/json/"
+
 func getIpInfo() (IpInfo, error) {
-	resp, err := http.Get("http://ip-api.com/json/")
+	resp, err := http.Get(IpInfoURL)
 	if err != nil {
 		return IpInfo{}, err
 	}
@@ -856,8 +7860,152 @@ func getIpInfo() (IpInfo, error) {
 	return info, nil
 }
 
-func getUsers() ([]UserData, error) {
-	res, err := apiCall("GET", "/users", nil)
+func findUser(users []UserData, username string) (UserData, bool) {
+	for _, u := range users {
+		if u.Password == username {
+			return u, true
+		}
+	}
+	return UserData{}, false
+}
+
+// lookupUser finds an account by typed or stored name. The input is
+// normalized first; with lowercase_usernames on, legacy mixed-case
+// accounts still match case-insensitively.
+func lookupUser(users []UserData, username string, config *BotConfig) (UserData, bool) {
+	username = normalizeUsername(username, config.LowercaseUsernames)
+	if user, found := findUser(users, username); found {
+		return user, true
+	}
+	if config.LowercaseUsernames {
+		for _, u := range users {
+			if strings.EqualFold(u.Password, username) {
+				return u, true
+			}
+		}
+	}
+	return UserData{}, false
+}
+
+// fetchUser looks up one account, preferring the single-user endpoint and
+// falling back to the full list when it is unavailable or a
+// case-insensitive match is needed.
+func fetchUser(ctx context.Context, username string, config *BotConfig) (UserData, bool, error) {
+	username = normalizeUsername(username, config.LowercaseUsernames)
+	user, found, err := getUser(ctx, username)
+	if err == nil && (found || !config.LowercaseUsernames) {
+		return user, found, nil
+	}
+
+	users, err := getUsers(ctx)
+	if err != nil {
+		return UserData{}, false, err
+	}
+	user, found = lookupUser(users, username, config)
+	return user, found, nil
+}
+
+// normalizeUsername drops control and invisible format characters
+// (zero-width spaces, BOM, direction marks), trims surrounding spaces and
+// optionally lowercases, so pasted names map to a single account.
+func normalizeUsername(text string, lowercase bool) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, text)
+	text = strings.TrimSpace(text)
+	if lowercase {
+		text = strings.ToLower(text)
+	}
+	return text
+}
+
+// findSimilarUser returns an existing account that differs from username
+// only by case or by a single edit (e.g. a trailing digit).
+func findSimilarUser(users []UserData, username string) (string, bool) {
+	for _, u := range users {
+		if strings.EqualFold(u.Password, username) || levenshtein(u.Password, username) <= 1 {
+			return u.Password, true
+		}
+	}
+	return "", false
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	m := a
+	if b < m {
+		m = b
+	}
+	if c < m {
+		m = c
+	}
+	return m
+}
+
+// getUser fetches a single account through /user/get. An error means the
+// endpoint could not be used (e.g. an older API without it); callers then
+// fall back to scanning getUsers.
+func getUser(ctx context.Context, password string) (UserData, bool, error) {
+	res, err := apiCall(ctx, "GET", "/user/get?password="+url.QueryEscape(password), nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound && res != nil {
+		// JSON 404 from the endpoint itself: the account does not exist
+		return UserData{}, false, nil
+	}
+	if err != nil {
+		return UserData{}, false, err
+	}
+	if res == nil {
+		return UserData{}, false, fmt.Errorf("user lookup endpoint not available")
+	}
+	if res["success"] != true {
+		return UserData{}, false, nil
+	}
+
+	var user UserData
+	dataBytes, _ := json.Marshal(res["data"])
+	json.Unmarshal(dataBytes, &user)
+	return user, true, nil
+}
+
+// getUsers returns the account list. Results are cached for
+// usersCacheTTL so menu navigation does not hit the API on every tap;
+// mutations call invalidateUsersCache. The lock is not held during the
+// API call, so a slow server doesn't block lookups on the others.
+func getUsers(ctx context.Context) ([]UserData, error) {
+	server := serverName(ctx)
+	usersCacheMutex.Lock()
+	if cached, ok := usersCache[server]; ok && time.Since(usersCacheAt[server]) < usersCacheTTL {
+		usersCacheMutex.Unlock()
+		return append([]UserData(nil), cached...), nil
+	}
+	gen := usersCacheGen
+	usersCacheMutex.Unlock()
+
+	res, err := apiCall(ctx, "GET", "/users", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -866,8 +8014,34 @@ func getUsers() ([]UserData, error) {
 		return nil, fmt.Errorf("failed to get users")
 	}
 
-	var users []UserData
+	users := []UserData{}
 	dataBytes, _ := json.Marshal(res["data"])
 	json.Unmarshal(dataBytes, &users)
-	return users, nil
-}
\ No newline at end of file
+
+	usersCacheMutex.Lock()
+	if gen == usersCacheGen {
+		usersCache[server] = users
+		usersCacheAt[server] = time.Now()
+	}
+	usersCacheMutex.Unlock()
+	return append([]UserData(nil), users...), nil
+}
+
+// invalidateUsersCache forces the next getUsers to query the API.
+func invalidateUsersCache() {
+	usersCacheMutex.Lock()
+	defer usersCacheMutex.Unlock()
+	usersCache = make(map[string][]UserData)
+	usersCacheGen++
+}
+
+// cacheTTL returns the configured user list cache TTL.
+func cacheTTL(config *BotConfig) time.Duration {
+	if config.UsersCacheSeconds < 0 {
+		return 0
+	}
+	if config.UsersCacheSeconds == 0 {
+		return DefaultUsersCacheTTL
+	}
+	return time.Duration(config.UsersCacheSeconds) * time.Second
+}
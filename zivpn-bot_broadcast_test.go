@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The broadcast worker pool shares counters, the blocked list and the
+// Sender across goroutines; run these with -race.
+
+// seedChats registers n private chats with IDs base+1 .. base+n.
+func seedChats(base int64, n int) {
+	chatsMutex.Lock()
+	defer chatsMutex.Unlock()
+	for i := int64(1); i <= int64(n); i++ {
+		activeChats[base+i] = ChatSession{UserID: base + i, ChatID: base + i, JoinedAt: time.Now()}
+	}
+}
+
+// waitForText polls until a message containing substr was sent.
+func waitForText(t *testing.T, bot *fakeSender, substr string, timeout time.Duration) string {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if text := bot.lastText(substr); text != "" {
+			return text
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no message containing %q after %s", substr, timeout)
+	return ""
+}
+
+func TestBroadcastWorkerPool(t *testing.T) {
+	bot, _, config := newTestBot(t)
+	config.BroadcastWorkers = 8
+	config.BroadcastRate = MaxBroadcastRate
+
+	const base, total = 5000, 40
+	seedChats(base, total)
+
+	// Every 5th chat blocked the bot; one chat hits a flood-wait once.
+	floodChat := int64(base + 3)
+	flooded := false
+	bot.sendErr = func(c tgbotapi.Chattable) error {
+		chatID := chatOf(c)
+		if chatID > base && (chatID-base)%5 == 0 {
+			return &tgbotapi.Error{Code: http.StatusForbidden, Message: "Forbidden: bot was blocked by the user"}
+		}
+		if chatID == floodChat && !flooded {
+			flooded = true
+			return &tgbotapi.Error{Code: http.StatusTooManyRequests, Message: "Too Many Requests",
+				ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 1}}
+		}
+		return nil
+	}
+
+	count, ok := launchBroadcast(bot, testOwnerID, BroadcastContent{Text: "halo"}, config)
+	if !ok || count != total {
+		t.Fatalf("launchBroadcast = (%d, %v), want (%d, true)", count, ok, total)
+	}
+	if _, ok := launchBroadcast(bot, testOwnerID, BroadcastContent{Text: "lagi"}, config); ok {
+		t.Fatal("second broadcast started while the first one runs")
+	}
+
+	report := waitForText(t, bot, "Broadcast selesai", 10*time.Second)
+	for _, want := range []string{"Terkirim : 32", "Gagal    : 8", "Diblokir : 8", "Total    : 40"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report missing %q:\n%s", want, report)
+		}
+	}
+
+	chatsMutex.Lock()
+	remaining := len(activeChats)
+	chatsMutex.Unlock()
+	if remaining != total-8 {
+		t.Errorf("%d chats left, want %d (blocked chats forgotten)", remaining, total-8)
+	}
+
+	broadcastMutex.Lock()
+	running := broadcastCancel != nil
+	broadcastMutex.Unlock()
+	if running {
+		t.Error("broadcast still marked as running")
+	}
+}
+
+func TestBroadcastCancel(t *testing.T) {
+	bot, _, config := newTestBot(t)
+	config.BroadcastWorkers = 4
+	config.BroadcastRate = 1
+
+	seedChats(6000, 20)
+
+	if _, ok := launchBroadcast(bot, testOwnerID, BroadcastContent{Text: "halo"}, config); !ok {
+		t.Fatal("broadcast did not start")
+	}
+	cancelBroadcast(bot, testOwnerID)
+
+	report := waitForText(t, bot, "Broadcast dihentikan", 5*time.Second)
+	if strings.Contains(report, "Terkirim : 20") {
+		t.Errorf("cancelled broadcast still reached everyone:\n%s", report)
+	}
+}
+
+func TestBroadcastFooter(t *testing.T) {
+	tests := []struct {
+		name   string
+		config BotConfig
+		want   string
+	}{
+		{"default", BotConfig{}, "\n\n_• Broadcast dari Admin •_"},
+		{"brand", BotConfig{BrandName: "Kaisar VPN"}, "\n\n_• Broadcast dari Kaisar VPN •_"},
+		{"brand with underscore", BotConfig{BrandName: "kaisar_vpn"}, "\n\n_• Broadcast dari kaisar_\\__vpn •_"},
+		{"template", BotConfig{BrandName: "Kaisar", Domain: "vpn.example.com", BroadcastFooter: "— {brand} ({domain})"}, "\n\n— Kaisar (vpn.example.com)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := broadcastFooter(&tt.config); got != tt.want {
+				t.Errorf("broadcastFooter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// End-to-end flows against the mock zivpn-api: every step goes through
+// handleCallback/handleMessage exactly like a Telegram update would.
+
+func TestAccountLifecycle(t *testing.T) {
+	bot, api, config := newTestBot(t)
+
+	// Create
+	tap(bot, testOwnerID, "menu_create", config)
+	handleMessage(bot, textMessage(testOwnerID, "dave01"), config)
+	handleMessage(bot, textMessage(testOwnerID, "30"), config)
+	created, ok := api.user("dave01")
+	if !ok {
+		t.Fatal("create: dave01 missing")
+	}
+
+	// List
+	tap(bot, testOwnerID, "menu_list", config)
+	if list := bot.lastText("List Passwords"); !strings.Contains(list, "dave01") {
+		t.Fatalf("list: dave01 not listed in %q", list)
+	}
+
+	// Renew
+	tap(bot, testOwnerID, "menu_renew", config)
+	tap(bot, testOwnerID, "select_renew:"+callbackToken(testOwnerID, "dave01"), config)
+	if got := userStates[testOwnerID]; got != "renew_days" {
+		t.Fatalf("renew: state %q, want renew_days", got)
+	}
+	handleMessage(bot, textMessage(testOwnerID, "10"), config)
+	if got := userStates[testOwnerID]; got != "renew_confirm" {
+		t.Fatalf("renew: state %q, want renew_confirm", got)
+	}
+	tap(bot, testOwnerID, "renew_confirm", config)
+	renewed, _ := api.user("dave01")
+	if renewed.Expired <= created.Expired {
+		t.Fatalf("renew: expiry %s not after %s", renewed.Expired, created.Expired)
+	}
+
+	// Delete
+	tap(bot, testOwnerID, "menu_delete", config)
+	tap(bot, testOwnerID, "select_delete:"+callbackToken(testOwnerID, "dave01"), config)
+	tap(bot, testOwnerID, "confirm_delete:"+callbackToken(testOwnerID, "dave01"), config)
+	if _, ok := api.user("dave01"); ok {
+		t.Fatal("delete: dave01 still exists")
+	}
+}
+
+func TestCreateAPIFailureOffersRetry(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.failNext("/user/create", http.StatusInternalServerError)
+
+	tap(bot, testOwnerID, "menu_create", config)
+	handleMessage(bot, textMessage(testOwnerID, "erin01"), config)
+	handleMessage(bot, textMessage(testOwnerID, "30"), config)
+
+	if _, ok := api.user("erin01"); ok {
+		t.Fatal("erin01 created despite the failure")
+	}
+	if bot.lastText("Server sedang bermasalah") == "" {
+		t.Fatal("no outage message")
+	}
+	if _, ok := retryActions[testOwnerID]; !ok {
+		t.Fatal("no retry offered")
+	}
+
+	tap(bot, testOwnerID, "retry_last", config)
+	if _, ok := api.user("erin01"); !ok {
+		t.Fatal("retry did not create erin01")
+	}
+}
+
+func TestListAPIFailure(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.addUser("frank01", "2030-01-01")
+	api.failNext("/users", http.StatusInternalServerError)
+
+	tap(bot, testOwnerID, "menu_list", config)
+
+	if bot.lastText("List Passwords") != "" {
+		t.Fatal("list shown despite the failure")
+	}
+	if bot.lastText("Server sedang bermasalah") == "" {
+		t.Fatal("no outage message")
+	}
+}
+
+func TestRenewAPIFailureKeepsExpiry(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.addUser("gina01", "2030-01-01")
+	api.failNext("/user/renew", http.StatusInternalServerError)
+
+	renewUser(bot, testOwnerID, testOwnerID, "gina01", 30, config)
+
+	if u, _ := api.user("gina01"); u.Expired != "2030-01-01" {
+		t.Fatalf("expiry changed to %s", u.Expired)
+	}
+	if bot.lastText("Server sedang bermasalah") == "" {
+		t.Fatal("no outage message")
+	}
+	if len(renewHistory["gina01"]) != 0 {
+		t.Error("failed renew recorded in history")
+	}
+}
+
+func TestRenewUnknownAccount(t *testing.T) {
+	bot, _, config := newTestBot(t)
+
+	renewUser(bot, testOwnerID, testOwnerID, "nobody01", 30, config)
+
+	if bot.lastText("sudah tidak ada") == "" {
+		t.Fatal("no 'account gone' message")
+	}
+}
+
+func TestDeleteAPIFailureKeepsAccount(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.addUser("hank01", "2030-01-01")
+	api.failNext("/user/delete", http.StatusInternalServerError)
+
+	tap(bot, testOwnerID, "confirm_delete:"+callbackToken(testOwnerID, "hank01"), config)
+
+	if _, ok := api.user("hank01"); !ok {
+		t.Fatal("hank01 deleted despite the failure")
+	}
+	if bot.lastText("Server sedang bermasalah") == "" {
+		t.Fatal("no outage message")
+	}
+}
+
+func TestAPIErrorShowsRequestID(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.failNext("/users", http.StatusInternalServerError)
+
+	tap(bot, testOwnerID, "menu_list", config)
+
+	if bot.lastText("(ID: ") == "" {
+		t.Fatal("error message carries no request ID")
+	}
+}
+
+func TestAutoRenewCoversRemoteServers(t *testing.T) {
+	bot, local, config := newTestBot(t)
+
+	remote := &mockAPI{users: make(map[string]UserData), fail: make(map[string]int)}
+	server := httptest.NewServer(remote)
+	t.Cleanup(server.Close)
+	apiServers["sg"] = ServerConfig{Name: "sg", Url: server.URL + "/api", Key: "test-key"}
+	t.Cleanup(func() { delete(apiServers, "sg") })
+
+	tomorrow := time.Now().In(botLocation(config)).AddDate(0, 0, 1).Format("2006-01-02")
+	local.addUser("ivy01", tomorrow)
+	remote.addUser("jack01", tomorrow)
+	for _, name := range []string{"ivy01", "jack01"} {
+		name := name
+		setAutoRenew(name, true)
+		t.Cleanup(func() { setAutoRenew(name, false) })
+	}
+
+	runAutoRenew(bot, config)
+
+	if u, _ := local.user("ivy01"); u.Expired == tomorrow {
+		t.Error("local account not renewed")
+	}
+	if u, _ := remote.user("jack01"); u.Expired == tomorrow {
+		t.Error("remote account not renewed")
+	}
+	if report := bot.lastText("Auto-renew"); !strings.Contains(report, "sg/jack01") {
+		t.Errorf("report does not name the remote account:\n%s", report)
+	}
+}
+
+// The activation scheduler DMs the owner while the update loop keeps
+// binding accounts; -race catches unguarded access to the bindings.
+func TestActivationWhileBinding(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	today := time.Now().In(botLocation(config)).Format("2006-01-02")
+	api.addUser("kim01", today)
+	bindAccount("kim01", testUserID, LocalServerName)
+
+	activationsMutex.Lock()
+	activations["kim01"] = PendingActivation{StartDate: today, Days: 30, CreatedBy: testOwnerID}
+	activationsMutex.Unlock()
+	t.Cleanup(func() { removeActivation("kim01") })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runActivations(bot, config)
+	}()
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("other%02d", i)
+		bindAccount(name, testOwnerID, LocalServerName)
+		unbindAccount(name)
+	}
+	<-done
+
+	if bot.lastText("sudah aktif") == "" {
+		t.Fatal("owner was not told about the activation")
+	}
+}
+
+// textChoice returns the number /menu assigned to callback data in chatID.
+func textChoice(t *testing.T, chatID int64, data string) string {
+	t.Helper()
+	for number, choice := range textMenuChoices[chatID] {
+		if choice == data {
+			return number
+		}
+	}
+	t.Fatalf("no text menu choice for %q in %v", data, textMenuChoices[chatID])
+	return ""
+}
+
+func TestTextMenuRenewFlow(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.addUser("nina01", "2030-01-01")
+
+	handleMessage(bot, textMessage(testOwnerID, "/menu"), config)
+	handleMessage(bot, textMessage(testOwnerID, textChoice(t, testOwnerID, "menu_renew")), config)
+	handleMessage(bot, textMessage(testOwnerID, textChoice(t, testOwnerID, "select_renew:"+callbackToken(testOwnerID, "nina01"))), config)
+	// The duration goes to the flow, not to the choices
+	handleMessage(bot, textMessage(testOwnerID, "1"), config)
+	if got := userStates[testOwnerID]; got != "renew_confirm" {
+		t.Fatalf("state %q, want renew_confirm", got)
+	}
+	handleMessage(bot, textMessage(testOwnerID, textChoice(t, testOwnerID, "renew_confirm")), config)
+
+	if u, _ := api.user("nina01"); u.Expired != "2030-01-02" {
+		t.Errorf("expiry %s, want 2030-01-02", u.Expired)
+	}
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	for _, c := range bot.sent {
+		if msg, ok := c.(tgbotapi.MessageConfig); ok && msg.ReplyMarkup != nil {
+			t.Errorf("keyboard sent in text menu mode: %q", msg.Text)
+		}
+	}
+}
+
+func TestTextMenuExit(t *testing.T) {
+	bot, _, config := newTestBot(t)
+
+	handleMessage(bot, textMessage(testOwnerID, "/menu"), config)
+	handleMessage(bot, textMessage(testOwnerID, "0"), config)
+	if textMenuChats[testOwnerID] {
+		t.Fatal("still in text menu mode")
+	}
+	showMainMenu(textMenuSender{bot}, testOwnerID, config)
+	if bot.lastText("MENU") == "" || textMenuChoices[testOwnerID] != nil {
+		t.Error("menu rendered as text after exit")
+	}
+}
+
+func TestReferralRewardOnRemoteServer(t *testing.T) {
+	bot, local, config := newTestBot(t)
+	config.ReferralBonusDays = 7
+
+	remote := &mockAPI{users: make(map[string]UserData), fail: make(map[string]int)}
+	server := httptest.NewServer(remote)
+	t.Cleanup(server.Close)
+	apiServers["sg"] = ServerConfig{Name: "sg", Url: server.URL + "/api", Key: "test-key"}
+	t.Cleanup(func() { delete(apiServers, "sg") })
+
+	remote.addUser("quinn01", "2030-01-01")
+	bindAccount("quinn01", testOwnerID, "sg")
+	referrals[testUserID] = Referral{ReferrerID: testOwnerID, CreatedAt: time.Now()}
+	t.Cleanup(func() { referrals = make(map[int64]Referral) })
+
+	rewardReferral(bot, testUserID, config)
+
+	if u, _ := remote.user("quinn01"); u.Expired != "2030-01-08" {
+		t.Errorf("remote expiry %s, want 2030-01-08", u.Expired)
+	}
+	if _, ok := local.user("quinn01"); ok {
+		t.Error("bonus created the account on the local server")
+	}
+	if history := renewHistory["quinn01"]; len(history) != 1 || history[0].OldExpiry != "2030-01-01" {
+		t.Errorf("renew history %+v, want one entry from 2030-01-01", history)
+	}
+}
+
+func TestConfirmRoutesIgnoreDoubleTap(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.addUser("sam01", "2030-01-01")
+
+	data := "remind_renew:" + callbackToken(testOwnerID, "sam01")
+	tap(bot, testOwnerID, data, config)
+	tap(bot, testOwnerID, data, config)
+
+	want := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, reminderRenewDays(config, testOwnerID)).Format("2006-01-02")
+	if u, _ := api.user("sam01"); u.Expired != want {
+		t.Errorf("expiry %s, want %s (renewed once)", u.Expired, want)
+	}
+}
+
+// A broadcast confirmed from the text menu runs on worker goroutines
+// while the main loop keeps rendering text menus; -race catches the
+// text menu wrapper leaking into the workers.
+func TestTextMenuBroadcast(t *testing.T) {
+	bot, _, config := newTestBot(t)
+	config.BroadcastRate = MaxBroadcastRate
+	seedChats(7000, 20)
+
+	handleMessage(bot, textMessage(testOwnerID, "/menu"), config)
+	handleMessage(bot, textMessage(testOwnerID, textChoice(t, testOwnerID, "menu_broadcast")), config)
+	handleMessage(bot, textMessage(testOwnerID, textChoice(t, testOwnerID, "broadcast_compose")), config)
+	handleMessage(bot, textMessage(testOwnerID, "halo semua"), config)
+	handleMessage(bot, textMessage(testOwnerID, textChoice(t, testOwnerID, "broadcast_send")), config)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for bot.lastText("Broadcast selesai") == "" && time.Now().Before(deadline) {
+		handleMessage(bot, textMessage(testOwnerID, "/menu"), config)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if report := bot.lastText("Broadcast selesai"); !strings.Contains(report, "Terkirim : 20") {
+		t.Fatalf("broadcast report %q, want 20 sent", report)
+	}
+}
+
+func TestReferralRewardPicksSoonestExpiry(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	config.ReferralBonusDays = 7
+
+	api.addUser("rita01", "2030-06-01")
+	api.addUser("rita02", "2030-01-01")
+	api.addUser("rita03", "2030-03-01")
+	for _, name := range []string{"rita01", "rita02", "rita03"} {
+		bindAccount(name, testOwnerID, "")
+	}
+	referrals[testUserID] = Referral{ReferrerID: testOwnerID, CreatedAt: time.Now()}
+	t.Cleanup(func() { referrals = make(map[int64]Referral) })
+
+	rewardReferral(bot, testUserID, config)
+
+	if u, _ := api.user("rita02"); u.Expired != "2030-01-08" {
+		t.Errorf("rita02 expiry %s, want 2030-01-08", u.Expired)
+	}
+	for name, want := range map[string]string{"rita01": "2030-06-01", "rita03": "2030-03-01"} {
+		if u, _ := api.user(name); u.Expired != want {
+			t.Errorf("%s expiry %s, want %s", name, u.Expired, want)
+		}
+	}
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The bot keeps its state under /etc/zivpn with fixed paths. On a machine
+// running the bot the tests would overwrite it, so they refuse to run.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if _, err := os.Stat("/etc/zivpn"); err == nil {
+		fmt.Println("skipping tests: /etc/zivpn exists and would be overwritten")
+		os.Exit(0)
+	}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// ==========================================
+// Fake Telegram Sender
+// ==========================================
+
+// fakeSender records every message instead of talking to Telegram. It is
+// safe for concurrent use, like the broadcast workers need.
+type fakeSender struct {
+	mu       sync.Mutex
+	sent     []tgbotapi.Chattable
+	requests []tgbotapi.Chattable
+	nextID   int
+
+	// sendErr, when set, decides the error returned for a message
+	sendErr func(c tgbotapi.Chattable) error
+}
+
+func (f *fakeSender) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sent = append(f.sent, c)
+	if f.sendErr != nil {
+		if err := f.sendErr(c); err != nil {
+			return tgbotapi.Message{}, err
+		}
+	}
+	f.nextID++
+	return tgbotapi.Message{MessageID: f.nextID, Chat: &tgbotapi.Chat{ID: chatOf(c)}}, nil
+}
+
+func (f *fakeSender) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, c)
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (f *fakeSender) GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error) {
+	return tgbotapi.File{}, errors.New("fakeSender: GetFile not supported")
+}
+
+// texts returns the text or caption of every sent message, in order.
+func (f *fakeSender) texts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var texts []string
+	for _, c := range f.sent {
+		switch m := c.(type) {
+		case tgbotapi.MessageConfig:
+			texts = append(texts, m.Text)
+		case tgbotapi.EditMessageTextConfig:
+			texts = append(texts, m.Text)
+		case tgbotapi.PhotoConfig:
+			texts = append(texts, m.Caption)
+		case tgbotapi.DocumentConfig:
+			texts = append(texts, m.Caption)
+		}
+	}
+	return texts
+}
+
+// lastText returns the last sent text containing substr, or "".
+func (f *fakeSender) lastText(substr string) string {
+	texts := f.texts()
+	for i := len(texts) - 1; i >= 0; i-- {
+		if strings.Contains(texts[i], substr) {
+			return texts[i]
+		}
+	}
+	return ""
+}
+
+func (f *fakeSender) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sent)
+}
+
+func chatOf(c tgbotapi.Chattable) int64 {
+	switch m := c.(type) {
+	case tgbotapi.MessageConfig:
+		return m.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return m.ChatID
+	case tgbotapi.PhotoConfig:
+		return m.ChatID
+	case tgbotapi.DocumentConfig:
+		return m.ChatID
+	}
+	return 0
+}
+
+// ==========================================
+// Mock zivpn-api
+// ==========================================
+
+// mockAPI is an in-memory zivpn-api answering like the real one.
+type mockAPI struct {
+	mu    sync.Mutex
+	users map[string]UserData
+	fail  map[string]int // Endpoint -> status for its next call
+	calls []string
+}
+
+// newMockAPI starts a mock API and points the bot at it until the test
+// ends. It also serves the IP lookup used by menus.
+func newMockAPI(t *testing.T) *mockAPI {
+	t.Helper()
+	api := &mockAPI{users: make(map[string]UserData), fail: make(map[string]int)}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+
+	oldURL, oldKey, oldIpInfo := ApiUrl, ApiKey, IpInfoURL
+	ApiUrl, ApiKey, IpInfoURL = server.URL+"/api", "test-key", server.URL+"/json/"
+	t.Cleanup(func() { ApiUrl, ApiKey, IpInfoURL = oldURL, oldKey, oldIpInfo })
+	return api
+}
+
+// failNext makes the next call to endpoint (e.g. "/user/create") answer
+// with status.
+func (api *mockAPI) failNext(endpoint string, status int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.fail[endpoint] = status
+}
+
+func (api *mockAPI) addUser(password string, expired string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.users[password] = UserData{Password: password, Expired: expired, Status: "Active"}
+}
+
+func (api *mockAPI) user(password string) (UserData, bool) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	u, ok := api.users[password]
+	return u, ok
+}
+
+func (api *mockAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/json/" {
+		json.NewEncoder(w).Encode(IpInfo{City: "Jakarta", Isp: "Test ISP", Query: "203.0.113.1"})
+		return
+	}
+	if r.Header.Get("X-API-Key") != "test-key" {
+		mockReply(w, http.StatusUnauthorized, false, "Unauthorized", nil)
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	endpoint := strings.TrimPrefix(r.URL.Path, "/api")
+	api.calls = append(api.calls, r.Method+" "+endpoint)
+	if status, ok := api.fail[endpoint]; ok {
+		delete(api.fail, endpoint)
+		mockReply(w, status, false, "Simulated failure", nil)
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+		Days     int    `json:"days"`
+		Expired  string `json:"expired"`
+	}
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+
+	switch endpoint {
+	case "/users":
+		list := make([]UserData, 0, len(api.users))
+		for _, u := range api.users {
+			list = append(list, u)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Password < list[j].Password })
+		mockReply(w, http.StatusOK, true, "Daftar user", list)
+	case "/user/get":
+		u, ok := api.users[r.URL.Query().Get("password")]
+		if !ok {
+			mockReply(w, http.StatusNotFound, false, "User tidak ditemukan", nil)
+			return
+		}
+		mockReply(w, http.StatusOK, true, "Data user", u)
+	case "/user/create":
+		if _, exists := api.users[req.Password]; exists {
+			mockReply(w, http.StatusConflict, false, "User sudah ada", nil)
+			return
+		}
+		u := UserData{Password: req.Password, Expired: time.Now().AddDate(0, 0, req.Days).Format("2006-01-02"), Status: "Active"}
+		api.users[req.Password] = u
+		mockReply(w, http.StatusOK, true, "User berhasil dibuat", map[string]string{"password": u.Password, "expired": u.Expired})
+	case "/user/renew":
+		u, ok := api.users[req.Password]
+		if !ok {
+			mockReply(w, http.StatusNotFound, false, "User tidak ditemukan", nil)
+			return
+		}
+		if req.Expired != "" {
+			u.Expired = req.Expired
+		} else if current, err := time.Parse("2006-01-02", u.Expired); err == nil {
+			u.Expired = current.AddDate(0, 0, req.Days).Format("2006-01-02")
+		}
+		u.Status = "Active"
+		api.users[req.Password] = u
+		mockReply(w, http.StatusOK, true, "User berhasil diperpanjang", map[string]string{"password": u.Password, "expired": u.Expired})
+	case "/user/delete":
+		if _, ok := api.users[req.Password]; !ok {
+			mockReply(w, http.StatusNotFound, false, "User tidak ditemukan", nil)
+			return
+		}
+		delete(api.users, req.Password)
+		mockReply(w, http.StatusOK, true, "User berhasil dihapus", nil)
+	case "/user/lock", "/user/unlock":
+		u, ok := api.users[req.Password]
+		if !ok {
+			mockReply(w, http.StatusNotFound, false, "User tidak ditemukan", nil)
+			return
+		}
+		u.Status = "Active"
+		if endpoint == "/user/lock" {
+			u.Status = "Locked"
+		}
+		api.users[req.Password] = u
+		mockReply(w, http.StatusOK, true, "Status diubah", nil)
+	case "/info":
+		mockReply(w, http.StatusOK, true, "System Info", map[string]string{"domain": "vpn.example.com", "port": "5667"})
+	default:
+		mockReply(w, http.StatusNotFound, false, "Not found", nil)
+	}
+}
+
+func mockReply(w http.ResponseWriter, status int, success bool, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": success, "message": message, "data": data})
+}
+
+// ==========================================
+// Test Setup
+// ==========================================
+
+const (
+	testOwnerID = int64(1001)
+	testUserID  = int64(2002)
+)
+
+// newTestBot resets the bot's global state and returns a fake sender, a
+// mock API and a private-mode config owned by testOwnerID.
+func newTestBot(t *testing.T) (*fakeSender, *mockAPI, *BotConfig) {
+	t.Helper()
+	resetBotState()
+	api := newMockAPI(t)
+	config := &BotConfig{
+		AdminID:            testOwnerID,
+		Mode:               "private",
+		Domain:             "vpn.example.com",
+		CallbackDebounceMs: -1,
+		UsersCacheSeconds:  -1,
+		ClientFormats:      []string{},
+	}
+	usersCacheTTL = cacheTTL(config)
+	return &fakeSender{}, api, config
+}
+
+func resetBotState() {
+	userStates = make(map[int64]string)
+	tempUserData = make(map[int64]map[string]string)
+	stateUpdatedAt = make(map[int64]time.Time)
+	lastMessageIDs = make(map[int64]int)
+	editableMessages = make(map[int64]int)
+	bindings = make(map[string]int64)
+	bindingServers = make(map[string]string)
+	attributions = make(map[string]int64)
+	lastCreated = make(map[int64]CreatedAccount)
+	retryActions = make(map[int64]RetryAction)
+	notes = make(map[string][]Note)
+	renewHistory = make(map[string][]RenewEvent)
+	previewMode = make(map[int64]bool)
+	supportThreads = make(map[int]int64)
+	supportThreadOrder = nil
+	textMenuChats = make(map[int64]bool)
+	textMenuChoices = make(map[int64]map[string]string)
+	consumedCallbacks = make(map[int64]string)
+	lastCallbacks = make(map[int64]lastCallback)
+	callbackTokens = make(map[int64]map[string]string)
+	callbackTokenIDs = make(map[int64]map[string]string)
+	chatsMutex.Lock()
+	activeChats = make(map[int64]ChatSession)
+	chatsMutex.Unlock()
+	invalidateUsersCache()
+}
+
+// textMessage builds an incoming private message from userID.
+func textMessage(userID int64, text string) *tgbotapi.Message {
+	msg := &tgbotapi.Message{
+		MessageID: 1,
+		From:      &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(strings.Fields(text)[0])
+		msg.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return msg
+}
+
+// tap simulates userID pressing a button with data.
+func tap(bot Sender, userID int64, data string, config *BotConfig) {
+	handleCallback(bot, &tgbotapi.CallbackQuery{
+		ID:      "cb",
+		From:    &tgbotapi.User{ID: userID, FirstName: "Test"},
+		Message: &tgbotapi.Message{MessageID: 1, Chat: &tgbotapi.Chat{ID: userID, Type: "private"}},
+		Data:    data,
+	}, config)
+}
+
+// ==========================================
+// Handler Tests
+// ==========================================
+
+func TestCreateFlowStateTransitions(t *testing.T) {
+	bot, api, config := newTestBot(t)
+
+	tap(bot, testOwnerID, "menu_create", config)
+	if got := userStates[testOwnerID]; got != "create_username" {
+		t.Fatalf("after menu_create: state %q, want create_username", got)
+	}
+
+	handleMessage(bot, textMessage(testOwnerID, "alice01"), config)
+	if got := userStates[testOwnerID]; got != "create_days" {
+		t.Fatalf("after password: state %q, want create_days", got)
+	}
+
+	handleMessage(bot, textMessage(testOwnerID, "0"), config)
+	if got := userStates[testOwnerID]; got != "create_days" {
+		t.Fatalf("after invalid duration: state %q, want create_days", got)
+	}
+
+	handleMessage(bot, textMessage(testOwnerID, "30"), config)
+	if state, ok := userStates[testOwnerID]; ok {
+		t.Fatalf("after duration: state %q, want none", state)
+	}
+	if _, ok := api.user("alice01"); !ok {
+		t.Fatal("alice01 was not created")
+	}
+	if bot.lastText("alice01") == "" {
+		t.Error("account info for alice01 was not sent")
+	}
+}
+
+func TestCreateRejectsTakenPassword(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.addUser("bob01", "2030-01-01")
+
+	tap(bot, testOwnerID, "menu_create", config)
+	handleMessage(bot, textMessage(testOwnerID, "bob01"), config)
+
+	if got := userStates[testOwnerID]; got != "create_username" {
+		t.Fatalf("state %q, want create_username", got)
+	}
+	if bot.lastText("sudah dipakai") == "" {
+		t.Error("no 'already taken' reply")
+	}
+}
+
+func TestCancelClearsState(t *testing.T) {
+	bot, _, config := newTestBot(t)
+
+	tap(bot, testOwnerID, "menu_create", config)
+	tap(bot, testOwnerID, "cancel", config)
+
+	if state, ok := userStates[testOwnerID]; ok {
+		t.Fatalf("state %q after cancel, want none", state)
+	}
+	if _, ok := tempUserData[testOwnerID]; ok {
+		t.Error("temp data kept after cancel")
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.addUser("carol01", "2030-01-01")
+
+	deleteUser(bot, testOwnerID, testOwnerID, "carol01", config)
+
+	if _, ok := api.user("carol01"); ok {
+		t.Fatal("carol01 still exists")
+	}
+	if bot.lastText("berhasil dihapus") == "" {
+		t.Error("no delete confirmation")
+	}
+}
+
+func TestPrivateModeRejectsStrangers(t *testing.T) {
+	bot, api, config := newTestBot(t)
+
+	handleMessage(bot, textMessage(testUserID, "/start"), config)
+
+	if bot.lastText("Akses Ditolak") == "" {
+		t.Error("stranger was not refused")
+	}
+	if len(api.calls) != 0 {
+		t.Errorf("API called for a refused user: %v", api.calls)
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		name      string
+		in        string
+		lowercase bool
+		want      string
+	}{
+		{"plain", "alice01", false, "alice01"},
+		{"surrounding space", "  alice01 \t", false, "alice01"},
+		{"zero-width space", "ali\u200bce01", false, "alice01"},
+		{"zero-width joiner", "\u200dalice01\u200c", false, "alice01"},
+		{"byte order mark", "\ufeffalice01", false, "alice01"},
+		{"soft hyphen", "ali\u00adce01", false, "alice01"},
+		{"control chars", "ali\x00ce\x1b01\x7f", false, "alice01"},
+		{"newline inside", "alice\n01", false, "alice01"},
+		{"case kept", "Alice01", false, "Alice01"},
+		{"case folded", "Alice01", true, "alice01"},
+		{"folded with zero-width", "AL\u200bICE01", true, "alice01"},
+		{"only invisible", "\u200b\u200d\ufeff", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeUsername(tt.in, tt.lowercase); got != tt.want {
+				t.Errorf("normalizeUsername(%q, %v) = %q, want %q", tt.in, tt.lowercase, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartCreateChecksPermissionAndPreview(t *testing.T) {
+	bot, _, config := newTestBot(t)
+	config.Roles = map[string][]int64{"viewer": {testUserID}}
+	config.Permissions = map[string][]string{"viewer": {"renew"}}
+
+	handleStartPayload(bot, textMessage(testUserID, "/start create"), "create", config)
+	if state := userStates[testUserID]; state != "" {
+		t.Errorf("viewer entered state %q", state)
+	}
+	if bot.lastText("Akses Ditolak") == "" {
+		t.Error("viewer was not denied")
+	}
+
+	previewMode[testOwnerID] = true
+	handleStartPayload(bot, textMessage(testOwnerID, "/start create"), "create", config)
+	if state := userStates[testOwnerID]; state != "" {
+		t.Errorf("preview entered state %q", state)
+	}
+
+	previewMode[testOwnerID] = false
+	handleStartPayload(bot, textMessage(testOwnerID, "/start create"), "create", config)
+	if state := userStates[testOwnerID]; state != "create_username" {
+		t.Errorf("owner state %q, want create_username", state)
+	}
+}
+
+func TestContactOnlyShownToAdmins(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	api.addUser("lee01", "2030-01-01")
+	setContact("lee01", "+62 812 3456 7890")
+	t.Cleanup(func() { notes = make(map[string][]Note) })
+
+	confirmDeleteUser(bot, testUserID, testUserID, "select_delete:lee01", config)
+	listUsers(bot, testUserID, testUserID, "all", 1, config)
+	if bot.lastText("lee01") == "" {
+		t.Fatal("lee01 not shown to the user")
+	}
+	for _, text := range bot.texts() {
+		if strings.Contains(text, "3456") {
+			t.Fatalf("contact shown to a non-admin:\n%s", text)
+		}
+	}
+
+	confirmDeleteUser(bot, testOwnerID, testOwnerID, "select_delete:lee01", config)
+	if bot.lastText("3456") == "" {
+		t.Error("contact hidden from the owner on delete")
+	}
+	listUsers(bot, testOwnerID, testOwnerID, "all", 1, config)
+	if !strings.Contains(bot.lastText("List Passwords"), "3456") {
+		t.Error("contact hidden from the owner in the list")
+	}
+}
+
+func TestMaxAccountsPerUserOnlyInPublicMode(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	config.MaxAccountsPerUser = 1
+	api.addUser("olga01", "2030-01-01")
+	attributions["olga01"] = testUserID
+
+	if !createUser(bot, testUserID, testUserID, "olga02", "", 30, config) {
+		t.Fatal("private mode: create refused by the public limit")
+	}
+
+	config.Mode = "public"
+	if createUser(bot, testUserID, testUserID, "olga03", "", 30, config) {
+		t.Fatal("public mode: create allowed past the limit")
+	}
+	if bot.lastText("Batas maksimal 1 akun") == "" {
+		t.Error("no limit message")
+	}
+}
+
+func TestGetUsersDoesNotWaitForSlowServer(t *testing.T) {
+	_, api, _ := newTestBot(t)
+	api.addUser("paul01", "2030-01-01")
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		mockReply(w, http.StatusOK, true, "Daftar user", []UserData{})
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	apiServers["slow"] = ServerConfig{Name: "slow", Url: slow.URL + "/api", Key: "test-key"}
+	t.Cleanup(func() { delete(apiServers, "slow") })
+
+	go getUsers(withServer(appCtx, "slow"))
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := getUsers(appCtx)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("getUsers: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("local getUsers blocked by the slow server")
+	}
+}
+
+func TestVersionReleaseCheckAdminOnlyAndCached(t *testing.T) {
+	bot, _, config := newTestBot(t)
+
+	var mu sync.Mutex
+	hits := 0
+	release := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		w.Write([]byte(`{"tag_name": "v9.9.9"}`))
+	}))
+	t.Cleanup(release.Close)
+	config.ReleaseCheckURL = release.URL
+	t.Cleanup(func() { latestReleaseTag, latestReleaseAt = "", time.Time{} })
+
+	showVersion(bot, testUserID, testUserID, config)
+	if strings.Contains(bot.lastText("Versi"), "v9.9.9") {
+		t.Error("release shown to a non-admin")
+	}
+
+	showVersion(bot, testOwnerID, testOwnerID, config)
+	showVersion(bot, testOwnerID, testOwnerID, config)
+	if !strings.Contains(bot.lastText("Versi"), "Rilis terbaru: v9.9.9") {
+		t.Errorf("release missing for the owner:\n%s", bot.lastText("Versi"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits != 1 {
+		t.Errorf("release URL fetched %d times, want 1", hits)
+	}
+}
+
+func TestSimilarUserNameOnlyShownToAdmins(t *testing.T) {
+	bot, api, config := newTestBot(t)
+	config.Mode = "public"
+	api.addUser("rita01", "2030-01-01")
+
+	for _, userID := range []int64{testUserID, testOwnerID} {
+		startCreateUser(bot, userID, userID, config)
+		handleState(bot, textMessage(userID, "rita02"), "create_username", config)
+	}
+
+	if text := bot.lastText("mirip"); !strings.Contains(text, "`rita01`") {
+		t.Errorf("owner warning lacks the similar name:\n%s", text)
+	}
+	for _, text := range bot.texts() {
+		if strings.Contains(text, "mirip dengan akun lain") {
+			return
+		}
+		if strings.Contains(text, "rita01") {
+			t.Fatalf("similar name shown to a user:\n%s", text)
+		}
+	}
+	t.Error("user got no generic warning")
+}
+
+// The dashboard updater renders the mode while the update loop switches
+// it; run with -race.
+func TestDashboardTextWhileSwitchingMode(t *testing.T) {
+	bot, _, config := newTestBot(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			dashboardText(config)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		setMaintenance(bot, testOwnerID, "on", config)
+		setMode(testOwnerID, "public", config)
+		setMaintenanceMode(bot, false, config)
+		setMode(testOwnerID, "private", config)
+	}
+	<-done
+
+	if text := dashboardText(config); !strings.Contains(text, "Mode: Private") {
+		t.Errorf("dashboard mode wrong:\n%s", text)
+	}
+}
+
+// The bot token and API key stay out of backups and restores unless the
+// owner sets backup_secrets.
+func TestBackupSecretsOptIn(t *testing.T) {
+	_, _, config := newTestBot(t)
+
+	secrets := []string{"bot-config.json", "apikey"}
+	targets := restoreTargets(config)
+	for _, name := range secrets {
+		if targets[name] {
+			t.Errorf("%s restorable without backup_secrets", name)
+		}
+	}
+	if !targets["users.json"] {
+		t.Error("users.json not restorable")
+	}
+
+	config.BackupSecrets = true
+	targets = restoreTargets(config)
+	for _, name := range secrets {
+		if !targets[name] {
+			t.Errorf("%s not restorable with backup_secrets", name)
+		}
+	}
+	if len(backupFiles) != 5 {
+		t.Errorf("backupSet changed backupFiles: %v", backupFiles)
+	}
+}
+
+// Past the thread limit only the oldest forwarded message stops being
+// replyable.
+func TestSupportThreadEvictsOldest(t *testing.T) {
+	resetBotState()
+
+	for id := 1; id <= SupportThreadLimit+1; id++ {
+		trackSupportThread(id, int64(id))
+	}
+	if _, ok := supportThreads[1]; ok {
+		t.Error("oldest thread kept")
+	}
+	if len(supportThreads) != SupportThreadLimit {
+		t.Errorf("%d threads kept, want %d", len(supportThreads), SupportThreadLimit)
+	}
+	for _, id := range []int{2, SupportThreadLimit, SupportThreadLimit + 1} {
+		if supportThreads[id] != int64(id) {
+			t.Errorf("thread %d lost", id)
+		}
+	}
+}
+
+// Account notes are part of /export.
+func TestExportIncludesNotes(t *testing.T) {
+	bot, _, _ := newTestBot(t)
+	notes["alice"] = []Note{{Text: "pelanggan lama", UpdatedAt: time.Now()}}
+
+	exportSnapshot(bot, testOwnerID)
+
+	for _, c := range bot.sent {
+		doc, ok := c.(tgbotapi.DocumentConfig)
+		if !ok {
+			continue
+		}
+		var snapshot ExportSnapshot
+		if err := json.Unmarshal(doc.File.(tgbotapi.FileBytes).Bytes, &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.SchemaVersion != ExportSchemaVersion {
+			t.Errorf("schema %d, want %d", snapshot.SchemaVersion, ExportSchemaVersion)
+		}
+		if got := snapshot.Notes["alice"]; len(got) != 1 || got[0].Text != "pelanggan lama" {
+			t.Errorf("notes not exported: %+v", snapshot.Notes)
+		}
+		return
+	}
+	t.Fatalf("no export sent: %q", bot.texts())
+}
+
+// Schedule times are entered in the bot's timezone, not the server's.
+func TestScheduleBroadcastUsesBotTimezone(t *testing.T) {
+	bot, _, config := newTestBot(t)
+	config.Timezone = "Asia/Tokyo"
+	loc := botLocation(config)
+	t.Cleanup(func() { scheduledBroadcasts = nil })
+
+	tempUserData[testOwnerID] = map[string]string{"broadcast_text": "halo"}
+	setState(testOwnerID, "broadcast_schedule_time")
+	want := time.Now().In(loc).Add(48 * time.Hour).Truncate(time.Minute)
+	handleMessage(bot, textMessage(testOwnerID, want.Format(ScheduleTimeLayout)), config)
+
+	if len(scheduledBroadcasts) != 1 {
+		t.Fatalf("%d broadcasts scheduled, want 1: %q", len(scheduledBroadcasts), bot.texts())
+	}
+	if got := scheduledBroadcasts[0].At; !got.Equal(want) {
+		t.Errorf("scheduled at %v, want %v", got, want)
+	}
+}
+
+// Maintenance windows are entered in the bot's timezone, not the server's.
+func TestMaintenanceWindowUsesBotTimezone(t *testing.T) {
+	bot, _, config := newTestBot(t)
+	config.Timezone = "Asia/Tokyo"
+	loc := botLocation(config)
+
+	tap(bot, testOwnerID, "maintenance_window", config)
+	start := time.Now().In(loc).Add(48 * time.Hour).Truncate(time.Minute)
+	handleMessage(bot, textMessage(testOwnerID, start.Format(ScheduleTimeLayout)), config)
+	handleMessage(bot, textMessage(testOwnerID, "30"), config)
+
+	window, ok := maintenanceWindowFromTemp(testOwnerID, config)
+	if !ok {
+		t.Fatalf("no window entered: %q", bot.texts())
+	}
+	if !window.Start.Equal(start) || !window.End.Equal(start.Add(30*time.Minute)) {
+		t.Errorf("window %v - %v, want start %v", window.Start, window.End, start)
+	}
+}
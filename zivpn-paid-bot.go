@@ -1,3 +1,7 @@
+//go:build paidbot
+
+// zivpn-paid-bot is built on its own (go build zivpn-paid-bot.go, see install.sh). The tag
+// keeps it out of ./..., which is the free bot and its tests.
 package main
 
 import (
@@ -45,6 +49,24 @@ type BotConfig struct {
 	PakasirSlug    string `json:"pakasir_slug"`
 	PakasirApiKey  string `json:"pakasir_api_key"`
 	DailyPrice     int    `json:"daily_price"`
+
+	// Price display (optional). Locale picks the thousands separator and
+	// symbol placement: "id", "en", "de", "fr". Empty keeps "Rp 10000".
+	Locale         string `json:"locale,omitempty"`
+	CurrencySymbol string `json:"currency_symbol,omitempty"` // Default "Rp"
+}
+
+// NumberFormat describes how a locale writes amounts.
+type NumberFormat struct {
+	Thousands    string
+	SymbolSuffix bool
+}
+
+var numberFormats = map[string]NumberFormat{
+	"id": {Thousands: ".", SymbolSuffix: false},
+	"en": {Thousands: ",", SymbolSuffix: false},
+	"de": {Thousands: ".", SymbolSuffix: true},
+	"fr": {Thousands: " ", SymbolSuffix: true},
 }
 
 type IpInfo struct {
@@ -186,7 +208,7 @@ func handleState(bot *tgbotapi.BotAPI, msg *tgbotapi.Message, state string, conf
 		tempUserData[userID]["password"] = text
 		mutex.Unlock()
 		userStates[userID] = "create_days"
-		sendMessage(bot, chatID, fmt.Sprintf("⏳ Masukkan Durasi (hari)\nHarga: Rp %d / hari:", config.DailyPrice))
+		sendMessage(bot, chatID, fmt.Sprintf("⏳ Masukkan Durasi (hari)\nHarga: %s / hari:", formatPrice(config, config.DailyPrice)))
 
 	case "create_days":
 		days, ok := validateNumber(bot, chatID, text, 1, 365, "Durasi")
@@ -218,7 +240,7 @@ func startCreateUser(bot *tgbotapi.BotAPI, chatID int64, userID int64) {
 func processPayment(bot *tgbotapi.BotAPI, chatID int64, userID int64, days int, config *BotConfig) {
 	price := days * config.DailyPrice
 	if price < 500 {
-		sendMessage(bot, chatID, fmt.Sprintf("❌ Total harga Rp %d. Minimal transaksi adalah Rp 500.\nSilakan tambah durasi.", price))
+		sendMessage(bot, chatID, fmt.Sprintf("❌ Total harga %s. Minimal transaksi adalah %s.\nSilakan tambah durasi.", formatPrice(config, price), formatPrice(config, 500)))
 		return
 	}
 	orderID := fmt.Sprintf("ZIVPN-%d-%d", userID, time.Now().Unix())
@@ -240,8 +262,8 @@ func processPayment(bot *tgbotapi.BotAPI, chatID int64, userID int64, days int,
 	// Generate QR Image URL
 	qrUrl := fmt.Sprintf("https://api.qrserver.com/v1/create-qr-code/?size=300x300&data=%s", payment.PaymentNumber)
 
-	msgText := fmt.Sprintf("💳 **Tagihan Pembayaran**\n\nPassword: `%s`\nDurasi: %d Hari\nTotal: Rp %d\n\nSilakan scan QRIS di atas untuk membayar.\nSistem akan otomatis mengecek pembayaran setiap menit.\nExpired: %s",
-		tempUserData[userID]["password"], days, price, payment.ExpiredAt)
+	msgText := fmt.Sprintf("💳 **Tagihan Pembayaran**\n\nPassword: `%s`\nDurasi: %d Hari\nTotal: %s\n\nSilakan scan QRIS di atas untuk membayar.\nSistem akan otomatis mengecek pembayaran setiap menit.\nExpired: %s",
+		tempUserData[userID]["password"], days, formatPrice(config, price), payment.ExpiredAt)
 
 	photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileURL(qrUrl))
 	photo.Caption = msgText
@@ -381,7 +403,7 @@ func showMainMenu(bot *tgbotapi.BotAPI, chatID int64, config *BotConfig) {
 		domain = "(Not Configured)"
 	}
 
-	msgText := fmt.Sprintf("```\n━━━━━━━━━━━━━━━━━━━━━\n    STORE ZIVPN UDP\n━━━━━━━━━━━━━━━━━━━━━\n • Domain   : %s\n • City     : %s\n • ISP      : %s\n • Harga    : Rp %d / Hari\n━━━━━━━━━━━━━━━━━━━━━\n```\n👇 Silakan pilih menu dibawah ini:", domain, ipInfo.City, ipInfo.Isp, config.DailyPrice)
+	msgText := fmt.Sprintf("```\n━━━━━━━━━━━━━━━━━━━━━\n    STORE ZIVPN UDP\n━━━━━━━━━━━━━━━━━━━━━\n • Domain   : %s\n • City     : %s\n • ISP      : %s\n • Harga    : %s / Hari\n━━━━━━━━━━━━━━━━━━━━━\n```\n👇 Silakan pilih menu dibawah ini:", domain, ipInfo.City, ipInfo.Isp, formatPrice(config, config.DailyPrice))
 
 	msg := tgbotapi.NewMessage(chatID, msgText)
 	msg.ParseMode = "Markdown"
@@ -486,6 +508,37 @@ func validateNumber(bot *tgbotapi.BotAPI, chatID int64, text string, min, max in
 	return val, true
 }
 
+// formatPrice renders an amount for config.Locale. Unknown or empty
+// locales keep the plain "Rp 10000" format.
+func formatPrice(config *BotConfig, amount int) string {
+	symbol := config.CurrencySymbol
+	if symbol == "" {
+		symbol = "Rp"
+	}
+	format, ok := numberFormats[strings.ToLower(config.Locale)]
+	if !ok {
+		return fmt.Sprintf("%s %d", symbol, amount)
+	}
+	number := groupThousands(amount, format.Thousands)
+	if format.SymbolSuffix {
+		return number + " " + symbol
+	}
+	return symbol + " " + number
+}
+
+// groupThousands inserts sep between groups of three digits.
+func groupThousands(n int, sep string) string {
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	digits := strconv.Itoa(n)
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + sep + digits[i:]
+	}
+	return sign + digits
+}
+
 func systemInfo(bot *tgbotapi.BotAPI, chatID int64, config *BotConfig) {
 	res, err := apiCall("GET", "/info", nil)
 	if err != nil {